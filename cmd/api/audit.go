@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"github.com/henrtytanoh/greenlight/internal/data"
+	jsonlog "github.com/henrtytanoh/greenlight/internal/jsonLog"
+	"github.com/henrtytanoh/greenlight/internal/validator"
+)
+
+// audit() appends an event to the audit log. The actor defaults to the authenticated
+// user, and the IP address and request ID are taken from the request. When the request
+// was made with an API key or by a third-party app, that credential is noted too.
+// Failing to record an event is logged but doesn't fail the request. The action it
+// records has already happened, so the event is written even if the client goes away
+// in the meantime.
+func (app *application) audit(r *http.Request, event data.AuditEvent) {
+	if event.ActorID == nil {
+		if user := app.contextGetUser(r); !user.IsAnonymous() {
+			event.ActorID = &user.ID
+		}
+	}
+	event.IP = app.clientIP(r)
+	event.RequestID = app.contextGetRequestID(r)
+
+	if key := app.contextGetAPIKey(r); key != nil {
+		event.Details = withDetail(event.Details, "api_key_id", key.ID)
+	}
+	if token := app.contextGetOAuthToken(r); token != nil {
+		event.Details = withDetail(event.Details, "oauth_client_id", token.ClientID)
+	}
+
+	err := app.models.Audit.Insert(context.WithoutCancel(r.Context()), &event)
+	if err != nil {
+		app.logger.PrintError(err, app.logProperties(r, jsonlog.Properties{"audit_action": event.Action}))
+	}
+}
+
+func withDetail(details map[string]interface{}, key string, value interface{}) map[string]interface{} {
+	if details == nil {
+		details = map[string]interface{}{}
+	}
+	details[key] = value
+	return details
+}
+
+// change is how a modified field is recorded in the details of an audit event.
+type change struct {
+	From interface{} `json:"from"`
+	To   interface{} `json:"to"`
+}
+
+// movieChanges() returns the fields which differ between two versions of a movie.
+func movieChanges(before, after *data.Movie) map[string]interface{} {
+	changes := map[string]interface{}{}
+	if before.Title != after.Title {
+		changes["title"] = change{before.Title, after.Title}
+	}
+	if before.Year != after.Year {
+		changes["year"] = change{before.Year, after.Year}
+	}
+	if before.Runtime != after.Runtime {
+		changes["runtime"] = change{before.Runtime, after.Runtime}
+	}
+	if strings.Join(before.Genres, ",") != strings.Join(after.Genres, ",") {
+		changes["genres"] = change{before.Genres, after.Genres}
+	}
+	return changes
+}
+
+// List audit events, most recent first, optionally filtered by actor, action, outcome,
+// target, IP address, request ID and time range.
+func (app *application) listAuditEventsHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		data.AuditFilters
+		data.Filters
+	}
+
+	v := validator.New()
+	qs := r.URL.Query()
+
+	input.ActorID = int64(app.readInt(qs, "actor_id", 0, v))
+	input.Action = app.readString(qs, "action", "")
+	input.Outcome = app.readString(qs, "outcome", "")
+	input.TargetType = app.readString(qs, "target_type", "")
+	input.TargetID = app.readString(qs, "target_id", "")
+	input.IP = app.readString(qs, "ip", "")
+	input.RequestID = app.readString(qs, "request_id", "")
+	input.Since = app.readTime(qs, "since", v)
+	input.Until = app.readTime(qs, "until", v)
+
+	input.Filters.Page = app.readInt(qs, "page", 1, v)
+	input.Filters.PageSize = app.readInt(qs, "page_size", 20, v)
+	input.Filters.Sort = app.readString(qs, "sort", "-id")
+	input.Filters.SortSafelist = []string{"id", "-id"}
+
+	data.ValidateAuditFilters(v, input.AuditFilters)
+	if data.ValidateFilters(v, input.Filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	events, metadata, err := app.models.Audit.GetAll(r.Context(), input.AuditFilters, input.Filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"audit_events": events, "metadata": metadata}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -9,9 +9,58 @@ import (
 
 type contextKey string
 
-const userContextKey = contextKey("user")
+const (
+	userContextKey   = contextKey("user")
+	apiKeyContextKey = contextKey("apiKey")
+	tokenContextKey  = contextKey("token")
+
+	oauthTokenContextKey = contextKey("oauthToken")
+
+	permissionsContextKey = contextKey("permissions")
+
+	requestInfoContextKey = contextKey("requestInfo")
+)
+
+// requestInfo identifies a request in log entries. It is shared by pointer, so that the
+// route and the user, which are only known further down the middleware chain, are also
+// logged by the middleware wrapping it.
+type requestInfo struct {
+	ID     string
+	Route  string
+	UserID int64
+}
+
+func (app *application) contextSetRequestInfo(r *http.Request, info *requestInfo) *http.Request {
+	ctx := context.WithValue(r.Context(), requestInfoContextKey, info)
+	return r.WithContext(ctx)
+}
+
+// contextGetRequestInfo() returns nil for requests which didn't go through the
+// requestID() middleware.
+func (app *application) contextGetRequestInfo(r *http.Request) *requestInfo {
+	info, _ := r.Context().Value(requestInfoContextKey).(*requestInfo)
+	return info
+}
+
+func (app *application) contextGetRequestID(r *http.Request) string {
+	if info := app.contextGetRequestInfo(r); info != nil {
+		return info.ID
+	}
+	return ""
+}
+
+// contextSetRoute() records the pattern of the route serving the request, for the
+// middleware wrapping the router.
+func (app *application) contextSetRoute(r *http.Request, pattern string) {
+	if info := app.contextGetRequestInfo(r); info != nil {
+		info.Route = pattern
+	}
+}
 
 func (app *application) contextSetUser(r *http.Request, user *data.User) *http.Request {
+	if info := app.contextGetRequestInfo(r); info != nil && !user.IsAnonymous() {
+		info.UserID = user.ID
+	}
 	ctx := context.WithValue(r.Context(), userContextKey, user)
 	return r.WithContext(ctx)
 }
@@ -23,3 +72,58 @@ func (app *application) contextGetUser(r *http.Request) *data.User {
 	}
 	return user
 }
+
+// The API key is only present in the context when the request was authenticated with
+// one, so contextGetAPIKey() returns nil rather than panicking when it is missing.
+func (app *application) contextSetAPIKey(r *http.Request, key *data.APIKey) *http.Request {
+	ctx := context.WithValue(r.Context(), apiKeyContextKey, key)
+	return r.WithContext(ctx)
+}
+
+func (app *application) contextGetAPIKey(r *http.Request) *data.APIKey {
+	key, _ := r.Context().Value(apiKeyContextKey).(*data.APIKey)
+	return key
+}
+
+// Likewise, the OAuth access token is only present when a third-party app is acting on
+// behalf of the user.
+func (app *application) contextSetOAuthToken(r *http.Request, token *data.OAuthToken) *http.Request {
+	ctx := context.WithValue(r.Context(), oauthTokenContextKey, token)
+	return r.WithContext(ctx)
+}
+
+func (app *application) contextGetOAuthToken(r *http.Request) *data.OAuthToken {
+	token, _ := r.Context().Value(oauthTokenContextKey).(*data.OAuthToken)
+	return token
+}
+
+// isDelegated() reports whether the request was made with a credential that only holds
+// part of the user's permissions: an API key or a third-party app's access token. Such
+// credentials must not be able to mint other credentials.
+func (app *application) isDelegated(r *http.Request) bool {
+	return app.contextGetAPIKey(r) != nil || app.contextGetOAuthToken(r) != nil
+}
+
+// The plaintext authentication token is kept in the context so that it can be revoked
+// by the logout handler. It is empty when the request did not use a bearer token.
+func (app *application) contextSetToken(r *http.Request, token string) *http.Request {
+	ctx := context.WithValue(r.Context(), tokenContextKey, token)
+	return r.WithContext(ctx)
+}
+
+func (app *application) contextGetToken(r *http.Request) string {
+	token, _ := r.Context().Value(tokenContextKey).(string)
+	return token
+}
+
+// Signed access tokens carry the user's permissions, in which case they are stored in
+// the context and requirePermission() does not need to query the database.
+func (app *application) contextSetPermissions(r *http.Request, permissions data.Permissions) *http.Request {
+	ctx := context.WithValue(r.Context(), permissionsContextKey, permissions)
+	return r.WithContext(ctx)
+}
+
+func (app *application) contextGetPermissions(r *http.Request) (data.Permissions, bool) {
+	permissions, ok := r.Context().Value(permissionsContextKey).(data.Permissions)
+	return permissions, ok
+}
@@ -3,17 +3,56 @@ package main
 import (
 	"fmt"
 	"net/http"
+	"runtime/debug"
+	"strconv"
+	"time"
+
+	"github.com/henrtytanoh/greenlight/internal/errreport"
+	jsonlog "github.com/henrtytanoh/greenlight/internal/jsonLog"
 )
 
-func (app *application) logError(r *http.Request, err error) {
-	app.logger.PrintFatal(err, map[string]string{
-		"request_method": r.Method,
-		"request_url":    r.URL.String(),
-	})
+// logError() logs an error which failed a request and reports it to the error tracker,
+// unless the client is to blame, in which case it is only a warning.
+func (app *application) logError(r *http.Request, err error) errreport.Class {
+	class := errreport.Classify(err)
+	properties := app.logProperties(r, jsonlog.Properties{"error_class": class})
+
+	if class == errreport.ClassClient {
+		app.logger.PrintWarn(err.Error(), properties)
+		return class
+	}
+	app.logger.PrintError(err, properties)
+
+	if app.errorTracker != nil {
+		event := errreport.Event{
+			Time:   time.Now(),
+			Class:  class,
+			Err:    err,
+			Method: r.Method,
+			// The query string is left out: it can carry secrets, such as the code and
+			// state of an OAuth or OIDC callback.
+			URL: r.URL.Path,
+		}
+		if info := app.contextGetRequestInfo(r); info != nil {
+			event.RequestID = info.ID
+			event.Route = info.Route
+			event.UserID = info.UserID
+		}
+		// Where a transient error happened is of little interest.
+		if class == errreport.ClassBug {
+			event.Stack = string(debug.Stack())
+		}
+		app.errorTracker.Capture(event)
+	}
+	return class
 }
 
+// Error responses carry the request ID, which support can look up in the logs.
 func (app *application) errorResponse(w http.ResponseWriter, r *http.Request, status int, message interface{}) {
 	env := envelope{"error": message}
+	if id := app.contextGetRequestID(r); id != "" {
+		env["request_id"] = id
+	}
 	err := app.writeJSON(w, status, env, nil)
 	if err != nil {
 		app.logError(r, err)
@@ -21,8 +60,14 @@ func (app *application) errorResponse(w http.ResponseWriter, r *http.Request, st
 	}
 }
 
+// Errors caused by an unavailable dependency are reported as such, so that clients know
+// they may retry.
 func (app *application) serverErrorResponse(w http.ResponseWriter, r *http.Request, err error) {
-	app.logError(r, err)
+	if app.logError(r, err) == errreport.ClassTransient {
+		message := "the server is temporarily unable to handle your request, please try again later"
+		app.errorResponse(w, r, http.StatusServiceUnavailable, message)
+		return
+	}
 	message := "the server encountered a problem and could not process your request"
 	app.errorResponse(w, r, http.StatusInternalServerError, message)
 }
@@ -50,11 +95,24 @@ func (app *application) editConflictResponse(w http.ResponseWriter, r *http.Requ
 	app.errorResponse(w, r, http.StatusConflict, message)
 }
 
-func (app *application) rateLimitExceededResponse(w http.ResponseWriter, r *http.Request) {
+func (app *application) rateLimitExceededResponse(w http.ResponseWriter, r *http.Request, retryAfter time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(ceilSeconds(retryAfter)))
 	message := "rate limit exceeded"
 	app.errorResponse(w, r, http.StatusTooManyRequests, message)
 }
 
+func (app *application) rateLimiterUnavailableResponse(w http.ResponseWriter, r *http.Request, retryAfter time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(ceilSeconds(retryAfter)))
+	message := "the server is temporarily unable to handle your request, please try again later"
+	app.errorResponse(w, r, http.StatusServiceUnavailable, message)
+}
+
+func (app *application) loginLockedResponse(w http.ResponseWriter, r *http.Request, retryAfter time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(ceilSeconds(retryAfter)))
+	message := "too many failed login attempts, please try again later"
+	app.errorResponse(w, r, http.StatusTooManyRequests, message)
+}
+
 func (app *application) invalidCredentialsResponse(w http.ResponseWriter, r *http.Request) {
 	message := "invalid authentication credentials"
 	app.errorResponse(w, r, http.StatusUnauthorized, message)
@@ -66,6 +124,33 @@ func (app *application) invalidAuthenticationTokenResponse(w http.ResponseWriter
 	app.errorResponse(w, r, http.StatusUnauthorized, message)
 }
 
+func (app *application) invalidAPIKeyResponse(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("WWW-Authenticate", "ApiKey")
+	message := "invalid, expired or revoked API key"
+	app.errorResponse(w, r, http.StatusUnauthorized, message)
+}
+
+func (app *application) invalidOAuthTokenResponse(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+	message := "invalid, expired or revoked access token"
+	app.errorResponse(w, r, http.StatusUnauthorized, message)
+}
+
+// oauthErrorResponse() sends an error from the OAuth token endpoints, in the format
+// required by RFC 6749 section 5.2 rather than our usual one.
+func (app *application) oauthErrorResponse(w http.ResponseWriter, r *http.Request, status int, code, description string) {
+	headers := http.Header{"Cache-Control": []string{"no-store"}}
+	if status == http.StatusUnauthorized {
+		headers.Set("WWW-Authenticate", `Basic realm="greenlight"`)
+	}
+	env := envelope{"error": code, "error_description": description}
+	err := app.writeJSON(w, status, env, headers)
+	if err != nil {
+		app.logError(r, err)
+		w.WriteHeader(500)
+	}
+}
+
 func (app *application) authenticationRequiredResponse(w http.ResponseWriter, r *http.Request) {
 	message := "you must be authenticated to access this resource"
 	app.errorResponse(w, r, http.StatusUnauthorized, message)
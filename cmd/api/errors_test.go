@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/henrtytanoh/greenlight/internal/errreport"
+)
+
+// recordingTracker keeps the events it captures.
+type recordingTracker struct {
+	events []errreport.Event
+}
+
+func (t *recordingTracker) Capture(event errreport.Event) {
+	t.events = append(t.events, event)
+}
+
+func (t *recordingTracker) Close(ctx context.Context) error {
+	return nil
+}
+
+func TestLogErrorLeavesOutTheQuery(t *testing.T) {
+	app, _ := newTestApplication(t)
+	tracker := &recordingTracker{}
+	app.errorTracker = tracker
+
+	r := httptest.NewRequest(http.MethodGet, "/v1/oidc/example/callback?code=secret-code&state=secret-state", nil)
+	app.serverErrorResponse(httptest.NewRecorder(), r, errors.New("exchange failed"))
+
+	if len(tracker.events) != 1 {
+		t.Fatalf("got %d events; want 1", len(tracker.events))
+	}
+	event := tracker.events[0]
+	if event.URL != "/v1/oidc/example/callback" {
+		t.Errorf("got URL %q; want the path without the query", event.URL)
+	}
+}
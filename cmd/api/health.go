@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	jsonlog "github.com/henrtytanoh/greenlight/internal/jsonLog"
+	"github.com/henrtytanoh/greenlight/migrations"
+)
+
+const (
+	componentUp       = "up"
+	componentDown     = "down"
+	componentDisabled = "disabled"
+)
+
+// componentHealth is the result of checking one of the API's dependencies.
+type componentHealth struct {
+	Status   string `json:"status"`
+	Required bool   `json:"required"`
+	Message  string `json:"message,omitempty"`
+	Duration string `json:"duration,omitempty"`
+}
+
+// healthCheck checks a dependency within its own timeout. The message it returns is
+// shown to whoever asks, so it must not reveal more than a version number; errors are
+// only logged.
+type healthCheck struct {
+	name     string
+	timeout  time.Duration
+	required bool
+	enabled  bool
+	check    func(ctx context.Context) (string, error)
+}
+
+// The API is alive as long as it answers: restarting it wouldn't fix a dependency.
+func (app *application) livenessHandler(w http.ResponseWriter, r *http.Request) {
+	env := envelope{
+		"status": "alive",
+		"system_info": map[string]string{
+			"environment": app.config.env,
+			"version":     version,
+		},
+	}
+
+	err := app.writeJSON(w, http.StatusOK, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The API is ready when Postgres and redis answer and the database schema is the one it
+// was built for. SMTP is optional: emails are sent in the background and retried, so
+// an unreachable server only makes the API degraded.
+func (app *application) readinessHandler(w http.ResponseWriter, r *http.Request) {
+	cfg := app.config.health
+	checks := []healthCheck{
+		{name: "database", timeout: cfg.dbTimeout, required: true, enabled: true, check: app.checkDatabase},
+		{name: "migrations", timeout: cfg.dbTimeout, required: true, enabled: true, check: app.checkMigrations},
+		{name: "redis", timeout: cfg.redisTimeout, required: true, enabled: true, check: app.checkRedis},
+		{name: "smtp", timeout: cfg.smtpTimeout, required: false, enabled: cfg.checkSMTP, check: app.checkSMTP},
+	}
+
+	components := make(map[string]componentHealth, len(checks))
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, check := range checks {
+		if !check.enabled {
+			components[check.name] = componentHealth{Status: componentDisabled, Required: check.required}
+			continue
+		}
+
+		wg.Add(1)
+		go func(check healthCheck) {
+			defer wg.Done()
+			health := app.runHealthCheck(r, check)
+			mu.Lock()
+			components[check.name] = health
+			mu.Unlock()
+		}(check)
+	}
+	wg.Wait()
+
+	status, code := "ready", http.StatusOK
+	for _, health := range components {
+		if health.Status != componentDown {
+			continue
+		}
+		if health.Required {
+			status, code = "unavailable", http.StatusServiceUnavailable
+			break
+		}
+		status = "degraded"
+	}
+
+	err := app.writeJSON(w, code, envelope{"status": status, "components": components}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) runHealthCheck(r *http.Request, check healthCheck) componentHealth {
+	ctx, cancel := context.WithTimeout(r.Context(), check.timeout)
+	defer cancel()
+
+	start := time.Now()
+	message, err := check.check(ctx)
+	health := componentHealth{
+		Status:   componentUp,
+		Required: check.required,
+		Message:  message,
+		Duration: time.Since(start).String(),
+	}
+	if err != nil {
+		app.logger.PrintWarn(err.Error(), app.logProperties(r, jsonlog.Properties{"component": check.name}))
+		health.Status = componentDown
+		if message == "" {
+			health.Message = "unreachable"
+			if errors.Is(err, context.DeadlineExceeded) {
+				health.Message = "timed out after " + check.timeout.String()
+			}
+		}
+	}
+	return health
+}
+
+func (app *application) checkDatabase(ctx context.Context) (string, error) {
+	return "", app.models.Schema.Ping(ctx)
+}
+
+func (app *application) checkRedis(ctx context.Context) (string, error) {
+	return "", app.redisClient.Ping(ctx).Err()
+}
+
+func (app *application) checkSMTP(ctx context.Context) (string, error) {
+	return "", app.mailer.Ping(ctx)
+}
+
+// checkMigrations() compares the schema version of the database with the latest
+// migration this build embeds. A newer schema is accepted: during a rolling update the
+// migrations run before the last old instances are replaced, and migrations are kept
+// backward compatible.
+func (app *application) checkMigrations(ctx context.Context) (string, error) {
+	expected, err := migrations.Version()
+	if err != nil {
+		return "", err
+	}
+	current, dirty, err := app.models.Schema.Version(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	switch {
+	case dirty:
+		message := fmt.Sprintf("migration %d failed halfway", current)
+		return message, errors.New(message)
+	case current < expected:
+		message := fmt.Sprintf("database is at version %d, expected %d", current, expected)
+		return message, errors.New(message)
+	default:
+		return fmt.Sprintf("version %d", current), nil
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/henrtytanoh/greenlight/internal/ratelimit"
+	"github.com/redis/go-redis/v9"
+)
+
+func TestProbesSkipRateLimiting(t *testing.T) {
+	app, _ := newTestApplication(t)
+
+	// Nothing listens on the port, and the closed fallback rejects every request
+	// while redis is unavailable.
+	client := redis.NewClient(&redis.Options{Addr: "127.0.0.1:1", MaxRetries: -1})
+	t.Cleanup(func() { client.Close() })
+
+	policies := enableTestRateLimits(t, app, client, ratelimit.FallbackClosed)
+
+	// Opening the database doesn't connect to it; the metrics only read its pool stats.
+	db, err := sql.Open("postgres", "postgres://127.0.0.1:1/greenlight")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	app.m = NewMetrics(db, client, policies.Degraded)
+
+	handler := app.routes()
+
+	tests := []struct {
+		path       string
+		wantStatus int
+	}{
+		{"/v1/health/live", http.StatusOK},
+		{"/v1/healthcheck", http.StatusOK},
+		{"/metrics", http.StatusOK},
+		{"/v1/plans", http.StatusServiceUnavailable},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, tt.path, nil)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != tt.wantStatus {
+			t.Errorf("%s: got status %d; want %d", tt.path, w.Code, tt.wantStatus)
+		}
+	}
+}
@@ -5,11 +5,18 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"math"
+	"net"
 	"net/http"
+	"net/netip"
 	"net/url"
+	"runtime/debug"
 	"strconv"
 	"strings"
+	"time"
 
+	"github.com/henrtytanoh/greenlight/internal/errreport"
+	jsonlog "github.com/henrtytanoh/greenlight/internal/jsonLog"
 	"github.com/henrtytanoh/greenlight/internal/validator"
 	"github.com/julienschmidt/httprouter"
 )
@@ -135,6 +142,50 @@ func (app *application) readInt(qs url.Values, key string, defaultValue int, v *
 	return i
 }
 
+// The readTime() helper reads an RFC 3339 timestamp from the query string. If no
+// matching key could be found it returns the zero time, and if the value isn't a valid
+// timestamp it records an error message in the provided Validator instance.
+func (app *application) readTime(qs url.Values, key string, v *validator.Validator) time.Time {
+	s := qs.Get(key)
+	if s == "" {
+		return time.Time{}
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		v.AddError(key, "must be an RFC 3339 timestamp")
+		return time.Time{}
+	}
+	return t
+}
+
+// ceilSeconds() rounds a duration up to whole seconds, as used by headers such as
+// Retry-After.
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
+
+// logProperties() returns the properties identifying the request in log entries (its
+// ID, method, URL, route and user) together with the given ones.
+func (app *application) logProperties(r *http.Request, properties jsonlog.Properties) jsonlog.Properties {
+	merged := jsonlog.Properties{
+		"request_method": r.Method,
+		"request_url":    r.URL.String(),
+	}
+	if info := app.contextGetRequestInfo(r); info != nil {
+		merged["request_id"] = info.ID
+		if info.Route != "" {
+			merged["route"] = info.Route
+		}
+		if info.UserID != 0 {
+			merged["user_id"] = info.UserID
+		}
+	}
+	for key, value := range properties {
+		merged[key] = value
+	}
+	return merged
+}
+
 // The background() helper accepts an arbitrary function as a parameter.
 func (app *application) background(fn func()) {
 	app.wg.Add(1)
@@ -144,10 +195,66 @@ func (app *application) background(fn func()) {
 		// Recover any panic.
 		defer func() {
 			if err := recover(); err != nil {
-				app.logger.PrintError(fmt.Errorf("%s", err), nil)
+				err := fmt.Errorf("%s", err)
+				app.logger.PrintError(err, nil)
+				if app.errorTracker != nil {
+					app.errorTracker.Capture(errreport.Event{
+						Time:  time.Now(),
+						Class: errreport.ClassBug,
+						Err:   err,
+						Stack: string(debug.Stack()),
+					})
+				}
 			}
 		}()
 		// Execute the arbitrary function that we passed as the parameter.
 		fn()
 	}()
 }
+
+// clientIP() returns the IP address of the client. The X-Forwarded-For and X-Real-IP
+// headers are only believed when the request comes from one of the -trusted-proxies,
+// since anyone can send them: otherwise a client could pick the address its requests
+// are rate limited, locked out and audited by. X-Forwarded-For is read from the right,
+// each trusted proxy having appended the address it received the request from, up to
+// the first address which isn't a trusted proxy.
+func (app *application) clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	remote, err := netip.ParseAddr(host)
+	if err != nil || !app.isTrustedProxy(remote) {
+		return host
+	}
+
+	if values := r.Header.Values("X-Forwarded-For"); len(values) > 0 {
+		addrs := strings.Split(strings.Join(values, ","), ",")
+		for i := len(addrs) - 1; i >= 0; i-- {
+			addr, err := netip.ParseAddr(strings.TrimSpace(addrs[i]))
+			if err != nil {
+				break
+			}
+			host = addr.Unmap().String()
+			if !app.isTrustedProxy(addr) {
+				break
+			}
+		}
+		return host
+	}
+
+	if addr, err := netip.ParseAddr(strings.TrimSpace(r.Header.Get("X-Real-IP"))); err == nil {
+		return addr.Unmap().String()
+	}
+	return host
+}
+
+func (app *application) isTrustedProxy(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, prefix := range app.config.trustedProxies {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
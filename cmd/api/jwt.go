@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/henrtytanoh/greenlight/internal/data"
+	jsonlog "github.com/henrtytanoh/greenlight/internal/jsonLog"
+	"github.com/henrtytanoh/greenlight/internal/jwt"
+)
+
+// Supported values for the -auth-mode flag. In token mode every request looks up its
+// opaque bearer token in Postgres. In jwt mode logins are issued a short-lived signed
+// access token carrying the user's permissions, plus an opaque refresh token.
+const (
+	authModeToken = "token"
+	authModeJWT   = "jwt"
+)
+
+// How often the signing keys are re-read from the database and, if needed, rotated.
+const signingKeyRefreshInterval = time.Minute
+
+// accessClaims are the claims carried by a stateless access token.
+type accessClaims struct {
+	jwt.Claims
+	Activated   bool             `json:"activated"`
+	Permissions data.Permissions `json:"permissions"`
+}
+
+// keyRing holds the signing keys which are currently valid, newest first.
+type keyRing struct {
+	mu         sync.RWMutex
+	keys       []*data.SigningKey
+	lastReload time.Time
+}
+
+func (k *keyRing) set(keys []*data.SigningKey) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.keys = keys
+	k.lastReload = time.Now()
+}
+
+func (k *keyRing) current() *data.SigningKey {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	if len(k.keys) == 0 {
+		return nil
+	}
+	return k.keys[0]
+}
+
+func (k *keyRing) lookup(keyID string) *data.SigningKey {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	for _, key := range k.keys {
+		if key.ID == keyID {
+			return key
+		}
+	}
+	return nil
+}
+
+// The JWKS document publishes the public half of every valid key, so that tokens signed
+// with a key that has just been rotated out can still be verified by other services.
+func (k *keyRing) jwks() (jwt.JWKS, error) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	set := jwt.JWKS{Keys: []jwt.JWK{}}
+	for _, key := range k.keys {
+		jwk, err := jwt.NewJWK(key.ID, signerFor(key).Public())
+		if err != nil {
+			return set, err
+		}
+		set.Keys = append(set.Keys, jwk)
+	}
+	return set, nil
+}
+
+func signerFor(key *data.SigningKey) crypto.Signer {
+	return ed25519.NewKeyFromSeed(key.PrivateKey)
+}
+
+// rotateSigningKeys() loads the valid signing keys and creates a new one when the newest
+// key is older than the rotation interval. A key keeps verifying tokens for one access
+// token lifetime after it stops being used for signing.
+func (app *application) rotateSigningKeys(ctx context.Context) error {
+	keys, err := app.models.SigningKeys.GetAllActive(ctx)
+	if err != nil {
+		return err
+	}
+
+	if len(keys) == 0 || time.Since(keys[0].CreatedAt) >= app.config.auth.keyRotation {
+		_, private, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return err
+		}
+		id := make([]byte, 8)
+		_, err = rand.Read(id)
+		if err != nil {
+			return err
+		}
+		key := &data.SigningKey{
+			ID:         hex.EncodeToString(id),
+			Algorithm:  jwt.AlgEdDSA,
+			PrivateKey: private.Seed(),
+			RetiresAt:  time.Now().Add(app.config.auth.keyRotation + app.config.auth.accessTokenTTL),
+		}
+		err = app.models.SigningKeys.Insert(ctx, key)
+		if err != nil {
+			return err
+		}
+		app.logger.PrintInfo("rotated access token signing key", jsonlog.Properties{"kid": key.ID})
+		keys = append([]*data.SigningKey{key}, keys...)
+	}
+
+	app.signingKeys.set(keys)
+	return app.models.SigningKeys.DeleteRetired(ctx)
+}
+
+// runSigningKeyRotation() keeps the key ring up to date for the lifetime of the process.
+func (app *application) runSigningKeyRotation() {
+	ticker := time.NewTicker(signingKeyRefreshInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		err := app.rotateSigningKeys(context.Background())
+		if err != nil {
+			app.logger.PrintError(err, nil)
+		}
+	}
+}
+
+// publicKeyFor() returns the jwt.KeyFunc used to verify access tokens. A key minted by
+// another replica may not have been loaded yet, so on a miss we reload the ring from the
+// database, at most once every few seconds, within ctx.
+func (app *application) publicKeyFor(ctx context.Context) jwt.KeyFunc {
+	return func(header jwt.Header) (crypto.PublicKey, error) {
+		key := app.signingKeys.lookup(header.KeyID)
+		if key == nil {
+			app.signingKeys.mu.RLock()
+			stale := time.Since(app.signingKeys.lastReload) > 5*time.Second
+			app.signingKeys.mu.RUnlock()
+			if stale {
+				keys, err := app.models.SigningKeys.GetAllActive(ctx)
+				if err != nil {
+					return nil, err
+				}
+				app.signingKeys.set(keys)
+				key = app.signingKeys.lookup(header.KeyID)
+			}
+		}
+		if key == nil {
+			return nil, jwt.ErrUnknownKey
+		}
+		return signerFor(key).Public(), nil
+	}
+}
+
+// newAccessToken() signs an access token for the user. It is returned as a data.Token so
+// that clients receive the same {"token", "expiry"} shape in both auth modes.
+func (app *application) newAccessToken(user *data.User, permissions data.Permissions) (*data.Token, error) {
+	key := app.signingKeys.current()
+	if key == nil {
+		return nil, errors.New("no access token signing key available")
+	}
+
+	now := time.Now()
+	expiry := now.Add(app.config.auth.accessTokenTTL)
+	claims := accessClaims{
+		Claims: jwt.Claims{
+			Issuer:    app.config.auth.issuer,
+			Subject:   strconv.FormatInt(user.ID, 10),
+			IssuedAt:  now.Unix(),
+			ExpiresAt: expiry.Unix(),
+		},
+		Activated:   user.Activated,
+		Permissions: permissions,
+	}
+
+	signed, err := jwt.Sign(claims, key.ID, signerFor(key))
+	if err != nil {
+		return nil, err
+	}
+
+	return &data.Token{
+		Plaintext: signed,
+		UserID:    user.ID,
+		Expiry:    expiry,
+		Scope:     data.ScopeAuthentication,
+	}, nil
+}
+
+// parseAccessToken() verifies an access token and returns its claims.
+func (app *application) parseAccessToken(ctx context.Context, token string) (*accessClaims, error) {
+	var claims accessClaims
+	_, err := jwt.Parse(token, app.publicKeyFor(ctx), &claims)
+	if err != nil {
+		return nil, err
+	}
+	err = claims.Validate(time.Now(), 30*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	if claims.Issuer != app.config.auth.issuer {
+		return nil, errors.New("access token issued by an unknown issuer")
+	}
+	return &claims, nil
+}
+
+func (app *application) jwksHandler(w http.ResponseWriter, r *http.Request) {
+	set, err := app.signingKeys.jwks()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"keys": set.Keys}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
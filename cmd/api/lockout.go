@@ -0,0 +1,246 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/henrtytanoh/greenlight/internal/data"
+	jsonlog "github.com/henrtytanoh/greenlight/internal/jsonLog"
+	"github.com/henrtytanoh/greenlight/internal/validator"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	// The first delay applied once the delay threshold is reached. It doubles with
+	// every further failure, up to maxLoginDelay.
+	baseLoginDelay = time.Second
+	maxLoginDelay  = time.Minute
+)
+
+// incrementFailures atomically increments a failure counter and starts its window on
+// the first failure, so that a crash between the two steps cannot leave a counter
+// which never expires.
+var incrementFailures = redis.NewScript(`
+local count = redis.call("INCR", KEYS[1])
+if count == 1 then
+	redis.call("PEXPIRE", KEYS[1], ARGV[1])
+end
+return count
+`)
+
+// loginLockout is the brute-force protection state of an email address or IP address.
+type loginLockout struct {
+	Failures     int64      `json:"failures"`
+	LockedUntil  *time.Time `json:"locked_until,omitempty"`
+	DelayedUntil *time.Time `json:"delayed_until,omitempty"`
+}
+
+// Failed logins are tracked both per email address, to protect a single account, and
+// per IP address, to slow down a client spraying guesses across many accounts.
+func loginKey(kind, subject, value string) string {
+	return "login:" + kind + ":" + subject + ":" + strings.ToLower(value)
+}
+
+// loginRetryAfter() returns how long the client has to wait before it may try to log in
+// again, or zero if it may try now.
+func (app *application) loginRetryAfter(ctx context.Context, email, ip string) (time.Duration, error) {
+	pipe := app.redisClient.Pipeline()
+	ttls := []*redis.DurationCmd{
+		pipe.PTTL(ctx, loginKey("lockout", "email", email)),
+		pipe.PTTL(ctx, loginKey("lockout", "ip", ip)),
+		pipe.PTTL(ctx, loginKey("delay", "email", email)),
+	}
+	_, err := pipe.Exec(ctx)
+	if err != nil && !errors.Is(err, redis.Nil) {
+		return 0, err
+	}
+
+	var retryAfter time.Duration
+	for _, ttl := range ttls {
+		// PTTL returns a negative value when the key does not exist.
+		if ttl.Val() > retryAfter {
+			retryAfter = ttl.Val()
+		}
+	}
+	return retryAfter, nil
+}
+
+// recordLoginFailure() counts a failed login. Past the delay threshold each further
+// failure makes the client wait twice as long, and past the lockout threshold the
+// account is locked and its owner notified. The user is nil when the email address
+// does not belong to anyone; the failure is still counted so that responses don't
+// reveal which addresses are registered.
+func (app *application) recordLoginFailure(r *http.Request, email string, user *data.User) error {
+	ctx := r.Context()
+	ip := app.clientIP(r)
+	cfg := app.config.login
+	window := cfg.failureWindow.Milliseconds()
+
+	emailFailures, err := incrementFailures.Run(ctx, app.redisClient, []string{loginKey("failures", "email", email)}, window).Int64()
+	if err != nil {
+		return err
+	}
+	ipFailures, err := incrementFailures.Run(ctx, app.redisClient, []string{loginKey("failures", "ip", ip)}, window).Int64()
+	if err != nil {
+		return err
+	}
+
+	if ipFailures >= int64(cfg.ipLockoutThreshold) {
+		err = app.redisClient.Set(ctx, loginKey("lockout", "ip", ip), ipFailures, cfg.lockoutDuration).Err()
+		if err != nil {
+			return err
+		}
+		app.logger.PrintError(errors.New("too many failed logins, locking out ip"), app.logProperties(r, jsonlog.Properties{"ip": ip}))
+	}
+
+	switch {
+	case emailFailures >= int64(cfg.lockoutThreshold):
+		err = app.redisClient.Set(ctx, loginKey("lockout", "email", email), emailFailures, cfg.lockoutDuration).Err()
+		if err != nil {
+			return err
+		}
+		err = app.redisClient.Del(ctx, loginKey("failures", "email", email), loginKey("delay", "email", email)).Err()
+		if err != nil {
+			return err
+		}
+		app.logger.PrintError(errors.New("too many failed logins, locking account"), app.logProperties(r, jsonlog.Properties{"email": email}))
+
+		if user != nil {
+			lockedUntil := time.Now().Add(cfg.lockoutDuration).UTC().Format(time.RFC1123)
+			app.background(func() {
+				data := map[string]interface{}{
+					"failures":    emailFailures,
+					"lockedUntil": lockedUntil,
+				}
+				err := app.mailer.Send(backgroundContext(r), user.Email, "account_locked.tmpl", data)
+				if err != nil {
+					app.logger.PrintError(err, app.logProperties(r, nil))
+				}
+			})
+		}
+
+	case emailFailures >= int64(cfg.delayThreshold):
+		exponent := float64(emailFailures - int64(cfg.delayThreshold))
+		delay := time.Duration(math.Min(float64(baseLoginDelay)*math.Pow(2, exponent), float64(maxLoginDelay)))
+		err = app.redisClient.Set(ctx, loginKey("delay", "email", email), emailFailures, delay).Err()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// resetLoginFailures() forgets the failures of an account after a successful login.
+func (app *application) resetLoginFailures(ctx context.Context, email string) error {
+	return app.redisClient.Del(ctx, loginKey("failures", "email", email), loginKey("delay", "email", email)).Err()
+}
+
+func (app *application) getLoginLockout(ctx context.Context, subject, value string) (loginLockout, error) {
+	var state loginLockout
+
+	pipe := app.redisClient.Pipeline()
+	failures := pipe.Get(ctx, loginKey("failures", subject, value))
+	lockout := pipe.PTTL(ctx, loginKey("lockout", subject, value))
+	delay := pipe.PTTL(ctx, loginKey("delay", subject, value))
+	_, err := pipe.Exec(ctx)
+	if err != nil && !errors.Is(err, redis.Nil) {
+		return state, err
+	}
+
+	state.Failures, _ = failures.Int64()
+	if ttl := lockout.Val(); ttl > 0 {
+		until := time.Now().Add(ttl).UTC()
+		state.LockedUntil = &until
+	}
+	if ttl := delay.Val(); ttl > 0 {
+		until := time.Now().Add(ttl).UTC()
+		state.DelayedUntil = &until
+	}
+	return state, nil
+}
+
+func (app *application) readLockoutParams(w http.ResponseWriter, r *http.Request) (string, string, bool) {
+	qs := r.URL.Query()
+	email := app.readString(qs, "email", "")
+	ip := app.readString(qs, "ip", "")
+
+	v := validator.New()
+	v.Check(email != "" || ip != "", "email", "an email or ip must be provided")
+	if email != "" {
+		data.ValidateEmail(v, email)
+	}
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return "", "", false
+	}
+	return email, ip, true
+}
+
+// Show the lockout state of an email address and/or IP address.
+func (app *application) showLoginLockoutHandler(w http.ResponseWriter, r *http.Request) {
+	email, ip, ok := app.readLockoutParams(w, r)
+	if !ok {
+		return
+	}
+
+	env := envelope{}
+	if email != "" {
+		state, err := app.getLoginLockout(r.Context(), "email", email)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		env["email"] = state
+	}
+	if ip != "" {
+		state, err := app.getLoginLockout(r.Context(), "ip", ip)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		env["ip"] = state
+	}
+
+	err := app.writeJSON(w, http.StatusOK, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Lift the lockout of an email address and/or IP address, and reset its failures.
+func (app *application) deleteLoginLockoutHandler(w http.ResponseWriter, r *http.Request) {
+	email, ip, ok := app.readLockoutParams(w, r)
+	if !ok {
+		return
+	}
+
+	var keys []string
+	if email != "" {
+		keys = append(keys, loginKey("failures", "email", email), loginKey("delay", "email", email), loginKey("lockout", "email", email))
+	}
+	if ip != "" {
+		keys = append(keys, loginKey("failures", "ip", ip), loginKey("lockout", "ip", ip))
+	}
+
+	err := app.redisClient.Del(r.Context(), keys...).Err()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.audit(r, data.AuditEvent{
+		Action:  data.AuditLockoutLift,
+		Outcome: data.AuditSuccess,
+		Details: map[string]interface{}{"email": email, "ip": ip},
+	})
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "lockout successfully lifted"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -3,8 +3,13 @@ package main
 import (
 	"context"
 	"database/sql"
+	"errors"
 	"flag"
 	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"net/netip"
 	"os"
 	"strconv"
 	"strings"
@@ -12,27 +17,37 @@ import (
 	"time"
 
 	"github.com/henrtytanoh/greenlight/internal/data"
+	"github.com/henrtytanoh/greenlight/internal/errreport"
 	jsonlog "github.com/henrtytanoh/greenlight/internal/jsonLog"
 	"github.com/henrtytanoh/greenlight/internal/mailer"
+	"github.com/henrtytanoh/greenlight/internal/oidc"
+	"github.com/henrtytanoh/greenlight/internal/payments"
+	"github.com/henrtytanoh/greenlight/internal/ratelimit"
 	_ "github.com/lib/pq"
-	"github.com/prometheus/client_golang/prometheus"
+	"github.com/redis/go-redis/extra/redisotel/v9"
 	"github.com/redis/go-redis/v9"
 )
 
 type config struct {
-	port int
-	env  string
-	db   struct {
+	port           int
+	env            string
+	requestTimeout time.Duration
+	db             struct {
 		dsn          string
 		maxOpenConns int
 		maxIdleConns int
 		maxIdleTime  string
+		queryTimeout time.Duration
 	}
 
 	limiter struct {
 		windowLength int
 		requestLimit int
+		authLimit    int
 		enabled      bool
+		strategy     string
+		policiesFile string
+		fallback     ratelimit.Fallback
 	}
 
 	smtp struct {
@@ -47,19 +62,86 @@ type config struct {
 		trustedOrigins []string
 	}
 
+	trustedProxies []netip.Prefix
+
 	redis struct {
 		dsn string
 	}
-}
 
-// prometheus metrics config
-type metrics struct {
-	totalRequestReceived prometheus.Counter
-	requestDuration      prometheus.Gauge
-	totalResponsesSent   prometheus.Counter
-	totalInternalServer  prometheus.Counter
-	totalClientSideError prometheus.Counter
+	log struct {
+		level         string
+		stackLevel    string
+		requestSample float64
+	}
+
+	health struct {
+		dbTimeout    time.Duration
+		redisTimeout time.Duration
+		smtpTimeout  time.Duration
+		checkSMTP    bool
+	}
+
+	errorTracker struct {
+		dsn string
+	}
+
+	otel struct {
+		endpoint    string
+		insecure    bool
+		serviceName string
+		sampleRatio float64
+	}
+
+	users struct {
+		defaultRole string
+	}
+
+	auth struct {
+		mode            string
+		issuer          string
+		accessTokenTTL  time.Duration
+		refreshTokenTTL time.Duration
+		keyRotation     time.Duration
+		totpIssuer      string
+	}
+
+	argon2 struct {
+		memory      uint
+		iterations  uint
+		parallelism uint
+	}
+
+	subscriptions struct {
+		checkInterval time.Duration
+		renewalGrace  time.Duration
+		checkoutTTL   time.Duration
+	}
+
+	payments struct {
+		provider      string
+		webhookSecret string
+		fakeURL       string
+	}
+
+	oidc struct {
+		providersFile string
+	}
+
+	passwords struct {
+		minLength    int
+		minClasses   int
+		breachedFile string
+	}
+
+	login struct {
+		failureWindow      time.Duration
+		delayThreshold     int
+		lockoutThreshold   int
+		lockoutDuration    time.Duration
+		ipLockoutThreshold int
+	}
 }
+
 type application struct {
 	config      config
 	logger      *jsonlog.Logger
@@ -68,6 +150,12 @@ type application struct {
 	wg          sync.WaitGroup
 	m           *metrics
 	redisClient *redis.Client
+	signingKeys *keyRing
+
+	oidcProviders map[string]*oidc.Provider
+	payments      payments.PaymentProvider
+	rateLimits    *ratelimit.Policies
+	errorTracker  errreport.Tracker
 }
 
 var (
@@ -81,15 +169,25 @@ func main() {
 
 	flag.IntVar(&cfg.port, "port", getPortFromEnv(), "API server port")
 	flag.StringVar(&cfg.env, "env", "development", "Environment (development|staging|production)")
+	flag.DurationVar(&cfg.requestTimeout, "request-timeout", 20*time.Second, "Deadline of each request, after which its database queries are canceled (0 for none)")
 	flag.StringVar(&cfg.db.dsn, "db-dsn", "", "PostgreSQL DSN")
 	flag.StringVar(&cfg.redis.dsn, "redis-dsn", "", "REDIS DSN")
 	flag.IntVar(&cfg.db.maxOpenConns, "db-max-open-conns", 25, "PostgreSQL max open connections")
 	flag.IntVar(&cfg.db.maxIdleConns, "db-max-idle-conns", 25, "PostgreSQL max idle connections")
 	flag.StringVar(&cfg.db.maxIdleTime, "db-max-idle-time", "15m", "PostgreSQL max connection idle time")
+	flag.DurationVar(&cfg.db.queryTimeout, "db-query-timeout", 3*time.Second, "PostgreSQL query timeout (0 to only use the request deadline)")
 
 	flag.IntVar(&cfg.limiter.windowLength, "window-length", 1, "Length of window")
 	flag.IntVar(&cfg.limiter.requestLimit, "request-limit", 100, "Maxmium request per window length")
 	flag.BoolVar(&cfg.limiter.enabled, "limiter-enabled", true, "Enable rate limiter")
+	flag.StringVar(&cfg.limiter.strategy, "limiter-strategy", ratelimit.SlidingWindow, "Rate limiting strategy ("+strings.Join(ratelimit.Strategies, "|")+")")
+	flag.StringVar(&cfg.limiter.fallback.Mode, "limiter-fallback", ratelimit.FallbackLocal, "What to do while redis is unavailable: count requests in process (local), allow them (open) or reject them (closed)")
+	flag.IntVar(&cfg.limiter.fallback.FailureThreshold, "limiter-breaker-failures", 5, "Consecutive redis errors before the rate limiter stops trying redis")
+	flag.DurationVar(&cfg.limiter.fallback.Cooldown, "limiter-breaker-cooldown", 10*time.Second, "How long the rate limiter stops trying redis after it failed")
+	flag.DurationVar(&cfg.limiter.fallback.Timeout, "limiter-redis-timeout", 250*time.Millisecond, "Timeout of the rate limiter's redis calls")
+	flag.IntVar(&cfg.limiter.fallback.LocalSize, "limiter-local-size", 10000, "Clients tracked per policy by the in-process fallback limiter")
+	flag.IntVar(&cfg.limiter.authLimit, "limiter-auth-limit", 100, "Maximum requests with credentials per IP address and window length, counted before the credentials are checked")
+	flag.StringVar(&cfg.limiter.policiesFile, "limiter-policies", "", "JSON file of rate limiting policies (default: -request-limit per -window-length for everyone)")
 
 	flag.StringVar(&cfg.smtp.host, "smtp-host", "", "SMTP host")
 	flag.IntVar(&cfg.smtp.port, "smtp-port", 25, "SMTP port")
@@ -97,11 +195,76 @@ func main() {
 	flag.StringVar(&cfg.smtp.password, "smtp-password", "", "SMTP password")
 	flag.StringVar(&cfg.smtp.sender, "smtp-sender", "Greenlight <no-reply@greenlight.henrygtanoh.net>", "SMTP sender")
 
+	flag.StringVar(&cfg.users.defaultRole, "default-role", "viewer", "Role granted to newly registered users")
+
+	flag.StringVar(&cfg.auth.mode, "auth-mode", authModeToken, "Authentication mode (token|jwt)")
+	flag.StringVar(&cfg.auth.issuer, "jwt-issuer", "greenlight", "Issuer of signed access tokens")
+	flag.DurationVar(&cfg.auth.accessTokenTTL, "jwt-access-ttl", 15*time.Minute, "Lifetime of signed access tokens")
+	flag.DurationVar(&cfg.auth.refreshTokenTTL, "jwt-refresh-ttl", 30*24*time.Hour, "Lifetime of refresh tokens")
+	flag.DurationVar(&cfg.auth.keyRotation, "jwt-key-rotation", 24*time.Hour, "How often the access token signing key is rotated")
+
+	flag.StringVar(&cfg.auth.totpIssuer, "totp-issuer", "Greenlight", "Issuer name shown in authenticator apps")
+
+	flag.UintVar(&cfg.argon2.memory, "argon2-memory", 64*1024, "Argon2id password hashing memory in KiB")
+	flag.UintVar(&cfg.argon2.iterations, "argon2-iterations", 3, "Argon2id password hashing iterations")
+	flag.UintVar(&cfg.argon2.parallelism, "argon2-parallelism", 2, "Argon2id password hashing parallelism")
+
+	flag.DurationVar(&cfg.subscriptions.checkInterval, "subscription-check-interval", time.Minute, "How often subscriptions are checked for expiry")
+	flag.DurationVar(&cfg.subscriptions.renewalGrace, "subscription-renewal-grace", 72*time.Hour, "How long past the end of its period a subscription waits for the payment provider to report a renewal")
+	flag.DurationVar(&cfg.subscriptions.checkoutTTL, "subscription-checkout-ttl", 24*time.Hour, "How long a subscription waits for its checkout to be completed")
+
+	flag.StringVar(&cfg.payments.provider, "payments-provider", "fake", "Payment provider subscriptions are paid through (fake)")
+	flag.StringVar(&cfg.payments.webhookSecret, "payments-webhook-secret", "", "Secret the payment provider signs its webhook requests with")
+	flag.StringVar(&cfg.payments.fakeURL, "payments-fake-url", "http://localhost:9002", "Base URL of the fake payment provider's checkout page")
+
+	flag.StringVar(&cfg.oidc.providersFile, "oidc-providers", "", "JSON file listing the OpenID Connect providers users can log in with")
+
+	flag.IntVar(&cfg.passwords.minLength, "password-min-length", 8, "Minimum length of new passwords in bytes")
+	flag.IntVar(&cfg.passwords.minClasses, "password-min-classes", 0, "Character classes (lower, upper, digit, symbol) new passwords must contain")
+	flag.StringVar(&cfg.passwords.breachedFile, "password-breached-file", "", "File of breached password SHA-1 hashes (default: bundled list of common passwords)")
+
+	flag.DurationVar(&cfg.login.failureWindow, "login-failure-window", 15*time.Minute, "Window over which failed logins are counted")
+	flag.IntVar(&cfg.login.delayThreshold, "login-delay-threshold", 3, "Failed logins for an account before each attempt is delayed")
+	flag.IntVar(&cfg.login.lockoutThreshold, "login-lockout-threshold", 10, "Failed logins for an account before it is locked")
+	flag.DurationVar(&cfg.login.lockoutDuration, "login-lockout-duration", 30*time.Minute, "How long an account or IP stays locked")
+	flag.IntVar(&cfg.login.ipLockoutThreshold, "login-ip-lockout-threshold", 100, "Failed logins from one IP before it is locked")
+
+	flag.StringVar(&cfg.log.level, "log-level", "info", "Minimum level of log entries (debug|info|warn|error|fatal|off)")
+	flag.StringVar(&cfg.log.stackLevel, "log-stack-level", "error", "Minimum level of log entries which carry a stack trace (debug|info|warn|error|fatal|off)")
+	flag.Float64Var(&cfg.log.requestSample, "log-request-sample", 1, "Fraction of requests which are logged")
+
+	flag.DurationVar(&cfg.health.dbTimeout, "health-db-timeout", time.Second, "Timeout of the readiness checks of Postgres and of the schema version")
+	flag.DurationVar(&cfg.health.redisTimeout, "health-redis-timeout", 500*time.Millisecond, "Timeout of the readiness check of redis")
+	flag.DurationVar(&cfg.health.smtpTimeout, "health-smtp-timeout", 3*time.Second, "Timeout of the readiness check of the SMTP server")
+	flag.BoolVar(&cfg.health.checkSMTP, "health-check-smtp", false, "Check that the SMTP server is reachable in the readiness check")
+
+	flag.StringVar(&cfg.errorTracker.dsn, "error-tracker-dsn", "", "DSN of the Sentry compatible tracker errors are reported to (default: errors are only logged)")
+
+	flag.StringVar(&cfg.otel.endpoint, "otel-endpoint", "", "host:port of the OTLP/HTTP collector traces are exported to (default: tracing disabled)")
+	flag.BoolVar(&cfg.otel.insecure, "otel-insecure", false, "Export traces over plain HTTP rather than HTTPS")
+	flag.StringVar(&cfg.otel.serviceName, "otel-service-name", "greenlight", "Service name of the exported traces")
+	flag.Float64Var(&cfg.otel.sampleRatio, "otel-sample-ratio", 1, "Fraction of new traces which are sampled")
+
 	flag.Func("cors-trusted-origins", "Trusted CORS origins (space separated)", func(val string) error {
 		cfg.cors.trustedOrigins = strings.Fields(val)
 		return nil
 	})
 
+	flag.Func("trusted-proxies", "IP addresses or networks of the proxies whose X-Forwarded-For and X-Real-IP headers are trusted (space separated)", func(val string) error {
+		for _, entry := range strings.Fields(val) {
+			prefix, err := netip.ParsePrefix(entry)
+			if err != nil {
+				addr, addrErr := netip.ParseAddr(entry)
+				if addrErr != nil {
+					return err
+				}
+				prefix = netip.PrefixFrom(addr, addr.BitLen())
+			}
+			cfg.trustedProxies = append(cfg.trustedProxies, prefix.Masked())
+		}
+		return nil
+	})
+
 	displayVersion := flag.Bool("version", false, "Display version and exit")
 	flag.Parse()
 
@@ -113,7 +276,76 @@ func main() {
 
 	logger := jsonlog.New(os.Stdout, jsonlog.LevelInfo)
 
-	logger.PrintInfo("db dsn ", map[string]string{
+	logLevel, err := jsonlog.ParseLevel(cfg.log.level)
+	if err != nil {
+		logger.PrintFatal(err, nil)
+	}
+	stackLevel, err := jsonlog.ParseLevel(cfg.log.stackLevel)
+	if err != nil {
+		logger.PrintFatal(err, nil)
+	}
+	logger = jsonlog.New(os.Stdout, logLevel)
+	logger.SetStackTraceLevel(stackLevel)
+
+	// Libraries logging with log/slog, or the log package, write to the same log.
+	slog.SetDefault(slog.New(jsonlog.NewHandler(logger)))
+
+	shutdown, err := setupTracing(cfg)
+	if err != nil {
+		logger.PrintFatal(err, nil)
+	}
+	defer func() {
+		err := shutdownTracing(shutdown)
+		if err != nil {
+			logger.PrintError(err, nil)
+		}
+	}()
+
+	if cfg.auth.mode != authModeToken && cfg.auth.mode != authModeJWT {
+		logger.PrintFatal(fmt.Errorf("invalid auth mode %q", cfg.auth.mode), nil)
+	}
+
+	hasher, err := newArgon2idHasher(cfg)
+	if err != nil {
+		logger.PrintFatal(err, nil)
+	}
+	data.SetPasswordHasher(hasher)
+
+	policy := data.DefaultPasswordPolicy
+	policy.MinLength = cfg.passwords.minLength
+	policy.MinCharacterClasses = cfg.passwords.minClasses
+	if cfg.passwords.breachedFile != "" {
+		breached, err := loadBreachedPasswords(cfg.passwords.breachedFile)
+		if err != nil {
+			logger.PrintFatal(err, nil)
+		}
+		policy.Breached = breached
+		logger.PrintInfo("loaded breached passwords", jsonlog.Properties{
+			"count": breached.Len(),
+		})
+	}
+	data.SetPasswordPolicy(policy)
+
+	oidcProviders := map[string]*oidc.Provider{}
+	if cfg.oidc.providersFile != "" {
+		providers, err := loadOIDCProviders(cfg.oidc.providersFile)
+		if err != nil {
+			logger.PrintFatal(err, nil)
+		}
+		oidcProviders = providers
+	}
+
+	errorTracker, err := newErrorTracker(cfg, logger)
+	if err != nil {
+		logger.PrintFatal(err, nil)
+	}
+
+	paymentProvider, err := newPaymentProvider(cfg, logger)
+	if err != nil {
+		logger.PrintFatal(err, nil)
+	}
+
+	logger.PrintDebug("db dsn ", jsonlog.Properties{
 		"db": cfg.db.dsn,
 	})
 	db, err := openDB(cfg)
@@ -124,7 +356,7 @@ func main() {
 	defer db.Close()
 	logger.PrintInfo("database connection pool established", nil)
 
-	logger.PrintInfo("redis dsn ", map[string]string{"redis": cfg.redis.dsn})
+	logger.PrintDebug("redis dsn ", jsonlog.Properties{"redis": cfg.redis.dsn})
 	redis, err := setupRedis(cfg)
 	if err != nil {
 		logger.PrintFatal(err, nil)
@@ -132,21 +364,85 @@ func main() {
 	defer redis.Close()
 	logger.PrintInfo("Redis connection established", nil)
 
+	rateLimits, err := loadRateLimitPolicies(cfg)
+	if err != nil {
+		logger.PrintFatal(err, nil)
+	}
+	err = rateLimits.Init(redis, cfg.limiter.strategy, cfg.limiter.fallback)
+	if err != nil {
+		logger.PrintFatal(err, nil)
+	}
+
 	app := &application{
 		config:      cfg,
 		logger:      logger,
-		models:      data.NewModels(db),
+		models:      data.NewModels(db, cfg.db.queryTimeout),
 		mailer:      mailer.New(cfg.smtp.host, cfg.smtp.port, cfg.smtp.username, cfg.smtp.password, cfg.smtp.sender),
-		m:           NewMetrics(),
+		m:           NewMetrics(db, redis, rateLimits.Degraded),
 		redisClient: redis,
+		signingKeys: &keyRing{},
+
+		oidcProviders: oidcProviders,
+		payments:      paymentProvider,
+		rateLimits:    rateLimits,
+		errorTracker:  errorTracker,
+	}
+
+	err = checkDefaultRole(context.Background(), app.models.Roles, cfg.users.defaultRole)
+	if err != nil {
+		logger.PrintFatal(err, nil)
+	}
+
+	rateLimits.OnRedisError = func(err error) {
+		app.m.rateLimiterRedisErrors.Inc()
+		app.logger.PrintError(err, jsonlog.Properties{"component": "rate limiter"})
 	}
 
+	if cfg.auth.mode == authModeJWT {
+		err = app.rotateSigningKeys(context.Background())
+		if err != nil {
+			logger.PrintFatal(err, nil)
+		}
+		go app.runSigningKeyRotation()
+	}
+
+	go app.runSubscriptionJob()
+
 	err = app.serve()
 	if err != nil {
 		logger.PrintFatal(err, nil)
 	}
 }
 
+// checkDefaultRole() makes sure the role granted to new users exists. Otherwise every
+// registration would succeed without granting any role, and leave the user locked out.
+func checkDefaultRole(ctx context.Context, roles data.RoleRepository, code string) error {
+	known, err := roles.GetAll(ctx)
+	if err != nil {
+		return err
+	}
+	if !known.Include(code) {
+		return fmt.Errorf("default role %q doesn't exist, it must be one of %s", code, strings.Join(known, ", "))
+	}
+	return nil
+}
+
+// newErrorTracker() returns the tracker errors are reported to, or nil when there is
+// none.
+func newErrorTracker(cfg config, logger *jsonlog.Logger) (errreport.Tracker, error) {
+	if cfg.errorTracker.dsn == "" {
+		return nil, nil
+	}
+	tracker, err := errreport.NewSentryTracker(cfg.errorTracker.dsn, cfg.env, version)
+	if err != nil {
+		return nil, err
+	}
+	tracker.OnError = func(err error) {
+		logger.PrintWarn(err.Error(), jsonlog.Properties{"component": "error tracker"})
+	}
+	return tracker, nil
+}
+
 func openDB(cfg config) (*sql.DB, error) {
 	db, err := sql.Open("postgres", cfg.db.dsn)
 	if err != nil {
@@ -174,44 +470,18 @@ func openDB(cfg config) (*sql.DB, error) {
 	return db, nil
 }
 
-func NewMetrics() *metrics {
-	m := &metrics{
-		totalRequestReceived: prometheus.NewCounter(prometheus.CounterOpts{
-			Name: "greenlight_total_request_received",
-			Help: "The total number of request received",
-		}),
-		requestDuration: prometheus.NewGauge(prometheus.GaugeOpts{
-			Name: "greenlight_request_duration_seconds",
-			Help: "The duration of each request in seconds",
-		}),
-		totalResponsesSent: prometheus.NewCounter(prometheus.CounterOpts{
-			Name: "greenlight_total_responses_sent",
-			Help: "The total number of responses sent",
-		}),
-		totalInternalServer: prometheus.NewCounter(prometheus.CounterOpts{
-			Name: "greenlight_total_internal_server_error",
-			Help: "The total number of internal server error",
-		}),
-		totalClientSideError: prometheus.NewCounter(prometheus.CounterOpts{
-			Name: "greenlight_total_client_side_error",
-			Help: "The total number of client side error",
-		}),
-	}
-
-	prometheus.MustRegister(m.totalRequestReceived)
-	prometheus.MustRegister(m.requestDuration)
-	prometheus.MustRegister(m.totalResponsesSent)
-	prometheus.MustRegister(m.totalInternalServer)
-	prometheus.MustRegister(m.totalClientSideError)
-	return m
-}
-
 func setupRedis(cfg config) (*redis.Client, error) {
 	opts, err := redis.ParseURL(cfg.redis.dsn)
 	if err != nil {
 		return nil, err
 	}
 	redis := redis.NewClient(opts)
+
+	// Trace every redis command, including the rate limiter's scripts.
+	err = redisotel.InstrumentTracing(redis)
+	if err != nil {
+		return nil, err
+	}
 	return redis, nil
 }
 
@@ -229,3 +499,90 @@ func getPortFromEnv() int {
 	// Default port if not provided in environment variable
 	return 4000
 }
+
+// newArgon2idHasher() checks the Argon2id flags before narrowing them to the types of
+// the hasher, so that e.g. a parallelism of 256 isn't silently wrapped to 0. The memory
+// must be at least 8 KiB per lane, as RFC 9106 requires.
+func newArgon2idHasher(cfg config) (data.Argon2idHasher, error) {
+	if cfg.argon2.parallelism < 1 || cfg.argon2.parallelism > math.MaxUint8 {
+		return data.Argon2idHasher{}, fmt.Errorf("argon2 parallelism must be between 1 and %d", math.MaxUint8)
+	}
+	if cfg.argon2.iterations < 1 || cfg.argon2.iterations > math.MaxUint32 {
+		return data.Argon2idHasher{}, fmt.Errorf("argon2 iterations must be between 1 and %d", uint32(math.MaxUint32))
+	}
+	if cfg.argon2.memory < 8*cfg.argon2.parallelism || cfg.argon2.memory > math.MaxUint32 {
+		return data.Argon2idHasher{}, fmt.Errorf("argon2 memory must be between %d (8 KiB per lane) and %d KiB", 8*cfg.argon2.parallelism, uint32(math.MaxUint32))
+	}
+
+	hasher := data.DefaultArgon2idHasher
+	hasher.Memory = uint32(cfg.argon2.memory)
+	hasher.Iterations = uint32(cfg.argon2.iterations)
+	hasher.Parallelism = uint8(cfg.argon2.parallelism)
+	return hasher, nil
+}
+
+func loadBreachedPasswords(path string) (*data.BreachedPasswords, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return data.LoadBreachedPasswords(f)
+}
+
+// loadRateLimitPolicies() reads the -limiter-policies file. Its default policy, and the
+// only policy when there is no file, is -request-limit requests per -window-length.
+func loadRateLimitPolicies(cfg config) (*ratelimit.Policies, error) {
+	fallback := &ratelimit.Policy{
+		Name:   "default",
+		Limit:  cfg.limiter.requestLimit,
+		Window: ratelimit.Duration(time.Duration(cfg.limiter.windowLength) * time.Second),
+	}
+	authentication := &ratelimit.Policy{
+		Name:   "authentication",
+		Key:    ratelimit.KeyIP,
+		Limit:  cfg.limiter.authLimit,
+		Window: fallback.Window,
+	}
+	if cfg.limiter.policiesFile == "" {
+		return &ratelimit.Policies{Default: fallback, Authentication: authentication}, nil
+	}
+
+	f, err := os.Open(cfg.limiter.policiesFile)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ratelimit.LoadPolicies(f, fallback, authentication)
+}
+
+func loadOIDCProviders(path string) (map[string]*oidc.Provider, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return oidc.LoadProviders(f, &http.Client{Timeout: 10 * time.Second})
+}
+
+// The fake provider signs its webhooks with this secret in development when no other is
+// configured, so that cmd/examples/fake-payments works out of the box.
+const developmentWebhookSecret = "whsec_development"
+
+func newPaymentProvider(cfg config, logger *jsonlog.Logger) (payments.PaymentProvider, error) {
+	secret := cfg.payments.webhookSecret
+	if secret == "" {
+		if cfg.env != "development" {
+			return nil, errors.New("a payments webhook secret is required outside development")
+		}
+		secret = developmentWebhookSecret
+		logger.PrintInfo("using the development payments webhook secret", nil)
+	}
+
+	switch cfg.payments.provider {
+	case "fake":
+		return payments.NewFakeProvider(secret, cfg.payments.fakeURL), nil
+	default:
+		return nil, fmt.Errorf("unknown payments provider %q", cfg.payments.provider)
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/henrtytanoh/greenlight/internal/data"
+)
+
+func TestNewArgon2idHasher(t *testing.T) {
+	tests := []struct {
+		name                            string
+		memory, iterations, parallelism uint
+		wantErr                         bool
+	}{
+		{"defaults", 64 * 1024, 3, 2, false},
+		{"minimum memory", 16, 1, 2, false},
+		{"largest parallelism", 8 * 255, 1, 255, false},
+		{"parallelism which would wrap to 0", 64 * 1024, 3, 256, true},
+		{"no parallelism", 64 * 1024, 3, 0, true},
+		{"no iterations", 64 * 1024, 0, 2, true},
+		{"no memory", 0, 3, 2, true},
+		{"less than 8 KiB per lane", 15, 3, 2, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var cfg config
+			cfg.argon2.memory = tt.memory
+			cfg.argon2.iterations = tt.iterations
+			cfg.argon2.parallelism = tt.parallelism
+			hasher, err := newArgon2idHasher(cfg)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v; want error %t", err, tt.wantErr)
+			}
+			if err == nil && uint(hasher.Parallelism) != tt.parallelism {
+				t.Errorf("got parallelism %d; want %d", hasher.Parallelism, tt.parallelism)
+			}
+		})
+	}
+}
+
+func TestCheckDefaultRole(t *testing.T) {
+	roles := data.NewMemoryStore().Models().Roles
+
+	tests := []struct {
+		role    string
+		wantErr bool
+	}{
+		{"viewer", false},
+		{"editor", false},
+		{"Viewer", true},
+		{"subscriber", true},
+		{"", true},
+	}
+
+	for _, tt := range tests {
+		err := checkDefaultRole(context.Background(), roles, tt.role)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("got error %v for %q; want error %t", err, tt.role, tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/redis/go-redis/v9"
+)
+
+// Route label of requests which match no route, so that scanners probing random
+// paths can't create new time series.
+const unmatchedRoute = "unmatched"
+
+// prometheus metrics config
+type metrics struct {
+	// Metrics are registered on the application's own registry rather than on the
+	// global one, so that several applications can live in the same process.
+	registry *prometheus.Registry
+
+	httpRequests         *prometheus.CounterVec
+	httpRequestDuration  *prometheus.HistogramVec
+	httpResponseSize     *prometheus.HistogramVec
+	httpRequestsInFlight prometheus.Gauge
+
+	rateLimiterRedisErrors prometheus.Counter
+	rateLimiterDegraded    prometheus.Counter
+}
+
+func NewMetrics(db *sql.DB, redisClient *redis.Client, rateLimiterDegraded func() bool) *metrics {
+	m := &metrics{
+		registry: prometheus.NewRegistry(),
+		httpRequests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "greenlight_http_requests_total",
+			Help: "The total number of requests by method, route and status class",
+		}, []string{"method", "route", "status"}),
+		httpRequestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "greenlight_http_request_duration_seconds",
+			Help:    "The duration of requests in seconds by method, route and status class",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"method", "route", "status"}),
+		httpResponseSize: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "greenlight_http_response_size_bytes",
+			Help:    "The size of response bodies in bytes by method and route",
+			Buckets: prometheus.ExponentialBuckets(100, 10, 6),
+		}, []string{"method", "route"}),
+		httpRequestsInFlight: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "greenlight_http_requests_in_flight",
+			Help: "The number of requests being served",
+		}),
+		rateLimiterRedisErrors: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "greenlight_rate_limiter_redis_errors_total",
+			Help: "The total number of redis errors of the rate limiter",
+		}),
+		rateLimiterDegraded: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "greenlight_rate_limiter_degraded_requests_total",
+			Help: "The total number of requests decided by the rate limiter fallback",
+		}),
+	}
+
+	m.registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		collectors.NewDBStatsCollector(db, "greenlight"),
+		newRedisPoolCollector(redisClient),
+		m.httpRequests,
+		m.httpRequestDuration,
+		m.httpResponseSize,
+		m.httpRequestsInFlight,
+		m.rateLimiterRedisErrors,
+		m.rateLimiterDegraded,
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "greenlight_rate_limiter_degraded",
+			Help: "Whether the rate limiter is in degraded mode (1) because redis is unavailable",
+		}, func() float64 {
+			if rateLimiterDegraded() {
+				return 1
+			}
+			return 0
+		}),
+	)
+	return m
+}
+
+// redisPoolCollector exports the connection pool statistics of a redis client.
+type redisPoolCollector struct {
+	client interface{ PoolStats() *redis.PoolStats }
+
+	hits       *prometheus.Desc
+	misses     *prometheus.Desc
+	timeouts   *prometheus.Desc
+	totalConns *prometheus.Desc
+	idleConns  *prometheus.Desc
+	staleConns *prometheus.Desc
+}
+
+func newRedisPoolCollector(client interface{ PoolStats() *redis.PoolStats }) *redisPoolCollector {
+	return &redisPoolCollector{
+		client:     client,
+		hits:       prometheus.NewDesc("greenlight_redis_pool_hits_total", "The number of times a free connection was found in the pool", nil, nil),
+		misses:     prometheus.NewDesc("greenlight_redis_pool_misses_total", "The number of times a free connection was not found in the pool", nil, nil),
+		timeouts:   prometheus.NewDesc("greenlight_redis_pool_timeouts_total", "The number of times waiting for a connection timed out", nil, nil),
+		totalConns: prometheus.NewDesc("greenlight_redis_pool_connections", "The number of connections in the pool", nil, nil),
+		idleConns:  prometheus.NewDesc("greenlight_redis_pool_idle_connections", "The number of idle connections in the pool", nil, nil),
+		staleConns: prometheus.NewDesc("greenlight_redis_pool_stale_connections_removed_total", "The number of stale connections removed from the pool", nil, nil),
+	}
+}
+
+func (c *redisPoolCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.hits
+	ch <- c.misses
+	ch <- c.timeouts
+	ch <- c.totalConns
+	ch <- c.idleConns
+	ch <- c.staleConns
+}
+
+func (c *redisPoolCollector) Collect(ch chan<- prometheus.Metric) {
+	stats := c.client.PoolStats()
+	ch <- prometheus.MustNewConstMetric(c.hits, prometheus.CounterValue, float64(stats.Hits))
+	ch <- prometheus.MustNewConstMetric(c.misses, prometheus.CounterValue, float64(stats.Misses))
+	ch <- prometheus.MustNewConstMetric(c.timeouts, prometheus.CounterValue, float64(stats.Timeouts))
+	ch <- prometheus.MustNewConstMetric(c.totalConns, prometheus.GaugeValue, float64(stats.TotalConns))
+	ch <- prometheus.MustNewConstMetric(c.idleConns, prometheus.GaugeValue, float64(stats.IdleConns))
+	ch <- prometheus.MustNewConstMetric(c.staleConns, prometheus.CounterValue, float64(stats.StaleConns))
+}
+
+// patternRouter is an httprouter.Router which records the pattern of the route serving
+// each request, so that metrics are labelled by route (/v1/movies/:id) rather than by
+// path, which would create new time series for every movie.
+//
+// The handler of every route is wrapped with Middleware, inside the code recording the
+// pattern, so that requests rejected by the middleware are still labelled with their
+// route.
+type patternRouter struct {
+	*httprouter.Router
+	Middleware func(http.Handler) http.Handler
+
+	setRoute func(r *http.Request, pattern string)
+}
+
+func newPatternRouter(setRoute func(r *http.Request, pattern string)) *patternRouter {
+	return &patternRouter{
+		Router:   httprouter.New(),
+		setRoute: setRoute,
+	}
+}
+
+func (rt *patternRouter) Handler(method, path string, handler http.Handler) {
+	if rt.Middleware != nil {
+		handler = rt.Middleware(handler)
+	}
+	rt.UnwrappedHandler(method, path, handler)
+}
+
+func (rt *patternRouter) HandlerFunc(method, path string, handler http.HandlerFunc) {
+	rt.Handler(method, path, handler)
+}
+
+// UnwrappedHandler() registers a route whose handler skips Middleware.
+func (rt *patternRouter) UnwrappedHandler(method, path string, handler http.Handler) {
+	rt.Router.Handler(method, path, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rt.setRoute(r, path)
+		handler.ServeHTTP(w, r)
+	}))
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestMetricsRouteLabel(t *testing.T) {
+	app, _ := newTestApplication(t)
+	app.config.cors.trustedOrigins = []string{"https://example.com"}
+	handler := app.routes()
+
+	tests := []struct {
+		name       string
+		method     string
+		path       string
+		preflight  bool
+		wantStatus int
+		wantRoute  string
+	}{
+		{"matched", http.MethodGet, "/v1/health/live", false, http.StatusOK, "/v1/health/live"},
+		// Rejected by the middleware, before the handler of the route runs.
+		{"unauthenticated", http.MethodGet, "/v1/movies/1", false, http.StatusUnauthorized, "/v1/movies/:id"},
+		{"not found", http.MethodGet, "/v1/movies/1/unknown", false, http.StatusNotFound, unmatchedRoute},
+		{"method not allowed", http.MethodPut, "/v1/movies", false, http.StatusMethodNotAllowed, unmatchedRoute},
+		{"CORS preflight", http.MethodOptions, "/v1/movies/1", true, http.StatusOK, unmatchedRoute},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, tt.path, nil)
+			if tt.preflight {
+				r.Header.Set("Origin", "https://example.com")
+				r.Header.Set("Access-Control-Request-Method", http.MethodPatch)
+				r.Header.Set("Access-Control-Request-Headers", "Authorization")
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("got status %d; want %d", w.Code, tt.wantStatus)
+			}
+			if tt.preflight && w.Header().Get("Access-Control-Allow-Methods") == "" {
+				t.Error("got no Access-Control-Allow-Methods; want the preflight answered")
+			}
+
+			status := strconv.Itoa(tt.wantStatus/100) + "xx"
+			got := testutil.ToFloat64(app.m.httpRequests.WithLabelValues(tt.method, tt.wantRoute, status))
+			if got != 1 {
+				t.Errorf("got %v requests labelled %s; want 1", got, tt.wantRoute)
+			}
+		})
+	}
+}
@@ -2,22 +2,58 @@ package main
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"net/http"
+	"regexp"
 	"slices"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/felixge/httpsnoop"
 	"github.com/henrtytanoh/greenlight/internal/data"
+	jsonlog "github.com/henrtytanoh/greenlight/internal/jsonLog"
+	"github.com/henrtytanoh/greenlight/internal/jwt"
+	"github.com/henrtytanoh/greenlight/internal/ratelimit"
 	"github.com/henrtytanoh/greenlight/internal/validator"
-	"github.com/tomasen/realip"
+	"go.opentelemetry.io/otel/attribute"
+	semconv "go.opentelemetry.io/otel/semconv/v1.21.0"
+	"go.opentelemetry.io/otel/trace"
 )
 
-const (
-	keyWithoutTTLVal = -1
-)
+// Request IDs set by a proxy or the client are kept if they are reasonably short and
+// can't garble the logs.
+var requestIDRX = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+// requestID() tags the request with the ID of its X-Request-ID header, or a new one.
+// The ID is echoed in the response and written in the log entries and error responses
+// about the request, so that a customer report can be matched with the logs.
+func (app *application) requestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		if !requestIDRX.MatchString(id) {
+			id = newRequestID()
+		}
+		w.Header().Set("X-Request-ID", id)
+		trace.SpanFromContext(r.Context()).SetAttributes(attribute.String("http.request_id", id))
+
+		r = app.contextSetRequestInfo(r, &requestInfo{ID: id})
+		next.ServeHTTP(w, r)
+	})
+}
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		// Uniqueness matters more than randomness here.
+		return strconv.FormatInt(time.Now().UnixNano(), 36)
+	}
+	return hex.EncodeToString(b)
+}
 
 func (app *application) recoverPanic(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -44,54 +80,148 @@ func (app *application) recoverPanic(next http.Handler) http.Handler {
 	})
 }
 
-func (app *application) rateLimit(next http.Handler) http.Handler {
+// timeout() gives each request a deadline of -request-timeout. The queries made on its
+// behalf inherit the deadline, as well as the cancellation of the request when the
+// client goes away, so a slow query doesn't outlive the request it serves.
+func (app *application) timeout(next http.Handler) http.Handler {
+	if app.config.requestTimeout <= 0 {
+		return next
+	}
 
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), app.config.requestTimeout)
+		defer cancel()
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
 
-		// Implement Fixed window strategy rate limiting with redis
-		// Functional, but does not handle bursty traffic and can result in 2* traffic at the frontier on the previous and current window
-		if app.config.limiter.enabled {
-			ip := realip.FromRequest(r)
-			key := "ratelimit:" + ip
+// rateLimitAuthentication() counts the requests which carry an API key or a token
+// against the authentication policy, per IP address, before authenticate looks the
+// credential up. rateLimit only runs once the client is known, so it can't stop anyone
+// from guessing credentials.
+func (app *application) rateLimitAuthentication(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !app.config.limiter.enabled || (r.Header.Get("Authorization") == "" && r.Header.Get("X-API-Key") == "") {
+			next.ServeHTTP(w, r)
+			return
+		}
 
-			// Using redis pipeline as we need to execute INCR and TTL. Note pipelines are not transactions, we still need to
-			// check for errors on both steps
-			ctx := context.Background()
-			requestsCount, err := app.redisClient.Incr(ctx, key).Result()
-			if err != nil {
-				app.serverErrorResponse(w, r, err)
-				return
+		ip := app.clientIP(r)
+		if app.rateLimits.Allowlisted(ip) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		req := ratelimit.Request{Method: r.Method, Path: r.URL.Path, IP: ip, Client: ratelimit.ClientAnonymous}
+		if app.allowRequest(w, r, app.rateLimits.Authentication, req) {
+			next.ServeHTTP(w, r)
+		}
+	})
+}
+
+// rateLimit() limits requests according to the first policy they match. It runs after
+// authenticate, so that policies can tell users, API keys and third-party apps apart,
+// and count the requests of authenticated users per user rather than per IP address.
+// Every counted response tells the client where it stands with the RateLimit headers
+// of the IETF draft (draft-ietf-httpapi-ratelimit-headers); allowlisted requests and
+// those let through by the open fallback aren't counted, and carry none. While redis is unavailable
+// requests are decided by the -limiter-fallback mode instead of failing.
+func (app *application) rateLimit(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !app.config.limiter.enabled {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		ip := app.clientIP(r)
+		if app.rateLimits.Allowlisted(ip) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		req := ratelimit.Request{
+			Method: r.Method,
+			Path:   r.URL.Path,
+			IP:     ip,
+			Client: ratelimit.ClientAnonymous,
+		}
+		if user := app.contextGetUser(r); !user.IsAnonymous() {
+			req.UserID = user.ID
+			switch {
+			case app.contextGetAPIKey(r) != nil:
+				req.Client = ratelimit.ClientAPIKey
+			case app.contextGetOAuthToken(r) != nil:
+				req.Client = ratelimit.ClientOAuthApp
+			default:
+				req.Client = ratelimit.ClientUser
 			}
-			// Set TTL if not present(i.e at the start of a window)
-			if ttl, err := app.redisClient.TTL(ctx, key).Result(); err != nil {
-				app.serverErrorResponse(w, r, err)
-				return
-			} else {
-				if ttl == keyWithoutTTLVal {
-					if err := app.redisClient.Expire(ctx, key, time.Duration(app.config.limiter.windowLength)*time.Second).Err(); err != nil {
-						app.serverErrorResponse(w, r, err)
-						return
-					}
-				}
+			req.Plan = func() (string, error) {
+				return app.currentPlan(r.Context(), user.ID)
 			}
+		}
 
-			if requestsCount > int64(app.config.limiter.requestLimit) {
-				app.rateLimitExceededResponse(w, r)
-				return
-			}
+		policy, err := app.rateLimits.Match(req)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		if app.allowRequest(w, r, policy, req) {
+			next.ServeHTTP(w, r)
 		}
-		next.ServeHTTP(w, r)
 	})
 }
 
+// allowRequest() counts the request against the policy and sets the RateLimit headers.
+// When the request is over the limit, or can't be counted, it sends the error response
+// and returns false.
+func (app *application) allowRequest(w http.ResponseWriter, r *http.Request, policy *ratelimit.Policy, req ratelimit.Request) bool {
+	result, err := app.rateLimits.Allow(r.Context(), policy, req)
+	if err != nil {
+		switch {
+		// The client went away, so there is no one to respond to.
+		case errors.Is(err, context.Canceled):
+		case errors.Is(err, ratelimit.ErrUnavailable):
+			app.m.rateLimiterDegraded.Inc()
+			app.rateLimiterUnavailableResponse(w, r, app.config.limiter.fallback.Cooldown)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return false
+	}
+	if result.Degraded {
+		app.m.rateLimiterDegraded.Inc()
+	}
+
+	// In the open fallback mode requests aren't counted, so there is nothing to tell.
+	if result.Limit > 0 {
+		w.Header().Set("RateLimit-Policy", fmt.Sprintf("%d;w=%d", result.Limit, ceilSeconds(policy.Window.Duration())))
+		w.Header().Set("RateLimit-Limit", strconv.Itoa(result.Limit))
+		w.Header().Set("RateLimit-Remaining", strconv.Itoa(result.Remaining))
+		w.Header().Set("RateLimit-Reset", strconv.Itoa(ceilSeconds(result.Reset)))
+	}
+
+	if !result.Allowed {
+		app.rateLimitExceededResponse(w, r, result.RetryAfter)
+		return false
+	}
+	return true
+}
+
 func (app *application) authenticate(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// Add the "Vary: Authorization" header to the response. This indicates to any
 		// caches that the response may vary based on the value of the Authorization
 		// header in the request
 		w.Header().Add("Vary", "Authorization")
+		w.Header().Add("Vary", "X-API-Key")
 		authorizationHeader := r.Header.Get("Authorization")
 
+		// Machine clients may send their API key in a dedicated header instead of the
+		// Authorization header.
+		if apiKey := r.Header.Get("X-API-Key"); apiKey != "" && authorizationHeader == "" {
+			authorizationHeader = "ApiKey " + apiKey
+		}
+
 		if authorizationHeader == "" {
 			r = app.contextSetUser(r, data.AnonymousUser)
 			next.ServeHTTP(w, r)
@@ -99,25 +229,44 @@ func (app *application) authenticate(next http.Handler) http.Handler {
 		}
 
 		headersParts := strings.Split(authorizationHeader, " ")
-		if len(headersParts) != 2 || headersParts[0] != "Bearer" {
-			app.logger.PrintError(fmt.Errorf("auth header is not correctly formed"), map[string]string{
-				"header": authorizationHeader,
-			})
+		if len(headersParts) != 2 || (headersParts[0] != "Bearer" && headersParts[0] != "ApiKey") {
+			// Only the scheme is logged, if there is one: the rest of the header is a
+			// credential, possibly a valid API key sent with the wrong scheme.
+			properties := jsonlog.Properties{}
+			if len(headersParts) > 1 {
+				properties["scheme"] = headersParts[0]
+			}
+			app.logger.PrintError(fmt.Errorf("auth header is not correctly formed"), app.logProperties(r, properties))
 			app.invalidAuthenticationTokenResponse(w, r)
 			return
 		}
 
+		if headersParts[0] == "ApiKey" {
+			app.authenticateAPIKey(w, r, headersParts[1], next)
+			return
+		}
+
 		token := headersParts[1]
 
+		if strings.HasPrefix(token, data.OAuthAccessTokenPrefix) {
+			app.authenticateOAuthToken(w, r, token, next)
+			return
+		}
+
+		if app.config.auth.mode == authModeJWT && jwt.LooksLikeJWT(token) {
+			app.authenticateAccessToken(w, r, token, next)
+			return
+		}
+
 		v := validator.New()
 
 		if data.ValidateTokenPlaintext(v, token); !v.Valid() {
-			app.logger.PrintError(fmt.Errorf("invalid token %s", token), nil)
+			app.logger.PrintError(errors.New("invalid token"), app.logProperties(r, nil))
 			app.invalidAuthenticationTokenResponse(w, r)
 			return
 		}
 
-		user, err := app.models.Users.GetForToken(data.ScopeAuthentication, token)
+		user, err := app.models.Users.GetForToken(r.Context(), data.ScopeAuthentication, token)
 		if err != nil {
 			switch {
 			case errors.Is(err, data.ErrRecordNotFound):
@@ -128,11 +277,115 @@ func (app *application) authenticate(next http.Handler) http.Handler {
 			}
 			return
 		}
+
+		err = app.models.Tokens.Touch(r.Context(), token)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
 		r = app.contextSetUser(r, user)
+		r = app.contextSetToken(r, token)
 		next.ServeHTTP(w, r)
 	})
 }
 
+// authenticateAccessToken() trusts the claims of a signed access token without going
+// to the database. Only the ID and activation status of the user are known; handlers
+// which need the rest of the record must fetch it themselves.
+func (app *application) authenticateAccessToken(w http.ResponseWriter, r *http.Request, token string, next http.Handler) {
+	claims, err := app.parseAccessToken(r.Context(), token)
+	if err != nil {
+		app.invalidAuthenticationTokenResponse(w, r)
+		return
+	}
+
+	id, err := strconv.ParseInt(claims.Subject, 10, 64)
+	if err != nil || id < 1 {
+		app.invalidAuthenticationTokenResponse(w, r)
+		return
+	}
+
+	user := &data.User{ID: id, Activated: claims.Activated}
+	r = app.contextSetUser(r, user)
+	r = app.contextSetPermissions(r, claims.Permissions)
+	next.ServeHTTP(w, r)
+}
+
+// authenticateAPIKey() resolves the owner of an API key and stores both the user and
+// the key in the request context. The key is needed later on by requirePermission()
+// to restrict the request to the permissions granted to the key.
+func (app *application) authenticateAPIKey(w http.ResponseWriter, r *http.Request, keyPlaintext string, next http.Handler) {
+	v := validator.New()
+	if data.ValidateAPIKeyPlaintext(v, keyPlaintext); !v.Valid() {
+		app.invalidAPIKeyResponse(w, r)
+		return
+	}
+
+	key, err := app.models.APIKeys.GetForPlaintext(r.Context(), keyPlaintext)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.invalidAPIKeyResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	user, err := app.models.Users.Get(r.Context(), key.UserID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.invalidAPIKeyResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	r = app.contextSetUser(r, user)
+	r = app.contextSetAPIKey(r, key)
+	next.ServeHTTP(w, r)
+}
+
+// authenticateOAuthToken() resolves the user on whose behalf a third-party app is
+// acting. As with API keys, the token is kept in the context so that requirePermission()
+// can restrict the request to the scopes the user granted.
+func (app *application) authenticateOAuthToken(w http.ResponseWriter, r *http.Request, tokenPlaintext string, next http.Handler) {
+	v := validator.New()
+	if data.ValidateOAuthPlaintext(v, "token", tokenPlaintext, data.OAuthAccessTokenPrefix); !v.Valid() {
+		app.invalidOAuthTokenResponse(w, r)
+		return
+	}
+
+	token, err := app.models.OAuthTokens.Get(r.Context(), data.OAuthKindAccess, tokenPlaintext)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.invalidOAuthTokenResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	user, err := app.models.Users.Get(r.Context(), token.UserID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.invalidOAuthTokenResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	r = app.contextSetUser(r, user)
+	r = app.contextSetOAuthToken(r, token)
+	next.ServeHTTP(w, r)
+}
+
 func (app *application) requireAuthenticatedUser(next http.HandlerFunc) http.HandlerFunc {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		user := app.contextGetUser(r)
@@ -160,14 +413,33 @@ func (app *application) requireActivatedUser(next http.HandlerFunc) http.Handler
 	return app.requireAuthenticatedUser(fn)
 }
 
+// requireFirstPartyCredential() rejects requests made with an API key or a third-party
+// app's access token. It guards the routes which manage the account itself: its
+// credentials, second factor, sessions and subscription. A delegated credential, even
+// one limited to movies:read, could otherwise lock the owner out or take over the
+// account.
+func (app *application) requireFirstPartyCredential(next http.HandlerFunc) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if app.isDelegated(r) {
+			app.notPermittedResponse(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
 func (app *application) requirePermission(code string, next http.HandlerFunc) http.HandlerFunc {
 	fn := func(w http.ResponseWriter, r *http.Request) {
 		user := app.contextGetUser(r)
 
-		permissions, err := app.models.Permissions.GetAllForUser(user.ID)
-		if err != nil {
-			app.serverErrorResponse(w, r, err)
-			return
+		permissions, ok := app.contextGetPermissions(r)
+		if !ok {
+			var err error
+			permissions, err = app.models.Permissions.GetAllForUser(r.Context(), user.ID)
+			if err != nil {
+				app.serverErrorResponse(w, r, err)
+				return
+			}
 		}
 
 		if !permissions.Include(code) {
@@ -175,6 +447,19 @@ func (app *application) requirePermission(code string, next http.HandlerFunc) ht
 			return
 		}
 
+		// Requests made with an API key are further limited to the subset of the
+		// owner's permissions that was granted to the key.
+		if key := app.contextGetAPIKey(r); key != nil && !key.Permissions.Include(code) {
+			app.notPermittedResponse(w, r)
+			return
+		}
+
+		// Third-party apps are limited to the scopes the user granted them.
+		if token := app.contextGetOAuthToken(r); token != nil && !token.Scopes.Include(code) {
+			app.notPermittedResponse(w, r)
+			return
+		}
+
 		next.ServeHTTP(w, r)
 	}
 
@@ -196,40 +481,50 @@ func (app *application) enableCORS(next http.Handler) http.Handler {
 				if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Headers") != "" {
 					// Set the appropriate headers to allow the browser to make requests
 					w.Header().Set("Access-Control-Allow-Methods", "OPTIONS, PUT, PATCH, DELETE")
-					w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
+					w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type, X-API-Key, X-Request-ID")
 
 					w.WriteHeader(http.StatusOK)
 					return
 				}
+
+				// Let browser clients read the rate limit headers and the request ID.
+				w.Header().Set("Access-Control-Expose-Headers", "RateLimit-Policy, RateLimit-Limit, RateLimit-Remaining, RateLimit-Reset, Retry-After, X-Request-ID")
 			}
 		}
 		next.ServeHTTP(w, r)
 	})
 }
 
+// Requests are labelled with the pattern of their route rather than their path, and
+// with the class of their status code (2xx, 4xx...), to keep the number of time series
+// bounded. The pattern is recorded by the patternRouter once it has matched the route,
+// so it is only known after the request is served. The request log is sampled with
+// -log-request-sample, since on a busy server it would drown everything else.
 func (app *application) metrics(next http.Handler) http.Handler {
+	requestLogger := app.logger.Sampled(app.config.log.requestSample)
 
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		app.logger.PrintInfo("Incoming request", map[string]string{
-			"method": r.Method,
-			"path":   r.URL.Path,
-		})
-		app.m.totalRequestReceived.Inc()
+		app.logger.PrintDebug("Incoming request", app.logProperties(r, nil))
+		app.m.httpRequestsInFlight.Inc()
+		defer app.m.httpRequestsInFlight.Dec()
+
 		metrics := httpsnoop.CaptureMetrics(next, w, r)
 
-		app.m.totalResponsesSent.Inc()
-		// check 500 status code
-		if metrics.Code == http.StatusInternalServerError {
-			app.m.totalInternalServer.Inc()
-		}
-		if metrics.Code >= http.StatusBadRequest && metrics.Code < http.StatusInternalServerError {
-			app.m.totalClientSideError.Inc()
+		route := unmatchedRoute
+		if info := app.contextGetRequestInfo(r); info != nil && info.Route != "" {
+			route = info.Route
 		}
-		app.m.requestDuration.Set(metrics.Duration.Seconds())
-		app.logger.PrintInfo("Request done", map[string]string{
-			"method":   r.Method,
-			"path":     r.URL.Path,
-			"duration": metrics.Duration.String(),
-		})
+		span := trace.SpanFromContext(r.Context())
+		span.SetName(r.Method + " " + route)
+		span.SetAttributes(semconv.HTTPRoute(route))
+
+		status := strconv.Itoa(metrics.Code/100) + "xx"
+		app.m.httpRequests.WithLabelValues(r.Method, route, status).Inc()
+		app.m.httpRequestDuration.WithLabelValues(r.Method, route, status).Observe(metrics.Duration.Seconds())
+		app.m.httpResponseSize.WithLabelValues(r.Method, route).Observe(float64(metrics.Written))
+		requestLogger.PrintInfo("Request done", app.logProperties(r, jsonlog.Properties{
+			"status":   metrics.Code,
+			"duration": metrics.Duration,
+		}))
 	})
 }
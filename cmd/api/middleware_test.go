@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/henrtytanoh/greenlight/internal/data"
+	jsonlog "github.com/henrtytanoh/greenlight/internal/jsonLog"
+	"github.com/henrtytanoh/greenlight/internal/ratelimit"
+	"github.com/redis/go-redis/v9"
+)
+
+// enableTestRateLimits() turns rate limiting on, with a default limit of 100 and an
+// authentication limit of 50 per second, in the given fallback mode.
+func enableTestRateLimits(t *testing.T, app *application, client *redis.Client, mode string, allowlist ...string) *ratelimit.Policies {
+	t.Helper()
+
+	app.config.limiter.enabled = true
+	app.config.limiter.requestLimit = 100
+	app.config.limiter.windowLength = 1
+	app.config.limiter.authLimit = 50
+	app.config.limiter.fallback = ratelimit.Fallback{
+		Mode:             mode,
+		FailureThreshold: 5,
+		Cooldown:         time.Second,
+		Timeout:          time.Second,
+		LocalSize:        100,
+	}
+	policies, err := loadRateLimitPolicies(app.config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	policies.Allowlist = allowlist
+	err = policies.Init(client, ratelimit.SlidingWindow, app.config.limiter.fallback)
+	if err != nil {
+		t.Fatal(err)
+	}
+	app.rateLimits = policies
+	return policies
+}
+
+func TestRateLimitHeaders(t *testing.T) {
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { client.Close() })
+	// Nothing listens on the port.
+	down := redis.NewClient(&redis.Options{Addr: "127.0.0.1:1", MaxRetries: -1})
+	t.Cleanup(func() { down.Close() })
+
+	tests := []struct {
+		name       string
+		client     *redis.Client
+		mode       string
+		allowlist  []string
+		token      string
+		wantStatus int
+		wantLimit  string
+	}{
+		{"anonymous", client, ratelimit.FallbackLocal, nil, "", http.StatusUnauthorized, "100"},
+		{"invalid token", client, ratelimit.FallbackLocal, nil, strings.Repeat("A", 26), http.StatusUnauthorized, "50"},
+		{"malformed token", client, ratelimit.FallbackLocal, nil, "not-a-token", http.StatusUnauthorized, "50"},
+		{"local fallback", down, ratelimit.FallbackLocal, nil, "", http.StatusUnauthorized, "100"},
+		{"open fallback", down, ratelimit.FallbackOpen, nil, "", http.StatusUnauthorized, ""},
+		{"allowlisted", client, ratelimit.FallbackLocal, []string{"192.0.2.0/24"}, "", http.StatusUnauthorized, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app, _ := newTestApplication(t)
+			enableTestRateLimits(t, app, tt.client, tt.mode, tt.allowlist...)
+
+			// httptest requests come from 192.0.2.1. Anonymous requests are rejected
+			// by the handler, after rateLimit; invalid credentials by authenticate.
+			r := httptest.NewRequest(http.MethodGet, "/v1/users/me/sessions", nil)
+			if tt.token != "" {
+				r.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			w := httptest.NewRecorder()
+			app.routes().ServeHTTP(w, r)
+
+			if w.Code != tt.wantStatus {
+				t.Fatalf("got status %d; want %d (%s)", w.Code, tt.wantStatus, w.Body)
+			}
+			if got := w.Header().Get("RateLimit-Limit"); got != tt.wantLimit {
+				t.Errorf("got RateLimit-Limit %q; want %q", got, tt.wantLimit)
+			}
+			if tt.wantLimit != "" && w.Header().Get("RateLimit-Remaining") == "" {
+				t.Error("got no RateLimit-Remaining; want it alongside RateLimit-Limit")
+			}
+		})
+	}
+}
+
+func TestRateLimitCanceledRequest(t *testing.T) {
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { client.Close() })
+
+	app, _ := newTestApplication(t)
+	enableTestRateLimits(t, app, client, ratelimit.FallbackLocal)
+
+	served := false
+	handler := app.rateLimit(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		served = true
+	}))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	r := httptest.NewRequest(http.MethodGet, "/v1/movies", nil).WithContext(ctx)
+	r = app.contextSetUser(r, data.AnonymousUser)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+
+	if served {
+		t.Error("got the request served; want it dropped")
+	}
+	if w.Body.Len() != 0 {
+		t.Errorf("got response %s; want none", w.Body)
+	}
+}
+
+func TestAuthenticateDoesNotLogCredentials(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+		value  string
+	}{
+		{"api key with a space", "X-API-Key", "s3cr3t s3cr3t"},
+		{"lowercase scheme", "Authorization", "apikey s3cr3t"},
+		{"no scheme", "Authorization", "s3cr3t"},
+		{"invalid token", "Authorization", "Bearer s3cr3t"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app, _ := newTestApplication(t)
+			var logs bytes.Buffer
+			app.logger = jsonlog.New(&logs, jsonlog.LevelInfo)
+
+			r := httptest.NewRequest(http.MethodGet, "/v1/movies", nil)
+			r.Header.Set(tt.header, tt.value)
+			w := httptest.NewRecorder()
+			app.routes().ServeHTTP(w, r)
+
+			if w.Code != http.StatusUnauthorized {
+				t.Fatalf("got status %d; want 401", w.Code)
+			}
+			if strings.Contains(logs.String(), "s3cr3t") {
+				t.Errorf("got the credential in the logs: %s", logs.String())
+			}
+		})
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+	"strconv"
 
 	"github.com/henrtytanoh/greenlight/internal/data"
 	"github.com/henrtytanoh/greenlight/internal/validator"
@@ -36,11 +37,20 @@ func (app *application) createMovieHandler(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
-	err = app.models.Movies.Insert(movie)
+	err = app.models.Movies.Insert(r.Context(), movie)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
+		return
 	}
 
+	app.audit(r, data.AuditEvent{
+		Action:     data.AuditMovieCreate,
+		Outcome:    data.AuditSuccess,
+		TargetType: "movie",
+		TargetID:   strconv.FormatInt(movie.ID, 10),
+		Details:    map[string]interface{}{"movie": movie},
+	})
+
 	// When sending a HTTP response, we want to include a Location header to let the
 	// client know which URL they can find the newly-created resource at. We make an
 	// empty http.Header map and then use the Set() method to add a new Location header,
@@ -65,7 +75,7 @@ func (app *application) showMovieHandler(w http.ResponseWriter, r *http.Request)
 	// Call the Get() method to fetch the data for a specific movie. We also need to
 	// use the errors.Is() function to check if it returns a data.ErrRecordNotFound
 	// error, in which case we send a 404 Not Found response to the client.
-	movie, err := app.models.Movies.Get(id)
+	movie, err := app.models.Movies.Get(r.Context(), id)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
@@ -92,7 +102,7 @@ func (app *application) updateMovieHandler(w http.ResponseWriter, r *http.Reques
 	}
 	// Fetch the existing movie record from the database, sending a 404 Not Found
 	// response to the client if we couldn't find a matching record.
-	movie, err := app.models.Movies.Get(id)
+	movie, err := app.models.Movies.Get(r.Context(), id)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
@@ -122,6 +132,9 @@ func (app *application) updateMovieHandler(w http.ResponseWriter, r *http.Reques
 	// value. Importantly, because input.Title is a now a pointer to a string, we need
 	// to dereference the pointer using the * operator to get the underlying value
 	// before assigning it to our movie record.
+	// Keep a copy of the record as it was, so that the changes can be audited.
+	before := *movie
+
 	if input.Title != nil {
 		movie.Title = *input.Title
 	}
@@ -144,7 +157,7 @@ func (app *application) updateMovieHandler(w http.ResponseWriter, r *http.Reques
 	}
 	// Pass the updated movie record to our new Update() method.
 	// Intercept any ErrEditConflict error and convert it to a 409 Conflict response.
-	err = app.models.Movies.Update(movie)
+	err = app.models.Movies.Update(r.Context(), movie)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrEditConflict):
@@ -154,6 +167,13 @@ func (app *application) updateMovieHandler(w http.ResponseWriter, r *http.Reques
 		}
 		return
 	}
+	app.audit(r, data.AuditEvent{
+		Action:     data.AuditMovieUpdate,
+		Outcome:    data.AuditSuccess,
+		TargetType: "movie",
+		TargetID:   strconv.FormatInt(movie.ID, 10),
+		Details:    map[string]interface{}{"changes": movieChanges(&before, movie)},
+	})
 	// Write the updated movie record in a JSON response.
 	err = app.writeJSON(w, http.StatusOK, envelope{"movie": movie}, nil)
 	if err != nil {
@@ -168,9 +188,20 @@ func (app *application) deleteMovieHandler(w http.ResponseWriter, r *http.Reques
 		app.notFoundResponse(w, r)
 		return
 	}
+	// Fetch the movie first, so that the audit log keeps what was deleted.
+	movie, err := app.models.Movies.Get(r.Context(), id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
 	// Delete the movie from the database, sending a 404 Not Found response to the
 	// client if there isn't a matching record.
-	err = app.models.Movies.Delete(id)
+	err = app.models.Movies.Delete(r.Context(), id)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
@@ -180,6 +211,13 @@ func (app *application) deleteMovieHandler(w http.ResponseWriter, r *http.Reques
 		}
 		return
 	}
+	app.audit(r, data.AuditEvent{
+		Action:     data.AuditMovieDelete,
+		Outcome:    data.AuditSuccess,
+		TargetType: "movie",
+		TargetID:   strconv.FormatInt(id, 10),
+		Details:    map[string]interface{}{"movie": movie},
+	})
 	// Return a 200 OK status code along with a success message.
 	err = app.writeJSON(w, http.StatusOK, envelope{"message": "movie successfully deleted"}, nil)
 	if err != nil {
@@ -214,7 +252,7 @@ func (app *application) listMoviesHandler(w http.ResponseWriter, r *http.Request
 		return
 	}
 
-	movies, metadata, err := app.models.Movies.GetAll(input.Title, input.Genres, input.Filters)
+	movies, metadata, err := app.models.Movies.GetAll(r.Context(), input.Title, input.Genres, input.Filters)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
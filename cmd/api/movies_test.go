@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/henrtytanoh/greenlight/internal/data"
+	jsonlog "github.com/henrtytanoh/greenlight/internal/jsonLog"
+)
+
+// newTestApplication() returns an application backed by the in-memory store, with
+// rate limiting disabled so that no redis is needed.
+func newTestApplication(t *testing.T) (*application, *data.MemoryStore) {
+	t.Helper()
+
+	store := data.NewMemoryStore()
+	var cfg config
+	cfg.env = "testing"
+	app := &application{
+		config: cfg,
+		logger: jsonlog.New(os.Stderr, jsonlog.LevelOff),
+		models: store.Models(),
+		m:      NewMetrics(nil, nil, func() bool { return false }),
+	}
+	return app, store
+}
+
+// newTestToken() creates an activated user with the given role and returns an
+// authentication token for them.
+func newTestToken(t *testing.T, models data.Models, email, role string) string {
+	t.Helper()
+	ctx := context.Background()
+
+	user := &data.User{Name: "Test", Email: email, Activated: true}
+	err := models.Users.Insert(ctx, user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = models.Roles.AddForUser(ctx, user.ID, role)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := models.Tokens.New(ctx, user.ID, time.Hour, data.ScopeAuthentication)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token.Plaintext
+}
+
+func TestMovieHandlers(t *testing.T) {
+	app, _ := newTestApplication(t)
+	handler := app.routes()
+
+	editor := newTestToken(t, app.models, "editor@example.com", "editor")
+	viewer := newTestToken(t, app.models, "viewer@example.com", "viewer")
+
+	send := func(method, path, token, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, strings.NewReader(body))
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	movie := `{"title": "Moana", "year": 2016, "runtime": "107 mins", "genres": ["animation", "adventure"]}`
+
+	tests := []struct {
+		name       string
+		method     string
+		path       string
+		token      string
+		body       string
+		wantStatus int
+	}{
+		{"create without a token", http.MethodPost, "/v1/movies", "", movie, http.StatusUnauthorized},
+		{"create with an invalid token", http.MethodPost, "/v1/movies", strings.Repeat("A", 26), movie, http.StatusUnauthorized},
+		{"create as a viewer", http.MethodPost, "/v1/movies", viewer, movie, http.StatusForbidden},
+		{"create as an editor", http.MethodPost, "/v1/movies", editor, movie, http.StatusCreated},
+		{"create an invalid movie", http.MethodPost, "/v1/movies", editor, `{"title": ""}`, http.StatusUnprocessableEntity},
+		{"show", http.MethodGet, "/v1/movies/1", viewer, "", http.StatusOK},
+		{"show a missing movie", http.MethodGet, "/v1/movies/2", viewer, "", http.StatusNotFound},
+		{"update as a viewer", http.MethodPatch, "/v1/movies/1", viewer, `{"year": 2017}`, http.StatusForbidden},
+		{"update as an editor", http.MethodPatch, "/v1/movies/1", editor, `{"year": 2017}`, http.StatusOK},
+		{"list", http.MethodGet, "/v1/movies?title=moana", viewer, "", http.StatusOK},
+		{"delete", http.MethodDelete, "/v1/movies/1", editor, "", http.StatusOK},
+		{"delete again", http.MethodDelete, "/v1/movies/1", editor, "", http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		w := send(tt.method, tt.path, tt.token, tt.body)
+		if w.Code != tt.wantStatus {
+			t.Fatalf("%s: got status %d; want %d (%s)", tt.name, w.Code, tt.wantStatus, w.Body)
+		}
+	}
+
+	// The writes are recorded in the audit log.
+	filters := data.Filters{Page: 1, PageSize: 20, Sort: "id", SortSafelist: []string{"id"}}
+	events, _, err := app.models.Audit.GetAll(context.Background(), data.AuditFilters{TargetType: "movie"}, filters)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var actions []string
+	for _, event := range events {
+		actions = append(actions, event.Action)
+	}
+	want := []string{data.AuditMovieCreate, data.AuditMovieUpdate, data.AuditMovieDelete}
+	if strings.Join(actions, ",") != strings.Join(want, ",") {
+		t.Errorf("got audit actions %v; want %v", actions, want)
+	}
+}
+
+func TestListMoviesHandler(t *testing.T) {
+	app, _ := newTestApplication(t)
+	handler := app.routes()
+	viewer := newTestToken(t, app.models, "viewer@example.com", "viewer")
+
+	for _, title := range []string{"Moana", "Black Panther", "The Breakfast Club"} {
+		err := app.models.Movies.Insert(context.Background(), &data.Movie{Title: title, Year: 2000, Runtime: 100, Genres: []string{"drama"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/v1/movies?sort=-title&page_size=2", nil)
+	r.Header.Set("Authorization", "Bearer "+viewer)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d; want 200 (%s)", w.Code, w.Body)
+	}
+
+	var body struct {
+		Movies   []data.Movie  `json:"movies"`
+		Metadata data.Metadata `json:"metadata"`
+	}
+	err := json.NewDecoder(w.Body).Decode(&body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body.Metadata.TotalRecords != 3 || len(body.Movies) != 2 {
+		t.Fatalf("got %d of %d movies; want 2 of 3", len(body.Movies), body.Metadata.TotalRecords)
+	}
+	if body.Movies[0].Title != "The Breakfast Club" || body.Movies[1].Title != "Moana" {
+		t.Errorf("got %q, %q; want the titles in descending order", body.Movies[0].Title, body.Movies[1].Title)
+	}
+}
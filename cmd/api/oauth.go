@@ -0,0 +1,525 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/henrtytanoh/greenlight/internal/data"
+	"github.com/henrtytanoh/greenlight/internal/oidc"
+	"github.com/henrtytanoh/greenlight/internal/validator"
+	"github.com/julienschmidt/httprouter"
+)
+
+// Lifetimes of the credentials issued to third-party apps.
+const (
+	oauthCodeTTL         = 5 * time.Minute
+	oauthAccessTokenTTL  = time.Hour
+	oauthRefreshTokenTTL = 30 * 24 * time.Hour
+)
+
+// authorizationRequest holds the parameters of an OAuth authorization request (RFC 6749
+// section 4.1.1), with PKCE (RFC 7636) being mandatory.
+type authorizationRequest struct {
+	ResponseType        string `json:"response_type"`
+	ClientID            string `json:"client_id"`
+	RedirectURI         string `json:"redirect_uri"`
+	Scope               string `json:"scope"`
+	State               string `json:"state"`
+	CodeChallenge       string `json:"code_challenge"`
+	CodeChallengeMethod string `json:"code_challenge_method"`
+}
+
+// validateAuthorizationRequest() checks an authorization request against the client's
+// registration and returns the client together with the scopes that can be granted:
+// those requested which the user holds themselves. Nothing is ever redirected to a
+// redirect URI before it has been matched against the registered ones.
+func (app *application) validateAuthorizationRequest(w http.ResponseWriter, r *http.Request, req *authorizationRequest) (*data.OAuthClient, data.Permissions, bool) {
+	v := validator.New()
+	v.Check(req.ClientID != "", "client_id", "must be provided")
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return nil, nil, false
+	}
+
+	client, err := app.models.OAuthClients.Get(r.Context(), req.ClientID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("client_id", "unknown client")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return nil, nil, false
+	}
+
+	if req.RedirectURI == "" && len(client.RedirectURIs) == 1 {
+		req.RedirectURI = client.RedirectURIs[0]
+	}
+	v.Check(validator.In(req.RedirectURI, client.RedirectURIs...), "redirect_uri", "must be one of the client's registered redirect URIs")
+	v.Check(req.ResponseType == "code", "response_type", "must be code")
+	v.Check(req.CodeChallengeMethod == "S256", "code_challenge_method", "must be S256")
+	v.Check(len(req.CodeChallenge) >= 43 && len(req.CodeChallenge) <= 128, "code_challenge", "must be between 43 and 128 bytes long")
+
+	requested := data.Permissions(strings.Fields(req.Scope))
+	if len(requested) == 0 {
+		requested = client.Scopes
+	}
+	for _, scope := range requested {
+		v.Check(client.Scopes.Include(scope), "scope", "must only contain scopes registered for the client")
+	}
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return nil, nil, false
+	}
+
+	permissions, err := app.models.Permissions.GetAllForUser(r.Context(), app.contextGetUser(r).ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return nil, nil, false
+	}
+	granted := data.Permissions{}
+	for _, scope := range requested {
+		if permissions.Include(scope) && !granted.Include(scope) {
+			granted = append(granted, scope)
+		}
+	}
+	if len(granted) == 0 {
+		v.AddError("scope", "none of the requested scopes can be granted by your account")
+		app.failedValidationResponse(w, r, v.Errors)
+		return nil, nil, false
+	}
+
+	return client, granted, true
+}
+
+// redirectWith() adds the given parameters to a redirect URI.
+func redirectWith(redirectURI string, params map[string]string) string {
+	u, err := url.Parse(redirectURI)
+	if err != nil {
+		return redirectURI
+	}
+	qs := u.Query()
+	for key, value := range params {
+		if value != "" {
+			qs.Set(key, value)
+		}
+	}
+	u.RawQuery = qs.Encode()
+	return u.String()
+}
+
+// Describe an authorization request, so that the user can be asked for their consent.
+// The parameters are the query string the third-party app sent the user's browser with.
+func (app *application) showOAuthAuthorizationHandler(w http.ResponseWriter, r *http.Request) {
+	qs := r.URL.Query()
+	req := authorizationRequest{
+		ResponseType:        qs.Get("response_type"),
+		ClientID:            qs.Get("client_id"),
+		RedirectURI:         qs.Get("redirect_uri"),
+		Scope:               qs.Get("scope"),
+		State:               qs.Get("state"),
+		CodeChallenge:       qs.Get("code_challenge"),
+		CodeChallengeMethod: qs.Get("code_challenge_method"),
+	}
+
+	client, scopes, ok := app.validateAuthorizationRequest(w, r, &req)
+	if !ok {
+		return
+	}
+
+	env := envelope{"authorization": envelope{
+		"client":       envelope{"client_id": client.ID, "name": client.Name},
+		"scopes":       scopes,
+		"redirect_uri": req.RedirectURI,
+	}}
+	err := app.writeJSON(w, http.StatusOK, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Record the user's decision on an authorization request. Either way the response tells
+// the client where to send the user's browser next: back to the app, with either an
+// authorization code or an access_denied error.
+func (app *application) createOAuthAuthorizationHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		authorizationRequest
+		Approve bool `json:"approve"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	client, scopes, ok := app.validateAuthorizationRequest(w, r, &input.authorizationRequest)
+	if !ok {
+		return
+	}
+
+	outcome := data.AuditSuccess
+	if !input.Approve {
+		outcome = data.AuditFailure
+	}
+	app.audit(r, data.AuditEvent{
+		Action:     data.AuditOAuthAuthorize,
+		Outcome:    outcome,
+		TargetType: "oauth_client",
+		TargetID:   client.ID,
+		Details:    map[string]interface{}{"scopes": scopes},
+	})
+
+	if !input.Approve {
+		redirectTo := redirectWith(input.RedirectURI, map[string]string{
+			"error": "access_denied",
+			"state": input.State,
+		})
+		err = app.writeJSON(w, http.StatusOK, envelope{"redirect_to": redirectTo}, nil)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	code := &data.OAuthCode{
+		ClientID:      client.ID,
+		UserID:        app.contextGetUser(r).ID,
+		RedirectURI:   input.RedirectURI,
+		Scopes:        scopes,
+		CodeChallenge: input.CodeChallenge,
+	}
+	err = app.models.OAuthTokens.NewCode(r.Context(), code, oauthCodeTTL)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	redirectTo := redirectWith(input.RedirectURI, map[string]string{
+		"code":  code.Plaintext,
+		"state": input.State,
+	})
+	err = app.writeJSON(w, http.StatusOK, envelope{"redirect_to": redirectTo}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// authenticateOAuthClient() identifies the client calling the token or revocation
+// endpoint, from either HTTP Basic authentication or the client_id and client_secret
+// form parameters. Confidential clients must present their secret; public clients
+// only identify themselves.
+func (app *application) authenticateOAuthClient(w http.ResponseWriter, r *http.Request) (*data.OAuthClient, bool) {
+	clientID, secret, ok := r.BasicAuth()
+	if ok {
+		clientID, _ = url.QueryUnescape(clientID)
+		secret, _ = url.QueryUnescape(secret)
+	} else {
+		clientID, secret = r.PostForm.Get("client_id"), r.PostForm.Get("client_secret")
+	}
+
+	client, err := app.models.OAuthClients.Get(r.Context(), clientID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.oauthErrorResponse(w, r, http.StatusUnauthorized, "invalid_client", "unknown client")
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return nil, false
+	}
+
+	if (client.Confidential && !client.Authenticate(secret)) || (!client.Confidential && secret != "") {
+		app.oauthErrorResponse(w, r, http.StatusUnauthorized, "invalid_client", "client authentication failed")
+		return nil, false
+	}
+	return client, true
+}
+
+// verifyCodeVerifier() checks a PKCE code verifier against the S256 challenge of the
+// authorization request. Verifiers are 43 to 128 unreserved characters (RFC 7636
+// section 4.1), which rules out guessable ones such as an empty string.
+func verifyCodeVerifier(verifier, challenge string) bool {
+	if len(verifier) < 43 || len(verifier) > 128 {
+		return false
+	}
+	for _, c := range verifier {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.ContainsRune("-._~", c)) {
+			return false
+		}
+	}
+	return subtle.ConstantTimeCompare([]byte(oidc.CodeChallenge(verifier)), []byte(challenge)) == 1
+}
+
+// The token endpoint (RFC 6749 section 3.2). Unlike the rest of the API it takes form
+// encoded parameters, as OAuth client libraries expect.
+func (app *application) createOAuthTokenHandler(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, 1_048_576)
+	err := r.ParseForm()
+	if err != nil {
+		app.oauthErrorResponse(w, r, http.StatusBadRequest, "invalid_request", err.Error())
+		return
+	}
+
+	client, ok := app.authenticateOAuthClient(w, r)
+	if !ok {
+		return
+	}
+
+	var userID int64
+	var scopes data.Permissions
+
+	switch r.PostForm.Get("grant_type") {
+	case "authorization_code":
+		code, err := app.models.OAuthTokens.ConsumeCode(r.Context(), r.PostForm.Get("code"))
+		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrRecordNotFound):
+				app.oauthErrorResponse(w, r, http.StatusBadRequest, "invalid_grant", "invalid, expired or already used authorization code")
+			default:
+				app.serverErrorResponse(w, r, err)
+			}
+			return
+		}
+
+		switch {
+		case code.ClientID != client.ID:
+			app.oauthErrorResponse(w, r, http.StatusBadRequest, "invalid_grant", "authorization code was issued to another client")
+			return
+		case code.RedirectURI != r.PostForm.Get("redirect_uri"):
+			app.oauthErrorResponse(w, r, http.StatusBadRequest, "invalid_grant", "redirect_uri does not match the authorization request")
+			return
+		case !verifyCodeVerifier(r.PostForm.Get("code_verifier"), code.CodeChallenge):
+			app.oauthErrorResponse(w, r, http.StatusBadRequest, "invalid_grant", "code_verifier does not match the code challenge")
+			return
+		}
+		userID, scopes = code.UserID, code.Scopes
+
+	case "refresh_token":
+		plaintext := r.PostForm.Get("refresh_token")
+		token, err := app.models.OAuthTokens.Get(r.Context(), data.OAuthKindRefresh, plaintext)
+		if err == nil && token.ClientID == client.ID {
+			// Refresh tokens are single use: each refresh returns a new one.
+			token, err = app.models.OAuthTokens.Consume(r.Context(), data.OAuthKindRefresh, plaintext)
+		} else if err == nil {
+			err = data.ErrRecordNotFound
+		}
+		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrRecordNotFound):
+				app.oauthErrorResponse(w, r, http.StatusBadRequest, "invalid_grant", "invalid, expired or revoked refresh token")
+			default:
+				app.serverErrorResponse(w, r, err)
+			}
+			return
+		}
+		userID, scopes = token.UserID, token.Scopes
+
+	default:
+		app.oauthErrorResponse(w, r, http.StatusBadRequest, "unsupported_grant_type", "grant_type must be authorization_code or refresh_token")
+		return
+	}
+
+	accessToken, err := app.models.OAuthTokens.New(r.Context(), data.OAuthKindAccess, client.ID, userID, scopes, oauthAccessTokenTTL)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	refreshToken, err := app.models.OAuthTokens.New(r.Context(), data.OAuthKindRefresh, client.ID, userID, scopes, oauthRefreshTokenTTL)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.audit(r, data.AuditEvent{
+		ActorID:    &userID,
+		Action:     data.AuditOAuthTokenCreate,
+		Outcome:    data.AuditSuccess,
+		TargetType: "oauth_client",
+		TargetID:   client.ID,
+		Details:    map[string]interface{}{"grant_type": r.PostForm.Get("grant_type"), "scopes": scopes},
+	})
+
+	env := envelope{
+		"access_token":  accessToken.Plaintext,
+		"token_type":    "Bearer",
+		"expires_in":    int(oauthAccessTokenTTL.Seconds()),
+		"refresh_token": refreshToken.Plaintext,
+		"scope":         strings.Join(scopes, " "),
+	}
+	err = app.writeJSON(w, http.StatusOK, env, http.Header{"Cache-Control": []string{"no-store"}})
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The token revocation endpoint (RFC 7009). Revoking an unknown token succeeds, so that
+// clients can't probe for valid tokens.
+func (app *application) revokeOAuthTokenHandler(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, 1_048_576)
+	err := r.ParseForm()
+	if err != nil {
+		app.oauthErrorResponse(w, r, http.StatusBadRequest, "invalid_request", err.Error())
+		return
+	}
+
+	client, ok := app.authenticateOAuthClient(w, r)
+	if !ok {
+		return
+	}
+
+	err = app.models.OAuthTokens.DeleteForClient(r.Context(), r.PostForm.Get("token"), client.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.audit(r, data.AuditEvent{
+		Action:     data.AuditOAuthTokenRevoke,
+		Outcome:    data.AuditSuccess,
+		TargetType: "oauth_client",
+		TargetID:   client.ID,
+	})
+	w.WriteHeader(http.StatusOK)
+}
+
+// Register a third-party app. The client secret is only ever returned in this response.
+func (app *application) createOAuthClientHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Name         string   `json:"name"`
+		RedirectURIs []string `json:"redirect_uris"`
+		Scopes       []string `json:"scopes"`
+		Confidential *bool    `json:"confidential"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	client := &data.OAuthClient{
+		UserID:       app.contextGetUser(r).ID,
+		Name:         input.Name,
+		RedirectURIs: input.RedirectURIs,
+		Scopes:       input.Scopes,
+		Confidential: input.Confidential == nil || *input.Confidential,
+	}
+
+	v := validator.New()
+	if data.ValidateOAuthClient(v, client); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.OAuthClients.New(r.Context(), client)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.audit(r, data.AuditEvent{
+		Action:     data.AuditOAuthClientCreate,
+		Outcome:    data.AuditSuccess,
+		TargetType: "oauth_client",
+		TargetID:   client.ID,
+		Details:    map[string]interface{}{"name": client.Name, "redirect_uris": client.RedirectURIs, "scopes": client.Scopes},
+	})
+
+	err = app.writeJSON(w, http.StatusCreated, envelope{"client": client}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) listOAuthClientsHandler(w http.ResponseWriter, r *http.Request) {
+	clients, err := app.models.OAuthClients.GetAllForUser(r.Context(), app.contextGetUser(r).ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"clients": clients}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) deleteOAuthClientHandler(w http.ResponseWriter, r *http.Request) {
+	id := httprouter.ParamsFromContext(r.Context()).ByName("id")
+
+	err := app.models.OAuthClients.DeleteForUser(r.Context(), id, app.contextGetUser(r).ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	app.audit(r, data.AuditEvent{
+		Action:     data.AuditOAuthClientDelete,
+		Outcome:    data.AuditSuccess,
+		TargetType: "oauth_client",
+		TargetID:   id,
+	})
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "client successfully deleted"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// List the third-party apps which currently have access to the user's account.
+func (app *application) listAuthorizedAppsHandler(w http.ResponseWriter, r *http.Request) {
+	clients, err := app.models.OAuthClients.GetAuthorizedForUser(r.Context(), app.contextGetUser(r).ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	apps := make([]envelope, 0, len(clients))
+	for _, client := range clients {
+		apps = append(apps, envelope{"client_id": client.ID, "name": client.Name})
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"apps": apps}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Revoke a third-party app's access to the user's account.
+func (app *application) deleteAuthorizedAppHandler(w http.ResponseWriter, r *http.Request) {
+	id := httprouter.ParamsFromContext(r.Context()).ByName("id")
+
+	err := app.models.OAuthTokens.DeleteAllForUser(r.Context(), id, app.contextGetUser(r).ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	app.audit(r, data.AuditEvent{
+		Action:     data.AuditOAuthAppRevoke,
+		Outcome:    data.AuditSuccess,
+		TargetType: "oauth_client",
+		TargetID:   id,
+	})
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "access successfully revoked"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
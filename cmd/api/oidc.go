@@ -0,0 +1,287 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/henrtytanoh/greenlight/internal/data"
+	jsonlog "github.com/henrtytanoh/greenlight/internal/jsonLog"
+	"github.com/henrtytanoh/greenlight/internal/oidc"
+	"github.com/henrtytanoh/greenlight/internal/validator"
+	"github.com/julienschmidt/httprouter"
+	"github.com/redis/go-redis/v9"
+)
+
+// How long a user has to complete the login at the identity provider.
+const oidcStateTTL = 10 * time.Minute
+
+// oidcLogin is what we remember about a login between sending the user to the identity
+// provider and their return to the callback. It is stored in redis under its state.
+type oidcLogin struct {
+	Provider string `json:"provider"`
+	Nonce    string `json:"nonce"`
+	Verifier string `json:"verifier"`
+}
+
+func oidcStateKey(state string) string {
+	return "oidc:state:" + state
+}
+
+func (app *application) readOIDCProvider(w http.ResponseWriter, r *http.Request) (*oidc.Provider, bool) {
+	name := httprouter.ParamsFromContext(r.Context()).ByName("provider")
+	provider, ok := app.oidcProviders[name]
+	if !ok {
+		app.notFoundResponse(w, r)
+		return nil, false
+	}
+	return provider, true
+}
+
+// List the names of the configured identity providers.
+func (app *application) listOIDCProvidersHandler(w http.ResponseWriter, r *http.Request) {
+	names := make([]string, 0, len(app.oidcProviders))
+	for name := range app.oidcProviders {
+		names = append(names, name)
+	}
+
+	err := app.writeJSON(w, http.StatusOK, envelope{"providers": names}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Start a login by redirecting the user to the identity provider. The state, nonce and
+// PKCE verifier are kept server side, so the client doesn't have to carry anything
+// between the two legs of the flow.
+func (app *application) oidcLoginHandler(w http.ResponseWriter, r *http.Request) {
+	provider, ok := app.readOIDCProvider(w, r)
+	if !ok {
+		return
+	}
+
+	var login oidcLogin
+	var state string
+	var err error
+	for _, dst := range []*string{&state, &login.Nonce, &login.Verifier} {
+		*dst, err = oidc.RandomString()
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+	login.Provider = provider.Name
+
+	authURL, err := provider.AuthCodeURL(r.Context(), state, login.Nonce, login.Verifier)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	js, err := json.Marshal(login)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	err = app.redisClient.Set(r.Context(), oidcStateKey(state), js, oidcStateTTL).Err()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	http.Redirect(w, r, authURL, http.StatusFound)
+}
+
+// The identity provider redirects the user back here with an authorization code, which
+// is exchanged for an ID token. The user it identifies is then logged in exactly as if
+// they had used their password.
+func (app *application) oidcCallbackHandler(w http.ResponseWriter, r *http.Request) {
+	provider, ok := app.readOIDCProvider(w, r)
+	if !ok {
+		return
+	}
+
+	qs := r.URL.Query()
+	if errorCode := qs.Get("error"); errorCode != "" {
+		message := fmt.Sprintf("the identity provider did not complete the login: %s", errorCode)
+		if description := qs.Get("error_description"); description != "" {
+			message += " (" + description + ")"
+		}
+		app.errorResponse(w, r, http.StatusUnauthorized, message)
+		return
+	}
+
+	state := qs.Get("state")
+	code := qs.Get("code")
+
+	v := validator.New()
+	v.Check(state != "", "state", "must be provided")
+	v.Check(code != "", "code", "must be provided")
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// The state is deleted as it is read, so that each login can only complete once.
+	js, err := app.redisClient.GetDel(r.Context(), oidcStateKey(state)).Bytes()
+	if err != nil && !errors.Is(err, redis.Nil) {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	var login oidcLogin
+	if err == nil {
+		err = json.Unmarshal(js, &login)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+	if login.Provider != provider.Name {
+		v.AddError("state", "invalid or expired login state")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	claims, err := provider.Exchange(r.Context(), code, login.Verifier, login.Nonce)
+	if err != nil {
+		app.logger.PrintError(err, app.logProperties(r, jsonlog.Properties{"provider": provider.Name}))
+		app.errorResponse(w, r, http.StatusUnauthorized, "the login could not be verified with the identity provider")
+		return
+	}
+
+	// Accounts are matched by email address, so we only trust addresses the provider
+	// has verified.
+	if claims.Email == "" || !claims.EmailVerified {
+		app.errorResponse(w, r, http.StatusForbidden, "the identity provider did not return a verified email address")
+		return
+	}
+
+	user, err := app.userForIdentity(r, provider.Name, claims)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// The identity provider replaces the password, so the login lockout doesn't apply
+	// here. A second factor enabled on the local account still does: the provider may
+	// not require one, and the user chose to protect this account with it.
+	app.completeLogin(w, r, user, "oidc:"+provider.Name)
+}
+
+// userForIdentity() returns the user linked to an external identity. The first time an
+// identity is seen it is linked to the user with the same email address, who is created
+// if they don't exist yet. Either way the user ends up activated, since the provider has
+// verified that they own the address.
+//
+// An account which was never activated may have been registered by someone else who
+// knew the address, waiting for its owner to sign in. Before it is linked, its password
+// is replaced with a random one and its tokens are revoked, so that whoever registered
+// it loses access.
+func (app *application) userForIdentity(r *http.Request, providerName string, claims *oidc.Claims) (*data.User, error) {
+	identity, err := app.models.Identities.Touch(r.Context(), providerName, claims.Subject, claims.Email)
+	switch {
+	case err == nil:
+		return app.models.Users.Get(r.Context(), identity.UserID)
+	case !errors.Is(err, data.ErrRecordNotFound):
+		return nil, err
+	}
+
+	user, err := app.models.Users.GetByEmail(r.Context(), claims.Email)
+	switch {
+	case errors.Is(err, data.ErrRecordNotFound):
+		user, err = app.createIdentityUser(r.Context(), claims)
+		if err != nil {
+			return nil, err
+		}
+	case err != nil:
+		return nil, err
+	case !user.Activated:
+		err = app.resetUnverifiedUser(r.Context(), user)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = app.models.Identities.Insert(r.Context(), &data.Identity{
+		Provider: providerName,
+		Subject:  claims.Subject,
+		UserID:   user.ID,
+		Email:    claims.Email,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	app.logger.PrintInfo("linked external identity", app.logProperties(r, jsonlog.Properties{
+		"provider": providerName,
+		"user_id":  user.ID,
+	}))
+	return user, nil
+}
+
+// resetUnverifiedUser() activates a user who signs in with an identity provider before
+// having activated their account, dropping every credential set up before their email
+// address was verified.
+func (app *application) resetUnverifiedUser(ctx context.Context, user *data.User) error {
+	password, err := oidc.RandomString()
+	if err != nil {
+		return err
+	}
+	err = user.Password.Set(password)
+	if err != nil {
+		return err
+	}
+	user.Activated = true
+	err = app.models.Users.Update(ctx, user)
+	if err != nil {
+		return err
+	}
+
+	for _, scope := range []string{data.ScopeActivation, data.ScopeAuthentication, data.ScopePasswordReset, data.ScopeRefresh, data.ScopeMFA} {
+		err = app.models.Tokens.DeleteAllForUser(ctx, scope, user.ID)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// createIdentityUser() registers a user who signed in with an identity provider. They
+// are given a random password nobody knows; they can still set one of their own
+// through the password reset flow.
+func (app *application) createIdentityUser(ctx context.Context, claims *oidc.Claims) (*data.User, error) {
+	name := claims.Name
+	if name == "" {
+		name, _, _ = strings.Cut(claims.Email, "@")
+	}
+
+	user := &data.User{
+		Name:      name,
+		Email:     claims.Email,
+		Activated: true,
+	}
+
+	password, err := oidc.RandomString()
+	if err != nil {
+		return nil, err
+	}
+	err = user.Password.Set(password)
+	if err != nil {
+		return nil, err
+	}
+
+	err = app.models.Users.Insert(ctx, user)
+	if err != nil {
+		return nil, err
+	}
+
+	err = app.models.Roles.AddForUser(ctx, user.ID, app.config.users.defaultRole)
+	if err != nil {
+		return nil, err
+	}
+	return user, nil
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/henrtytanoh/greenlight/internal/data"
+	jsonlog "github.com/henrtytanoh/greenlight/internal/jsonLog"
+	"github.com/henrtytanoh/greenlight/internal/payments"
+)
+
+// Receive a webhook event from the payment provider. Providers deliver events at least
+// once and retry until they get a 2xx response, so events which were already processed,
+// or which no longer apply to their subscription, are acknowledged without effect.
+func (app *application) paymentWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, 1_048_576)
+	payload, err := io.ReadAll(r.Body)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	event, err := app.payments.ParseWebhook(payload, r.Header)
+	if err != nil {
+		switch {
+		case errors.Is(err, payments.ErrInvalidSignature):
+			app.errorResponse(w, r, http.StatusBadRequest, "invalid webhook signature")
+		default:
+			app.badRequestResponse(w, r, err)
+		}
+		return
+	}
+
+	// The reference is the ID of the subscription the checkout was opened for. Events
+	// about anything else are recorded under no subscription.
+	subscriptionID, _ := strconv.ParseInt(event.Reference, 10, 64)
+	paymentEvent := data.PaymentEvent{Provider: app.payments.Name(), ID: event.ID, Type: event.Type}
+
+	switch event.Type {
+	case payments.EventCheckoutCompleted:
+		err = app.models.Subscriptions.Activate(r.Context(), paymentEvent, subscriptionID, event.SubscriptionID)
+	case payments.EventInvoicePaid:
+		err = app.models.Subscriptions.Renew(r.Context(), paymentEvent, subscriptionID, event.PeriodEnd)
+	case payments.EventSubscriptionCanceled:
+		err = app.models.Subscriptions.End(r.Context(), paymentEvent, subscriptionID)
+	default:
+		err = app.models.Subscriptions.RecordPaymentEvent(r.Context(), paymentEvent, subscriptionID)
+	}
+
+	properties := jsonlog.Properties{
+		"event_id":        event.ID,
+		"event_type":      event.Type,
+		"subscription_id": event.Reference,
+	}
+	switch {
+	case errors.Is(err, data.ErrDuplicatePaymentEvent):
+		app.logger.PrintInfo("ignored redelivered payment event", app.logProperties(r, properties))
+	case errors.Is(err, data.ErrRecordNotFound):
+		app.logger.PrintInfo("payment event does not apply to its subscription", app.logProperties(r, properties))
+	case err != nil:
+		app.serverErrorResponse(w, r, err)
+		return
+	default:
+		app.logger.PrintInfo("processed payment event", app.logProperties(r, properties))
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"received": true}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
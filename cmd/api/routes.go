@@ -3,19 +3,30 @@ package main
 import (
 	"net/http"
 
-	"github.com/julienschmidt/httprouter"
-
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
 )
 
 func (app *application) routes() http.Handler {
 	// Initialize a new httprouter router instance.
-	router := httprouter.New()
+	router := newPatternRouter(app.contextSetRoute)
 
-	router.NotFound = http.HandlerFunc(app.notFoundResponse)
-	router.MethodNotAllowed = http.HandlerFunc(app.methodNotAllowedResponse)
+	// Every route goes through authentication and rate limiting, except the probes and
+	// Prometheus scrapes, so that the API stays alive, and observable, while redis or
+	// Postgres is down.
+	router.Middleware = func(next http.Handler) http.Handler {
+		return app.timeout(app.enableCORS(app.rateLimitAuthentication(app.authenticate(app.rateLimit(next)))))
+	}
+	router.UnwrappedHandler(http.MethodGet, "/v1/healthcheck", http.HandlerFunc(app.healthcheckHandler))
+	router.UnwrappedHandler(http.MethodGet, "/v1/health/live", http.HandlerFunc(app.livenessHandler))
+	router.UnwrappedHandler(http.MethodGet, "/v1/health/ready", http.HandlerFunc(app.readinessHandler))
+	router.UnwrappedHandler(http.MethodGet, "/metrics", promhttp.HandlerFor(app.m.registry, promhttp.HandlerOpts{}))
 
-	router.HandlerFunc(http.MethodGet, "/v1/healthcheck", app.healthcheckHandler)
+	router.NotFound = router.Middleware(http.HandlerFunc(app.notFoundResponse))
+	router.MethodNotAllowed = router.Middleware(http.HandlerFunc(app.methodNotAllowedResponse))
+	// httprouter answers OPTIONS requests itself; CORS preflight requests are answered
+	// by enableCORS.
+	router.GlobalOPTIONS = router.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
 
 	router.HandlerFunc(http.MethodPost, "/v1/movies",
 		app.requirePermission("movies:write", app.createMovieHandler))
@@ -35,13 +46,75 @@ func (app *application) routes() http.Handler {
 	router.HandlerFunc(http.MethodPost, "/v1/users", app.registerUserHandler)
 	router.HandlerFunc(http.MethodPut, "/v1/users/activated", app.activateUserHandler)
 	router.HandlerFunc(http.MethodPut, "/v1/users/password", app.updateUserPasswordHandler)
-	router.HandlerFunc(http.MethodPost, "/v1/users/subscribe", app.createSubscription)
-	router.HandlerFunc(http.MethodPut, "/v1/users/unsubscribe", app.deleteSubscription)
+
+	// The routes which manage the account itself only accept the user's own credentials,
+	// not API keys or third-party apps' tokens.
+	router.HandlerFunc(http.MethodGet, "/v1/plans", app.listPlansHandler)
+	router.HandlerFunc(http.MethodGet, "/v1/users/me/subscription", app.requireActivatedUser(app.requireFirstPartyCredential(app.showSubscriptionHandler)))
+	router.HandlerFunc(http.MethodPost, "/v1/users/me/subscription", app.requireActivatedUser(app.requireFirstPartyCredential(app.createSubscriptionHandler)))
+	router.HandlerFunc(http.MethodDelete, "/v1/users/me/subscription", app.requireActivatedUser(app.requireFirstPartyCredential(app.deleteSubscriptionHandler)))
+	router.HandlerFunc(http.MethodPost, "/v1/webhooks/payments", app.paymentWebhookHandler)
+
+	router.HandlerFunc(http.MethodGet, "/v1/users/me/sessions", app.requireAuthenticatedUser(app.requireFirstPartyCredential(app.listSessionsHandler)))
+	router.HandlerFunc(http.MethodDelete, "/v1/users/me/sessions", app.requireAuthenticatedUser(app.requireFirstPartyCredential(app.deleteAllSessionsHandler)))
+	router.HandlerFunc(http.MethodDelete, "/v1/users/me/sessions/:id", app.requireAuthenticatedUser(app.requireFirstPartyCredential(app.deleteSessionHandler)))
+
+	router.HandlerFunc(http.MethodPost, "/v1/users/me/totp", app.requireActivatedUser(app.requireFirstPartyCredential(app.enrollTOTPHandler)))
+	router.HandlerFunc(http.MethodPut, "/v1/users/me/totp/verify", app.requireActivatedUser(app.requireFirstPartyCredential(app.confirmTOTPHandler)))
+	router.HandlerFunc(http.MethodDelete, "/v1/users/me/totp", app.requireActivatedUser(app.requireFirstPartyCredential(app.deleteTOTPHandler)))
+
+	router.HandlerFunc(http.MethodGet, "/v1/users/me/api-keys", app.requireActivatedUser(app.requireFirstPartyCredential(app.listAPIKeysHandler)))
+	router.HandlerFunc(http.MethodPost, "/v1/users/me/api-keys", app.requireActivatedUser(app.requireFirstPartyCredential(app.createAPIKeyHandler)))
+	router.HandlerFunc(http.MethodDelete, "/v1/users/me/api-keys/:id", app.requireActivatedUser(app.requireFirstPartyCredential(app.deleteAPIKeyHandler)))
+
+	router.HandlerFunc(http.MethodGet, "/v1/users/me/oauth-apps", app.requireActivatedUser(app.requireFirstPartyCredential(app.listAuthorizedAppsHandler)))
+	router.HandlerFunc(http.MethodDelete, "/v1/users/me/oauth-apps/:id", app.requireActivatedUser(app.requireFirstPartyCredential(app.deleteAuthorizedAppHandler)))
+
+	router.HandlerFunc(http.MethodGet, "/v1/oauth/clients", app.requireActivatedUser(app.requireFirstPartyCredential(app.listOAuthClientsHandler)))
+	router.HandlerFunc(http.MethodPost, "/v1/oauth/clients", app.requireActivatedUser(app.requireFirstPartyCredential(app.createOAuthClientHandler)))
+	router.HandlerFunc(http.MethodDelete, "/v1/oauth/clients/:id", app.requireActivatedUser(app.requireFirstPartyCredential(app.deleteOAuthClientHandler)))
+	router.HandlerFunc(http.MethodGet, "/v1/oauth/authorize", app.requireActivatedUser(app.requireFirstPartyCredential(app.showOAuthAuthorizationHandler)))
+	router.HandlerFunc(http.MethodPost, "/v1/oauth/authorize", app.requireActivatedUser(app.requireFirstPartyCredential(app.createOAuthAuthorizationHandler)))
+	router.HandlerFunc(http.MethodPost, "/v1/oauth/token", app.createOAuthTokenHandler)
+	router.HandlerFunc(http.MethodPost, "/v1/oauth/revoke", app.revokeOAuthTokenHandler)
+
+	router.HandlerFunc(http.MethodGet, "/v1/admin/users/:id/roles",
+		app.requirePermission("admin:access", app.showUserRolesHandler))
+	router.HandlerFunc(http.MethodPut, "/v1/admin/users/:id/roles",
+		app.requirePermission("admin:access", app.updateUserRolesHandler))
+
+	router.HandlerFunc(http.MethodGet, "/v1/admin/lockouts",
+		app.requirePermission("admin:access", app.showLoginLockoutHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/admin/lockouts",
+		app.requirePermission("admin:access", app.deleteLoginLockoutHandler))
+
+	router.HandlerFunc(http.MethodGet, "/v1/admin/audit",
+		app.requirePermission("admin:access", app.listAuditEventsHandler))
 
 	router.HandlerFunc(http.MethodPost, "/v1/tokens/activation", app.createActivationTokenHandler)
 	router.HandlerFunc(http.MethodPost, "/v1/tokens/authentication", app.createAuthenticationTokenHandler)
 	router.HandlerFunc(http.MethodPost, "/v1/tokens/password-reset", app.createPasswordResetTokenHandler)
+	router.HandlerFunc(http.MethodPost, "/v1/tokens/mfa", app.createAuthenticationTokenFromMFAHandler)
+
+	router.HandlerFunc(http.MethodGet, "/v1/oidc", app.listOIDCProvidersHandler)
+	router.HandlerFunc(http.MethodGet, "/v1/oidc/:provider/login", app.oidcLoginHandler)
+	router.HandlerFunc(http.MethodGet, "/v1/oidc/:provider/callback", app.oidcCallbackHandler)
+
+	// Signed access tokens can't be revoked, so in JWT mode logging out revokes the
+	// refresh token instead of the authentication token.
+	if app.config.auth.mode == authModeJWT {
+		router.HandlerFunc(http.MethodPost, "/v1/tokens/refresh", app.refreshAuthenticationTokenHandler)
+		router.HandlerFunc(http.MethodDelete, "/v1/tokens/refresh", app.deleteRefreshTokenHandler)
+		router.HandlerFunc(http.MethodGet, "/.well-known/jwks.json", app.jwksHandler)
+	} else {
+		router.HandlerFunc(http.MethodDelete, "/v1/tokens/authentication", app.requireAuthenticatedUser(app.requireFirstPartyCredential(app.deleteAuthenticationTokenHandler)))
+	}
+
+	handler := app.requestID(app.metrics(app.recoverPanic(router)))
 
-	router.Handler(http.MethodGet, "/metrics", promhttp.Handler())
-	return app.metrics(app.recoverPanic(app.enableCORS(app.rateLimit(app.authenticate(router)))))
+	// Every request gets a server span, continuing the trace of its traceparent header
+	// if it has one. Prometheus scrapes would only be noise.
+	return otelhttp.NewHandler(handler, "greenlight",
+		otelhttp.WithFilter(func(r *http.Request) bool { return r.URL.Path != "/metrics" }),
+	)
 }
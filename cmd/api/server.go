@@ -4,20 +4,29 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
 	"time"
+
+	jsonlog "github.com/henrtytanoh/greenlight/internal/jsonLog"
 )
 
 func (app *application) serve() error {
+	// The contexts of all requests derive from base, so that canceling it stops the
+	// queries of the requests still running when the shutdown grace period is over.
+	base, cancelRequests := context.WithCancel(context.Background())
+	defer cancelRequests()
+
 	srv := &http.Server{
 		Addr:         fmt.Sprintf(":%d", app.config.port),
 		Handler:      app.routes(),
 		IdleTimeout:  time.Minute,
 		ReadTimeout:  10 * time.Second,
 		WriteTimeout: 30 * time.Second,
+		BaseContext:  func(net.Listener) context.Context { return base },
 	}
 
 	shutdownError := make(chan error)
@@ -30,7 +39,7 @@ func (app *application) serve() error {
 		signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
 
 		s := <-quit
-		app.logger.PrintInfo("shutting down server", map[string]string{
+		app.logger.PrintInfo("shutting down server", jsonlog.Properties{
 			"signal": s.String(),
 		})
 
@@ -40,13 +49,15 @@ func (app *application) serve() error {
 
 		// shutdown the server
 		err := srv.Shutdown(ctx)
+		cancelRequests()
 		if err != nil {
 			shutdownError <- err
+			return
 		}
 
 		// Log a message to say that we're waiting for any background goroutines to
 		// complete their tasks.
-		app.logger.PrintInfo("completing background tasks", map[string]string{
+		app.logger.PrintInfo("completing background tasks", jsonlog.Properties{
 			"addr": srv.Addr,
 		})
 		// Call Wait() to block until our WaitGroup counter is zero --- essentially
@@ -54,10 +65,22 @@ func (app *application) serve() error {
 		// the shutdownError channel, to indicate that the shutdown completed without
 		// any issues.
 		app.wg.Wait()
+
+		// Send the errors still queued for the error tracker. The shutdown context may
+		// well have expired by now, so they get a timeout of their own.
+		if app.errorTracker != nil {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			err = app.errorTracker.Close(ctx)
+			if err != nil {
+				shutdownError <- err
+				return
+			}
+		}
 		shutdownError <- nil
 	}()
 
-	app.logger.PrintInfo("starting server", map[string]string{
+	app.logger.PrintInfo("starting server", jsonlog.Properties{
 		"addr": srv.Addr,
 		"env":  app.config.env,
 	})
@@ -73,7 +96,7 @@ func (app *application) serve() error {
 		return err
 	}
 
-	app.logger.PrintInfo("stopped server", map[string]string{
+	app.logger.PrintInfo("stopped server", jsonlog.Properties{
 		"addr": srv.Addr,
 	})
 
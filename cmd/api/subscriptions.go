@@ -0,0 +1,290 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/henrtytanoh/greenlight/internal/data"
+	jsonlog "github.com/henrtytanoh/greenlight/internal/jsonLog"
+	"github.com/henrtytanoh/greenlight/internal/payments"
+	"github.com/henrtytanoh/greenlight/internal/validator"
+)
+
+// List the plans users can subscribe to.
+func (app *application) listPlansHandler(w http.ResponseWriter, r *http.Request) {
+	plans, err := app.models.Plans.GetAll(r.Context())
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"plans": plans}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Show the user's current subscription, which is null when they don't have one.
+func (app *application) showSubscriptionHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	subscription, err := app.models.Subscriptions.GetCurrentForUser(r.Context(), user.ID)
+	if err != nil && !errors.Is(err, data.ErrRecordNotFound) {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"subscription": subscription}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Subscribe to a plan. The subscription starts incomplete and the user is sent to the
+// payment provider's checkout; it becomes current once the provider reports that the
+// checkout was completed. Subscribing again to the plan of a subscription which has been
+// canceled, but hasn't ended yet, resumes it instead.
+func (app *application) createSubscriptionHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Plan string `json:"plan"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	if data.ValidatePlanCode(v, input.Plan); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// The user in the context only carries an ID when authenticated with a signed
+	// access token, so fetch the full record for the email address.
+	user, err := app.models.Users.Get(r.Context(), app.contextGetUser(r).ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	current, err := app.models.Subscriptions.GetCurrentForUser(r.Context(), user.ID)
+	if err != nil && !errors.Is(err, data.ErrRecordNotFound) {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	switch {
+	case current == nil:
+	case current.Status == data.SubscriptionIncomplete:
+		// The user didn't complete their previous checkout; start over.
+		err = app.models.Subscriptions.AbandonIncomplete(r.Context(), user.ID)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	case current.Plan.Code != input.Plan || !current.CancelAtPeriodEnd:
+		v.AddError("plan", "you already have a subscription, cancel it first")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	case current.Provider == "":
+		// Complimentary subscriptions, such as those given to the users of the old
+		// subscribe toggle, were never paid for, so resuming one would be free.
+		v.AddError("plan", "your complimentary subscription can't be renewed, subscribe again once it has ended")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	default:
+		app.resumeSubscription(w, r, current)
+		return
+	}
+
+	plan, err := app.models.Plans.GetByCode(r.Context(), input.Plan)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("plan", "unknown plan")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	subscription, err := app.models.Subscriptions.New(r.Context(), user.ID, plan, app.payments.Name())
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrDuplicateSubscription):
+			v.AddError("plan", "you already have a subscription, cancel it first")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	checkout, err := app.payments.CreateCheckout(r.Context(), payments.CheckoutRequest{
+		Reference:   strconv.FormatInt(subscription.ID, 10),
+		Email:       user.Email,
+		PlanCode:    plan.Code,
+		PlanName:    plan.Name,
+		AmountCents: plan.PriceCents,
+		Currency:    plan.Currency,
+		PeriodDays:  plan.PeriodDays,
+		TrialDays:   plan.TrialDays,
+	})
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.models.Subscriptions.SetCheckout(r.Context(), subscription, checkout.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	env := envelope{"subscription": subscription, "checkout_url": checkout.URL}
+	err = app.writeJSON(w, http.StatusCreated, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// resumeSubscription() undoes the cancellation of a subscription, at the payment
+// provider first so that the user is charged for the next period.
+func (app *application) resumeSubscription(w http.ResponseWriter, r *http.Request, subscription *data.Subscription) {
+	if subscription.ProviderSubscriptionID != "" {
+		err := app.payments.SetCancelAtPeriodEnd(r.Context(), subscription.ProviderSubscriptionID, false)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	subscription.CancelAtPeriodEnd = false
+	subscription.CanceledAt = nil
+	err := app.models.Subscriptions.Update(r.Context(), subscription)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"subscription": subscription}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Cancel the user's subscription. It stays current until the end of the period that
+// has been paid for, or of the trial. A subscription whose checkout wasn't completed is
+// abandoned straight away.
+func (app *application) deleteSubscriptionHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	subscription, err := app.models.Subscriptions.GetCurrentForUser(r.Context(), user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	switch {
+	case subscription.Status == data.SubscriptionIncomplete:
+		err = app.models.Subscriptions.AbandonIncomplete(r.Context(), user.ID)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		now := time.Now()
+		subscription.Status = data.SubscriptionIncompleteExpired
+		subscription.EndedAt = &now
+
+	case !subscription.CancelAtPeriodEnd:
+		if subscription.ProviderSubscriptionID != "" {
+			err = app.payments.SetCancelAtPeriodEnd(r.Context(), subscription.ProviderSubscriptionID, true)
+			if err != nil {
+				app.serverErrorResponse(w, r, err)
+				return
+			}
+		}
+
+		now := time.Now()
+		subscription.CancelAtPeriodEnd = true
+		subscription.CanceledAt = &now
+		err = app.models.Subscriptions.Update(r.Context(), subscription)
+		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrEditConflict):
+				app.editConflictResponse(w, r)
+			default:
+				app.serverErrorResponse(w, r, err)
+			}
+			return
+		}
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"subscription": subscription}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// processSubscriptions() expires the subscriptions which are over: those which were
+// canceled, those the payment provider stopped renewing, and abandoned checkouts.
+// Expiring a subscription is what revokes the permissions of its plan's role.
+// Renewals are driven by the payment provider's webhook events.
+func (app *application) processSubscriptions(ctx context.Context) error {
+	userIDs, err := app.models.Subscriptions.ExpireDue(ctx, app.config.subscriptions.renewalGrace, app.config.subscriptions.checkoutTTL)
+	if err != nil {
+		return err
+	}
+	for _, userID := range userIDs {
+		app.logger.PrintInfo("subscription expired", jsonlog.Properties{"user_id": userID})
+	}
+	return nil
+}
+
+// currentPlan() returns the code of the plan whose role the user currently holds
+// through a subscription, or "" if none.
+func (app *application) currentPlan(ctx context.Context, userID int64) (string, error) {
+	subscription, err := app.models.Subscriptions.GetCurrentForUser(ctx, userID)
+	switch {
+	case errors.Is(err, data.ErrRecordNotFound):
+		return "", nil
+	case err != nil:
+		return "", err
+	case subscription.Status == data.SubscriptionIncomplete || !subscription.CurrentPeriodEnd.After(time.Now()):
+		return "", nil
+	}
+	return subscription.Plan.Code, nil
+}
+
+// runSubscriptionJob() processes subscriptions for the lifetime of the process. Every
+// replica runs it; the updates are safe to run concurrently.
+func (app *application) runSubscriptionJob() {
+	ticker := time.NewTicker(app.config.subscriptions.checkInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		err := app.processSubscriptions(context.Background())
+		if err != nil {
+			app.logger.PrintError(err, nil)
+		}
+	}
+}
@@ -3,9 +3,11 @@ package main
 import (
 	"errors"
 	"net/http"
+	"strconv"
 	"time"
 
 	"github.com/henrtytanoh/greenlight/internal/data"
+	jsonlog "github.com/henrtytanoh/greenlight/internal/jsonLog"
 	"github.com/henrtytanoh/greenlight/internal/validator"
 )
 
@@ -25,16 +27,37 @@ func (app *application) createAuthenticationTokenHandler(w http.ResponseWriter,
 	v := validator.New()
 
 	data.ValidateEmail(v, input.Email)
-	data.ValidatePasswordPlaintext(v, input.Password)
+	// The password policy only applies to new passwords, so that tightening it never
+	// locks existing users out.
+	v.Check(input.Password != "", "password", "must be provided")
 	if !v.Valid() {
 		app.failedValidationResponse(w, r, v.Errors)
 		return
 	}
 
-	user, err := app.models.Users.GetByEmail(input.Email)
+	ip := app.clientIP(r)
+
+	retryAfter, err := app.loginRetryAfter(r.Context(), input.Email, ip)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if retryAfter > 0 {
+		app.auditLoginFailure(r, nil, input.Email, "locked")
+		app.loginLockedResponse(w, r, retryAfter)
+		return
+	}
+
+	user, err := app.models.Users.GetByEmail(r.Context(), input.Email)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
+			err = app.recordLoginFailure(r, input.Email, nil)
+			if err != nil {
+				app.serverErrorResponse(w, r, err)
+				return
+			}
+			app.auditLoginFailure(r, nil, input.Email, "unknown_email")
 			app.invalidCredentialsResponse(w, r)
 		default:
 			app.serverErrorResponse(w, r, err)
@@ -42,29 +65,311 @@ func (app *application) createAuthenticationTokenHandler(w http.ResponseWriter,
 		return
 	}
 
+	// Password hashing is deliberately slow, so it gets a span of its own.
+	_, span := tracer.Start(r.Context(), "Password.Matches")
 	match, err := user.Password.Matches(input.Password)
+	span.End()
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
 
 	if !match {
+		err = app.recordLoginFailure(r, input.Email, user)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		app.auditLoginFailure(r, user, input.Email, "invalid_password")
 		app.invalidCredentialsResponse(w, r)
 		return
 	}
 
-	token, err := app.models.Tokens.New(user.ID, 24*time.Hour,
-		data.ScopeAuthentication)
+	// Store the password again if it was hashed with an outdated algorithm or
+	// parameters. Failing to do so must not prevent the user from logging in.
+	if user.Password.Rehashed() {
+		err = app.models.Users.Update(r.Context(), user)
+		if err != nil && !errors.Is(err, data.ErrEditConflict) {
+			app.logger.PrintError(err, app.logProperties(r, nil))
+		}
+	}
+
+	app.completeLogin(w, r, user, "password")
+}
+
+// completeLogin() logs in a user whose identity has been established by a password or an
+// identity provider. Users who have enabled two-factor authentication only get a
+// short-lived mfa token at this point, which has to be exchanged together with a
+// one-time code at POST /v1/tokens/mfa.
+func (app *application) completeLogin(w http.ResponseWriter, r *http.Request, user *data.User, method string) {
+	totp, err := app.models.TOTP.Get(r.Context(), user.ID)
+	if err != nil && !errors.Is(err, data.ErrRecordNotFound) {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if totp != nil && totp.Confirmed {
+		token, err := app.models.Tokens.New(r.Context(), user.ID, mfaTokenTTL, data.ScopeMFA)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		env := envelope{"mfa_token": token, "message": "a one-time code from your authenticator app is required"}
+		err = app.writeJSON(w, http.StatusAccepted, env, nil)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// Failures are only forgotten once the login is complete; with two-factor
+	// authentication that is when a valid code is entered.
+	err = app.resetLoginFailures(r.Context(), user.Email)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.issueAuthenticationTokens(w, r, user, method)
+}
+
+// auditLoginFailure() records a failed login. The user is nil when the email address
+// doesn't belong to anyone.
+func (app *application) auditLoginFailure(r *http.Request, user *data.User, email, reason string) {
+	event := data.AuditEvent{
+		Action:  data.AuditLogin,
+		Outcome: data.AuditFailure,
+		Details: map[string]interface{}{"email": email, "reason": reason},
+	}
+	if user != nil {
+		event.ActorID = &user.ID
+		event.TargetType, event.TargetID = "user", strconv.FormatInt(user.ID, 10)
+	}
+	app.audit(r, event)
+}
+
+// issueAuthenticationTokens() logs the user in and writes the tokens to the response. In
+// token mode this is an opaque token stored in the database; in jwt mode it is a
+// signed access token together with a refresh token. The method (password, mfa or the
+// name of an identity provider) is recorded in the audit log.
+func (app *application) issueAuthenticationTokens(w http.ResponseWriter, r *http.Request, user *data.User, method string) {
+	app.audit(r, data.AuditEvent{
+		ActorID:    &user.ID,
+		Action:     data.AuditLogin,
+		Outcome:    data.AuditSuccess,
+		TargetType: "user",
+		TargetID:   strconv.FormatInt(user.ID, 10),
+		Details:    map[string]interface{}{"method": method},
+	})
+
+	if app.config.auth.mode != authModeJWT {
+		token, err := app.models.Tokens.NewSession(r.Context(), user.ID, 24*time.Hour, app.clientIP(r), r.UserAgent())
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		err = app.writeJSON(w, http.StatusCreated, envelope{"authentication_token": token}, nil)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	app.issueTokenPair(w, r, user, "")
+}
+
+// issueTokenPair() creates an access token and a refresh token belonging to the given
+// refresh token family, starting a new family when it is empty.
+func (app *application) issueTokenPair(w http.ResponseWriter, r *http.Request, user *data.User, family string) {
+	permissions, err := app.models.Permissions.GetAllForUser(r.Context(), user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	accessToken, err := app.newAccessToken(user, permissions)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
 
-	err = app.writeJSON(w, http.StatusCreated, envelope{"authentication_token": token}, nil)
+	refreshToken, err := app.models.Tokens.NewRefresh(r.Context(), user.ID, app.config.auth.refreshTokenTTL, family, app.clientIP(r), r.UserAgent())
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
+
+	env := envelope{"authentication_token": accessToken, "refresh_token": refreshToken}
+	err = app.writeJSON(w, http.StatusCreated, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Exchange a refresh token for a new access token. Refresh tokens are single use: each
+// refresh returns a new one. If a refresh token that was already used is presented
+// again, it has most likely been stolen, so the whole family is revoked.
+func (app *application) refreshAuthenticationTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	if data.ValidateTokenPlaintext(v, input.RefreshToken); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	token, err := app.models.Tokens.GetRefresh(r.Context(), input.RefreshToken)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("refresh_token", "invalid or expired refresh token")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if token.UsedAt == nil {
+		err = app.models.Tokens.MarkUsed(r.Context(), token)
+	} else {
+		err = data.ErrEditConflict
+	}
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.logger.PrintError(errors.New("refresh token reuse detected, revoking token family"), app.logProperties(r, jsonlog.Properties{
+				"user_id": token.UserID,
+			}))
+			err = app.models.Tokens.DeleteFamily(r.Context(), token.Family)
+			if err != nil {
+				app.serverErrorResponse(w, r, err)
+				return
+			}
+			app.audit(r, data.AuditEvent{
+				ActorID:    &token.UserID,
+				Action:     data.AuditTokenRefresh,
+				Outcome:    data.AuditFailure,
+				TargetType: "user",
+				TargetID:   strconv.FormatInt(token.UserID, 10),
+				Details:    map[string]interface{}{"reason": "refresh_token_reuse", "revoked_family": token.Family},
+			})
+			v.AddError("refresh_token", "invalid or expired refresh token")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	user, err := app.models.Users.Get(r.Context(), token.UserID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("refresh_token", "invalid or expired refresh token")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	app.audit(r, data.AuditEvent{
+		ActorID:    &user.ID,
+		Action:     data.AuditTokenRefresh,
+		Outcome:    data.AuditSuccess,
+		TargetType: "user",
+		TargetID:   strconv.FormatInt(user.ID, 10),
+	})
+	app.issueTokenPair(w, r, user, token.Family)
+}
+
+// Revoke a refresh token, and with it every token of its family. Access tokens are not
+// stored anywhere, so they stay valid until they expire.
+func (app *application) deleteRefreshTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	if data.ValidateTokenPlaintext(v, input.RefreshToken); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	token, err := app.models.Tokens.GetRefresh(r.Context(), input.RefreshToken)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("refresh_token", "invalid or expired refresh token")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.models.Tokens.DeleteFamily(r.Context(), token.Family)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.audit(r, data.AuditEvent{
+		ActorID:    &token.UserID,
+		Action:     data.AuditLogout,
+		Outcome:    data.AuditSuccess,
+		TargetType: "user",
+		TargetID:   strconv.FormatInt(token.UserID, 10),
+	})
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "you have been logged out"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Revoke the authentication token that was used to make this request.
+func (app *application) deleteAuthenticationTokenHandler(w http.ResponseWriter, r *http.Request) {
+	token := app.contextGetToken(r)
+	if token == "" {
+		app.badRequestResponse(w, r, errors.New("the request was not made with an authentication token"))
+		return
+	}
+
+	err := app.models.Tokens.DeleteForPlaintext(r.Context(), data.ScopeAuthentication, token)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	user := app.contextGetUser(r)
+	app.audit(r, data.AuditEvent{
+		Action:     data.AuditLogout,
+		Outcome:    data.AuditSuccess,
+		TargetType: "user",
+		TargetID:   strconv.FormatInt(user.ID, 10),
+	})
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "you have been logged out"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
 }
 
 func (app *application) createActivationTokenHandler(w http.ResponseWriter, r *http.Request) {
@@ -87,7 +392,7 @@ func (app *application) createActivationTokenHandler(w http.ResponseWriter, r *h
 		return
 	}
 
-	user, err := app.models.Users.GetByEmail(input.Email)
+	user, err := app.models.Users.GetByEmail(r.Context(), input.Email)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
@@ -104,7 +409,7 @@ func (app *application) createActivationTokenHandler(w http.ResponseWriter, r *h
 		return
 	}
 
-	token, err := app.models.Tokens.New(user.ID, 3*24*time.Hour, data.ScopeActivation)
+	token, err := app.models.Tokens.New(r.Context(), user.ID, 3*24*time.Hour, data.ScopeActivation)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
@@ -114,9 +419,9 @@ func (app *application) createActivationTokenHandler(w http.ResponseWriter, r *h
 		data := map[string]interface{}{
 			"activationToken": token.Plaintext,
 		}
-		err = app.mailer.Send(user.Email, "token_activation.tmpl", data)
+		err = app.mailer.Send(backgroundContext(r), user.Email, "token_activation.tmpl", data)
 		if err != nil {
-			app.logger.PrintError(err, nil)
+			app.logger.PrintError(err, app.logProperties(r, nil))
 		}
 	})
 
@@ -146,7 +451,7 @@ func (app *application) createPasswordResetTokenHandler(w http.ResponseWriter, r
 	}
 
 	// Retrieve user from DB
-	user, err := app.models.Users.GetByEmail(input.Email)
+	user, err := app.models.Users.GetByEmail(r.Context(), input.Email)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
@@ -164,21 +469,29 @@ func (app *application) createPasswordResetTokenHandler(w http.ResponseWriter, r
 		return
 	}
 
-	token, err := app.models.Tokens.New(user.ID, 45*time.Minute, data.ScopePasswordReset)
+	token, err := app.models.Tokens.New(r.Context(), user.ID, 45*time.Minute, data.ScopePasswordReset)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
 
+	app.audit(r, data.AuditEvent{
+		ActorID:    &user.ID,
+		Action:     data.AuditPasswordResetStart,
+		Outcome:    data.AuditSuccess,
+		TargetType: "user",
+		TargetID:   strconv.FormatInt(user.ID, 10),
+	})
+
 	// email user
 	app.background(func() {
 		data := map[string]interface{}{
 			"passwordResetToken": token.Plaintext,
 		}
 
-		err := app.mailer.Send(user.Email, "token_password_reset.tmpl", data)
+		err := app.mailer.Send(backgroundContext(r), user.Email, "token_password_reset.tmpl", data)
 		if err != nil {
-			app.logger.PrintError(err, nil)
+			app.logger.PrintError(err, app.logProperties(r, nil))
 		}
 	})
 
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestDeleteAuthenticationTokenHandler(t *testing.T) {
+	tests := []struct {
+		name       string
+		mode       string
+		wantStatus int
+		// wantRevoked is whether the token is rejected afterwards.
+		wantRevoked bool
+	}{
+		{"opaque tokens", authModeToken, http.StatusOK, true},
+		// In JWT mode logging out goes through DELETE /v1/tokens/refresh.
+		{"signed access tokens", authModeJWT, http.StatusMethodNotAllowed, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app, _ := newTestApplication(t)
+			app.config.auth.mode = tt.mode
+			handler := app.routes()
+			token := newTestToken(t, app.models, "alice@example.com", "viewer")
+
+			r := httptest.NewRequest(http.MethodDelete, "/v1/tokens/authentication", nil)
+			r.Header.Set("Authorization", "Bearer "+token)
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("got status %d; want %d (%s)", w.Code, tt.wantStatus, w.Body)
+			}
+
+			r = httptest.NewRequest(http.MethodGet, "/v1/movies", nil)
+			r.Header.Set("Authorization", "Bearer "+token)
+			w = httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			if revoked := w.Code == http.StatusUnauthorized; revoked != tt.wantRevoked {
+				t.Errorf("got status %d using the token afterwards; want revoked %t", w.Code, tt.wantRevoked)
+			}
+		})
+	}
+}
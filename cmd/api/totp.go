@@ -0,0 +1,366 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/henrtytanoh/greenlight/internal/data"
+	"github.com/henrtytanoh/greenlight/internal/totp"
+	"github.com/henrtytanoh/greenlight/internal/validator"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	// Lifetime of the token returned by a successful password check when the user
+	// has enabled two-factor authentication.
+	mfaTokenTTL = 5 * time.Minute
+	// Number of wrong codes accepted for a user within mfaTokenTTL. Past it their
+	// pending mfa tokens are revoked, and no code is accepted until the count expires,
+	// even with the mfa token of a new login.
+	mfaMaxAttempts = 5
+)
+
+// Start enrolling the user in two-factor authentication. The returned secret is not
+// used at login until it has been confirmed with a valid code.
+func (app *application) enrollTOTPHandler(w http.ResponseWriter, r *http.Request) {
+	// The user in the context only carries an ID when authenticated with a signed
+	// access token, so fetch the full record for the email address.
+	user, err := app.models.Users.Get(r.Context(), app.contextGetUser(r).ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	enrollment := &data.TOTP{UserID: user.ID, Secret: secret}
+	err = app.models.TOTP.Upsert(r.Context(), enrollment)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			v := validator.New()
+			v.AddError("totp", "two-factor authentication is already enabled")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	recoveryCodes, err := app.models.TOTP.NewRecoveryCodes(r.Context(), user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	env := envelope{"totp": map[string]interface{}{
+		"secret":         totp.EncodeSecret(secret),
+		"uri":            totp.URI(app.config.auth.totpIssuer, user.Email, secret),
+		"recovery_codes": recoveryCodes,
+	}}
+	err = app.writeJSON(w, http.StatusCreated, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Confirm the enrollment with a code from the authenticator app.
+func (app *application) confirmTOTPHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Code string `json:"code"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	if data.ValidateTOTPCode(v, input.Code); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	enrollment, err := app.models.TOTP.Get(r.Context(), user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("totp", "two-factor authentication enrollment has not been started")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if enrollment.Confirmed {
+		v.AddError("totp", "two-factor authentication is already enabled")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	counter, ok := totp.Validate(enrollment.Secret, input.Code, time.Now(), 1)
+	if !ok {
+		v.AddError("code", "invalid one-time code")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.TOTP.Confirm(r.Context(), user.ID, counter)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.audit(r, data.AuditEvent{
+		Action:     data.AuditMFAEnable,
+		Outcome:    data.AuditSuccess,
+		TargetType: "user",
+		TargetID:   strconv.FormatInt(user.ID, 10),
+	})
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "two-factor authentication enabled"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Disable two-factor authentication. A valid code or recovery code is required so that
+// a stolen session alone cannot be used to remove the second factor.
+func (app *application) deleteTOTPHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Code         string `json:"code"`
+		RecoveryCode string `json:"recovery_code"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	if input.RecoveryCode == "" {
+		data.ValidateTOTPCode(v, input.Code)
+	}
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	enrollment, err := app.models.TOTP.Get(r.Context(), user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	ok, err := app.verifySecondFactor(r.Context(), enrollment, input.Code, input.RecoveryCode)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if !ok {
+		v.AddError("code", "invalid one-time code or recovery code")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.TOTP.Delete(r.Context(), user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.audit(r, data.AuditEvent{
+		Action:     data.AuditMFADisable,
+		Outcome:    data.AuditSuccess,
+		TargetType: "user",
+		TargetID:   strconv.FormatInt(user.ID, 10),
+	})
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "two-factor authentication disabled"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Exchange an mfa token and a one-time code (or a recovery code) for the real
+// authentication token.
+func (app *application) createAuthenticationTokenFromMFAHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		MFAToken     string `json:"mfa_token"`
+		Code         string `json:"code"`
+		RecoveryCode string `json:"recovery_code"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	data.ValidateTokenPlaintext(v, input.MFAToken)
+	if input.RecoveryCode == "" {
+		data.ValidateTOTPCode(v, input.Code)
+	}
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user, err := app.models.Users.GetForToken(r.Context(), data.ScopeMFA, input.MFAToken)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.invalidCredentialsResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	enrollment, err := app.models.TOTP.Get(r.Context(), user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.invalidCredentialsResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// Wrong codes count towards the login lockout, so an account locked meanwhile
+	// can't keep guessing with an mfa token it already holds.
+	retryAfter, err := app.loginRetryAfter(r.Context(), user.Email, app.clientIP(r))
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if retryAfter > 0 {
+		app.auditLoginFailure(r, user, user.Email, "locked")
+		app.loginLockedResponse(w, r, retryAfter)
+		return
+	}
+
+	attempts, err := app.failedMFAAttempts(r.Context(), user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	ok := false
+	if attempts < mfaMaxAttempts {
+		ok, err = app.verifySecondFactor(r.Context(), enrollment, input.Code, input.RecoveryCode)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+	if !ok {
+		err = app.recordFailedMFAAttempt(r, user)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		app.auditLoginFailure(r, user, user.Email, "invalid_mfa_code")
+		app.invalidCredentialsResponse(w, r)
+		return
+	}
+
+	err = app.models.Tokens.DeleteAllForUser(r.Context(), data.ScopeMFA, user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.resetLoginFailures(r.Context(), user.Email)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.issueAuthenticationTokens(w, r, user, "mfa")
+}
+
+// verifySecondFactor() checks a one-time code, or a recovery code when one is given.
+// Accepted codes are consumed so that they cannot be used twice.
+func (app *application) verifySecondFactor(ctx context.Context, enrollment *data.TOTP, code, recoveryCode string) (bool, error) {
+	if recoveryCode != "" {
+		err := app.models.TOTP.UseRecoveryCode(ctx, enrollment.UserID, recoveryCode)
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			return false, nil
+		case err != nil:
+			return false, err
+		}
+		return true, nil
+	}
+
+	counter, ok := totp.Validate(enrollment.Secret, code, time.Now(), 1)
+	if !ok {
+		return false, nil
+	}
+
+	err := app.models.TOTP.UseCounter(ctx, enrollment.UserID, counter)
+	switch {
+	case errors.Is(err, data.ErrEditConflict):
+		return false, nil
+	case err != nil:
+		return false, err
+	}
+	return true, nil
+}
+
+func mfaAttemptsKey(userID int64) string {
+	return "mfa:attempts:" + strconv.FormatInt(userID, 10)
+}
+
+// failedMFAAttempts() returns the number of wrong codes entered for the user within
+// mfaTokenTTL.
+func (app *application) failedMFAAttempts(ctx context.Context, userID int64) (int64, error) {
+	attempts, err := app.redisClient.Get(ctx, mfaAttemptsKey(userID)).Int64()
+	if errors.Is(err, redis.Nil) {
+		return 0, nil
+	}
+	return attempts, err
+}
+
+// recordFailedMFAAttempt() counts a wrong code as a failed login of the account, and
+// in redis against the user. A 6 digit code can be guessed given enough attempts, so
+// once the limit is reached the pending mfa tokens of the user are revoked. The count
+// is left to expire rather than cleared, so that logging in again with the password
+// doesn't buy more guesses.
+func (app *application) recordFailedMFAAttempt(r *http.Request, user *data.User) error {
+	err := app.recordLoginFailure(r, user.Email, user)
+	if err != nil {
+		return err
+	}
+
+	ctx := r.Context()
+	attempts, err := incrementFailures.Run(ctx, app.redisClient, []string{mfaAttemptsKey(user.ID)}, mfaTokenTTL.Milliseconds()).Int64()
+	if err != nil {
+		return err
+	}
+	if attempts >= mfaMaxAttempts {
+		return app.models.Tokens.DeleteAllForUser(ctx, data.ScopeMFA, user.ID)
+	}
+	return nil
+}
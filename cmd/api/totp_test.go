@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/henrtytanoh/greenlight/internal/data"
+	"github.com/henrtytanoh/greenlight/internal/mailer"
+	"github.com/henrtytanoh/greenlight/internal/totp"
+	"github.com/redis/go-redis/v9"
+)
+
+func TestMFABruteForceLocksAccount(t *testing.T) {
+	app, _ := newTestApplication(t)
+	ctx := context.Background()
+
+	mr := miniredis.RunT(t)
+	app.redisClient = redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { app.redisClient.Close() })
+	// Nothing listens on the port; the lockout email fails in the background.
+	app.mailer = mailer.New("127.0.0.1", 1, "", "", "Greenlight <no-reply@example.com>")
+	app.config.login.failureWindow = 15 * time.Minute
+	app.config.login.delayThreshold = 100
+	app.config.login.lockoutThreshold = 4
+	app.config.login.lockoutDuration = 30 * time.Minute
+	app.config.login.ipLockoutThreshold = 100
+	handler := app.routes()
+
+	user := &data.User{Name: "Alice", Email: "alice@example.com", Activated: true}
+	err := user.Password.Set("tulip-orbit-castle")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = app.models.Users.Insert(ctx, user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret := []byte("12345678901234567890")
+	err = app.models.TOTP.Upsert(ctx, &data.TOTP{UserID: user.ID, Secret: secret})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = app.models.TOTP.Confirm(ctx, user.ID, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	valid := totp.Code(secret, totp.Counter(time.Now()))
+	n, err := strconv.Atoi(valid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wrong := fmt.Sprintf("%06d", (n+1)%1000000)
+
+	send := func(path, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+	mfa := func(token, code string) *httptest.ResponseRecorder {
+		return send("/v1/tokens/mfa", fmt.Sprintf(`{"mfa_token": %q, "code": %q}`, token, code))
+	}
+
+	// Every cycle enters the right password and a wrong code. Before the lockout the
+	// password keeps being accepted, but the failures of the codes add up.
+	var mfaToken string
+	for i := 1; i <= app.config.login.lockoutThreshold; i++ {
+		w := send("/v1/tokens/authentication", `{"email": "alice@example.com", "password": "tulip-orbit-castle"}`)
+		if w.Code != http.StatusAccepted {
+			t.Fatalf("login %d: got status %d; want 202 (%s)", i, w.Code, w.Body)
+		}
+		var body struct {
+			MFAToken data.Token `json:"mfa_token"`
+		}
+		err := json.NewDecoder(w.Body).Decode(&body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		mfaToken = body.MFAToken.Plaintext
+
+		w = mfa(mfaToken, wrong)
+		if w.Code != http.StatusUnauthorized {
+			t.Fatalf("code %d: got status %d; want 401 (%s)", i, w.Code, w.Body)
+		}
+	}
+
+	w := send("/v1/tokens/authentication", `{"email": "alice@example.com", "password": "tulip-orbit-castle"}`)
+	if w.Code != http.StatusTooManyRequests {
+		t.Errorf("got status %d logging in after %d wrong codes; want 429", w.Code, app.config.login.lockoutThreshold)
+	}
+	// An mfa token obtained before the lockout doesn't get around it either.
+	w = mfa(mfaToken, valid)
+	if w.Code != http.StatusTooManyRequests {
+		t.Errorf("got status %d entering the right code while locked; want 429", w.Code)
+	}
+}
+
+func TestFailedMFAAttemptsExpire(t *testing.T) {
+	app, _ := newTestApplication(t)
+	ctx := context.Background()
+
+	mr := miniredis.RunT(t)
+	app.redisClient = redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { app.redisClient.Close() })
+	app.config.login.failureWindow = 15 * time.Minute
+	app.config.login.delayThreshold = 100
+	app.config.login.lockoutThreshold = 100
+	app.config.login.ipLockoutThreshold = 100
+
+	user := &data.User{Name: "Alice", Email: "alice@example.com", Activated: true}
+	err := app.models.Users.Insert(ctx, user)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := httptest.NewRequest(http.MethodPost, "/v1/tokens/mfa", nil)
+	for i := 0; i < mfaMaxAttempts; i++ {
+		err = app.recordFailedMFAAttempt(r, user)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Once the limit is reached the count stays, rather than starting over with the
+	// next login, until it expires.
+	attempts, err := app.failedMFAAttempts(ctx, user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if attempts != mfaMaxAttempts {
+		t.Errorf("got %d attempts; want %d", attempts, mfaMaxAttempts)
+	}
+	mr.FastForward(mfaTokenTTL)
+	attempts, err = app.failedMFAAttempts(ctx, user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if attempts != 0 {
+		t.Errorf("got %d attempts after %s; want 0", attempts, mfaTokenTTL)
+	}
+}
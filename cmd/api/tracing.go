@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.21.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var tracer = otel.Tracer("github.com/henrtytanoh/greenlight/cmd/api")
+
+// setupTracing() installs the global tracer provider, which exports spans over OTLP/HTTP
+// to the collector at -otel-endpoint, and the W3C trace context propagator. Without an
+// endpoint no spans are recorded, but incoming traceparent headers are still passed on.
+// The returned function flushes the spans which haven't been exported yet.
+func setupTracing(cfg config) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	if cfg.otel.endpoint == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	opts := []otlptracehttp.Option{otlptracehttp.WithEndpoint(cfg.otel.endpoint)}
+	if cfg.otel.insecure {
+		opts = append(opts, otlptracehttp.WithInsecure())
+	}
+	exporter, err := otlptracehttp.New(context.Background(), opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(semconv.SchemaURL,
+		semconv.ServiceName(cfg.otel.serviceName),
+		semconv.ServiceVersion(version),
+		semconv.DeploymentEnvironment(cfg.env),
+	))
+	if err != nil {
+		return nil, err
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		// Follow the caller's sampling decision, so that traces spanning several
+		// services are either complete or absent.
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(cfg.otel.sampleRatio))),
+	)
+	otel.SetTracerProvider(provider)
+	return provider.Shutdown, nil
+}
+
+// backgroundContext() returns a context for work which outlives the request, such as
+// sending emails: it isn't canceled with the request, but its spans still belong to the
+// request's trace.
+func backgroundContext(r *http.Request) context.Context {
+	return trace.ContextWithSpanContext(context.Background(), trace.SpanContextFromContext(r.Context()))
+}
+
+// shutdownTracing() flushes the remaining spans before the process exits.
+func shutdownTracing(shutdown func(context.Context) error) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return shutdown(ctx)
+}
@@ -27,7 +27,7 @@ headers: {
 },
 body: JSON.stringify({
 email: 'alice@example.com',
-password: 'pa55word'
+password: 'tulip-orbit-castle'
 })
 }).then(
 function (response) {
@@ -0,0 +1,113 @@
+// A stand-in for a Sentry compatible error tracker, to see locally what the API reports.
+// Start it and point the API at it:
+//
+//	go run ./cmd/examples/error-sink
+//	go run ./cmd/api -error-tracker-dsn http://development@localhost:9003/1
+//
+// Each event received is printed on one line, and the latest ones are listed as JSON by
+// GET http://localhost:9003/events.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// The number of events kept for GET /events.
+const keptEvents = 100
+
+type event struct {
+	EventID     string            `json:"event_id"`
+	Timestamp   string            `json:"timestamp"`
+	Transaction string            `json:"transaction"`
+	Tags        map[string]string `json:"tags"`
+	Exception   struct {
+		Values []struct {
+			Type  string `json:"type"`
+			Value string `json:"value"`
+		} `json:"values"`
+	} `json:"exception"`
+	Request struct {
+		Method string `json:"method"`
+		URL    string `json:"url"`
+	} `json:"request"`
+	User  map[string]string      `json:"user,omitempty"`
+	Extra map[string]interface{} `json:"extra,omitempty"`
+}
+
+type sink struct {
+	key string
+
+	mu     sync.Mutex
+	events []json.RawMessage
+}
+
+func main() {
+	addr := flag.String("addr", ":9003", "Server address")
+	key := flag.String("key", "development", "Public key of the DSN events must be sent with")
+	flag.Parse()
+
+	s := &sink{key: *key}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/", s.store)
+	mux.HandleFunc("/events", s.list)
+
+	log.Printf("error sink listening on %s", *addr)
+	log.Fatal(http.ListenAndServe(*addr, mux))
+}
+
+// store() receives an event sent to /api/<project>/store/.
+func (s *sink) store(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost || !strings.HasSuffix(r.URL.Path, "/store/") {
+		http.NotFound(w, r)
+		return
+	}
+	if !strings.Contains(r.Header.Get("X-Sentry-Auth"), "sentry_key="+s.key) {
+		http.Error(w, "invalid sentry_key", http.StatusUnauthorized)
+		return
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var e event
+	err = json.Unmarshal(body, &e)
+	if err != nil || len(e.Exception.Values) == 0 {
+		http.Error(w, "invalid event", http.StatusBadRequest)
+		return
+	}
+
+	s.mu.Lock()
+	s.events = append(s.events, body)
+	if len(s.events) > keptEvents {
+		s.events = s.events[1:]
+	}
+	s.mu.Unlock()
+
+	log.Printf("%s [%s] %s %s: %s (request %s)", e.Timestamp, e.Tags["class"], e.Request.Method,
+		e.Transaction, e.Exception.Values[0].Value, e.Tags["request_id"])
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"id": e.EventID})
+}
+
+// list() returns the latest events, newest first.
+func (s *sink) list(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	events := make([]json.RawMessage, 0, len(s.events))
+	for i := len(s.events) - 1; i >= 0; i-- {
+		events = append(events, s.events[i])
+	}
+	s.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(events)
+}
@@ -0,0 +1,205 @@
+// A stand-in checkout page for the API's fake payment provider. Visiting a checkout URL
+// returned by POST /v1/users/me/subscription completes the checkout at once, without
+// charging anything, and sends the API the signed webhook event a real provider would.
+//
+// Later events in a subscription's life are sent on request:
+//
+//	curl -X POST 'http://localhost:9002/renew?reference=1'
+//	curl -X POST 'http://localhost:9002/fail?reference=1'
+//	curl -X POST 'http://localhost:9002/cancel?reference=1'
+//
+// where the reference is the ID of the subscription in the API.
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/henrtytanoh/greenlight/internal/payments"
+)
+
+// subscription is what the stand-in provider knows about a completed checkout.
+type subscription struct {
+	id         string
+	periodDays int
+	periodEnd  time.Time
+}
+
+type provider struct {
+	webhookURL string
+	secret     []byte
+	client     *http.Client
+
+	mu            sync.Mutex
+	subscriptions map[string]*subscription
+}
+
+func main() {
+	addr := flag.String("addr", ":9002", "Server address")
+	webhookURL := flag.String("webhook-url", "http://localhost:4000/v1/webhooks/payments", "URL events are sent to")
+	secret := flag.String("secret", "whsec_development", "Secret webhook requests are signed with")
+	flag.Parse()
+
+	p := &provider{
+		webhookURL:    *webhookURL,
+		secret:        []byte(*secret),
+		client:        &http.Client{Timeout: 10 * time.Second},
+		subscriptions: make(map[string]*subscription),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/checkout/", p.checkout)
+	mux.HandleFunc("/renew", post(p.renew))
+	mux.HandleFunc("/fail", post(p.fail))
+	mux.HandleFunc("/cancel", post(p.cancel))
+
+	log.Printf("starting stand-in payment provider on %s", *addr)
+	log.Fatal(http.ListenAndServe(*addr, mux))
+}
+
+func post(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		next(w, r)
+	}
+}
+
+func (p *provider) checkout(w http.ResponseWriter, r *http.Request) {
+	qs := r.URL.Query()
+	reference := qs.Get("reference")
+	periodDays, err := strconv.Atoi(qs.Get("period_days"))
+	if reference == "" || err != nil {
+		http.Error(w, "invalid checkout URL", http.StatusBadRequest)
+		return
+	}
+	trialDays, _ := strconv.Atoi(qs.Get("trial_days"))
+
+	id, err := randomID("sub_fake_")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// The API decides whether the user gets the trial; the first period ends after the
+	// trial either way, and the renewal event settles it.
+	days := periodDays
+	if trialDays > 0 {
+		days = trialDays
+	}
+	sub := &subscription{id: id, periodDays: periodDays, periodEnd: time.Now().AddDate(0, 0, days)}
+
+	p.mu.Lock()
+	p.subscriptions[reference] = sub
+	p.mu.Unlock()
+
+	p.send(w, payments.EventCheckoutCompleted, reference, sub, false)
+}
+
+func (p *provider) renew(w http.ResponseWriter, r *http.Request) {
+	reference := r.URL.Query().Get("reference")
+	sub, ok := p.lookup(w, reference)
+	if !ok {
+		return
+	}
+
+	p.mu.Lock()
+	sub.periodEnd = sub.periodEnd.AddDate(0, 0, sub.periodDays)
+	p.mu.Unlock()
+
+	p.send(w, payments.EventInvoicePaid, reference, sub, true)
+}
+
+func (p *provider) fail(w http.ResponseWriter, r *http.Request) {
+	reference := r.URL.Query().Get("reference")
+	sub, ok := p.lookup(w, reference)
+	if !ok {
+		return
+	}
+	p.send(w, payments.EventPaymentFailed, reference, sub, false)
+}
+
+func (p *provider) cancel(w http.ResponseWriter, r *http.Request) {
+	reference := r.URL.Query().Get("reference")
+	sub, ok := p.lookup(w, reference)
+	if !ok {
+		return
+	}
+
+	p.mu.Lock()
+	delete(p.subscriptions, reference)
+	p.mu.Unlock()
+
+	p.send(w, payments.EventSubscriptionCanceled, reference, sub, false)
+}
+
+func (p *provider) lookup(w http.ResponseWriter, reference string) (*subscription, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	sub, ok := p.subscriptions[reference]
+	if !ok {
+		http.Error(w, "no completed checkout with this reference", http.StatusNotFound)
+	}
+	return sub, ok
+}
+
+// send() delivers a signed event to the API and reports the API's response.
+func (p *provider) send(w http.ResponseWriter, eventType, reference string, sub *subscription, withPeriodEnd bool) {
+	id, err := randomID("evt_fake_")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	event := payments.FakeEvent{ID: id, Type: eventType, Created: time.Now().Unix()}
+	event.Data.Reference = reference
+	event.Data.SubscriptionID = sub.id
+	if withPeriodEnd {
+		event.Data.PeriodEnd = sub.periodEnd.Unix()
+	}
+	payload, err := json.Marshal(event)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	req, err := http.NewRequest(http.MethodPost, p.webhookURL, bytes.NewReader(payload))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(payments.SignatureHeader, payments.SignFake(p.secret, payload, time.Now()))
+
+	res, err := p.client.Do(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer res.Body.Close()
+	body, _ := io.ReadAll(res.Body)
+
+	log.Printf("sent %s %s for subscription %s: %s", eventType, id, reference, res.Status)
+	fmt.Fprintf(w, "sent %s for subscription %s, the API answered %s\n%s", eventType, reference, res.Status, body)
+}
+
+func randomID(prefix string) (string, error) {
+	b := make([]byte, 12)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return prefix + hex.EncodeToString(b), nil
+}
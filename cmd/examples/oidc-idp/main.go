@@ -0,0 +1,260 @@
+// A stand-in OpenID Connect provider for trying out and testing OIDC login locally. It
+// approves every authorization request straight away, as the user given by the
+// login_hint parameter or the -email flag, and issues RS256 signed ID tokens.
+//
+// Point the API at it with an -oidc-providers file such as:
+//
+//	[{"name": "local", "issuer": "http://localhost:9001", "client_id": "greenlight",
+//	  "client_secret": "secret", "redirect_url": "http://localhost:4000/v1/oidc/local/callback"}]
+//
+// and run: curl -L http://localhost:4000/v1/oidc/local/login
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"log"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/henrtytanoh/greenlight/internal/jwt"
+	"github.com/henrtytanoh/greenlight/internal/oidc"
+)
+
+const keyID = "stand-in"
+
+type idTokenClaims struct {
+	jwt.Claims
+	Nonce         string `json:"nonce,omitempty"`
+	Email         string `json:"email"`
+	EmailVerified bool   `json:"email_verified"`
+	Name          string `json:"name,omitempty"`
+}
+
+// authorization is an issued authorization code waiting to be redeemed.
+type authorization struct {
+	redirectURI   string
+	codeChallenge string
+	nonce         string
+	email         string
+	name          string
+	expiry        time.Time
+}
+
+type provider struct {
+	issuer       string
+	clientID     string
+	clientSecret string
+	email        string
+	name         string
+	key          *rsa.PrivateKey
+
+	mu    sync.Mutex
+	codes map[string]authorization
+}
+
+func main() {
+	addr := flag.String("addr", ":9001", "Server address")
+	issuer := flag.String("issuer", "http://localhost:9001", "Issuer URL, as seen by the API")
+	clientID := flag.String("client-id", "greenlight", "The only client allowed to log in")
+	clientSecret := flag.String("client-secret", "secret", "Secret of the client")
+	email := flag.String("email", "alice@example.com", "Email of the user logging in, unless a login_hint is given")
+	name := flag.String("name", "Alice Smith", "Name of the user logging in")
+	flag.Parse()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	p := &provider{
+		issuer:       *issuer,
+		clientID:     *clientID,
+		clientSecret: *clientSecret,
+		email:        *email,
+		name:         *name,
+		key:          key,
+		codes:        make(map[string]authorization),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", p.discovery)
+	mux.HandleFunc("/jwks", p.jwks)
+	mux.HandleFunc("/authorize", p.authorize)
+	mux.HandleFunc("/token", p.token)
+
+	log.Printf("starting stand-in identity provider %s on %s", *issuer, *addr)
+	log.Fatal(http.ListenAndServe(*addr, mux))
+}
+
+func (p *provider) discovery(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"issuer":                                p.issuer,
+		"authorization_endpoint":                p.issuer + "/authorize",
+		"token_endpoint":                        p.issuer + "/token",
+		"jwks_uri":                              p.issuer + "/jwks",
+		"response_types_supported":              []string{"code"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{jwt.AlgRS256},
+		"code_challenge_methods_supported":      []string{"S256"},
+	})
+}
+
+func (p *provider) jwks(w http.ResponseWriter, r *http.Request) {
+	jwk, err := jwt.NewJWK(keyID, &p.key.PublicKey)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, jwt.JWKS{Keys: []jwt.JWK{jwk}})
+}
+
+func (p *provider) authorize(w http.ResponseWriter, r *http.Request) {
+	qs := r.URL.Query()
+	redirectURI := qs.Get("redirect_uri")
+	switch {
+	case qs.Get("client_id") != p.clientID:
+		http.Error(w, "unknown client_id", http.StatusBadRequest)
+		return
+	case redirectURI == "":
+		http.Error(w, "missing redirect_uri", http.StatusBadRequest)
+		return
+	}
+
+	target, err := url.Parse(redirectURI)
+	if err != nil {
+		http.Error(w, "invalid redirect_uri", http.StatusBadRequest)
+		return
+	}
+	params := target.Query()
+	params.Set("state", qs.Get("state"))
+
+	if qs.Get("response_type") != "code" || qs.Get("code_challenge_method") != "S256" || qs.Get("code_challenge") == "" {
+		params.Set("error", "invalid_request")
+		params.Set("error_description", "the code flow with an S256 code challenge is required")
+		target.RawQuery = params.Encode()
+		http.Redirect(w, r, target.String(), http.StatusFound)
+		return
+	}
+
+	email := qs.Get("login_hint")
+	if email == "" {
+		email = p.email
+	}
+
+	code, err := oidc.RandomString()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	p.mu.Lock()
+	p.codes[code] = authorization{
+		redirectURI:   redirectURI,
+		codeChallenge: qs.Get("code_challenge"),
+		nonce:         qs.Get("nonce"),
+		email:         email,
+		name:          p.name,
+		expiry:        time.Now().Add(time.Minute),
+	}
+	p.mu.Unlock()
+
+	log.Printf("approved login of %s", email)
+	params.Set("code", code)
+	target.RawQuery = params.Encode()
+	http.Redirect(w, r, target.String(), http.StatusFound)
+}
+
+func (p *provider) token(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	clientID, clientSecret, ok := r.BasicAuth()
+	if ok {
+		clientID, _ = url.QueryUnescape(clientID)
+		clientSecret, _ = url.QueryUnescape(clientSecret)
+	} else {
+		clientID, clientSecret = r.PostFormValue("client_id"), r.PostFormValue("client_secret")
+	}
+	if clientID != p.clientID || subtle.ConstantTimeCompare([]byte(clientSecret), []byte(p.clientSecret)) != 1 {
+		tokenError(w, http.StatusUnauthorized, "invalid_client")
+		return
+	}
+	if r.PostFormValue("grant_type") != "authorization_code" {
+		tokenError(w, http.StatusBadRequest, "unsupported_grant_type")
+		return
+	}
+
+	code := r.PostFormValue("code")
+	p.mu.Lock()
+	auth, exists := p.codes[code]
+	delete(p.codes, code)
+	p.mu.Unlock()
+
+	switch {
+	case !exists || time.Now().After(auth.expiry):
+		tokenError(w, http.StatusBadRequest, "invalid_grant")
+		return
+	case r.PostFormValue("redirect_uri") != auth.redirectURI:
+		tokenError(w, http.StatusBadRequest, "invalid_grant")
+		return
+	case oidc.CodeChallenge(r.PostFormValue("code_verifier")) != auth.codeChallenge:
+		tokenError(w, http.StatusBadRequest, "invalid_grant")
+		return
+	}
+
+	// Derive a stable subject from the email address, so that logging in twice as the
+	// same user yields the same identity.
+	sum := sha256.Sum256([]byte(auth.email))
+	now := time.Now()
+	claims := idTokenClaims{
+		Claims: jwt.Claims{
+			Issuer:    p.issuer,
+			Subject:   hex.EncodeToString(sum[:8]),
+			Audience:  jwt.Audience{p.clientID},
+			IssuedAt:  now.Unix(),
+			ExpiresAt: now.Add(5 * time.Minute).Unix(),
+		},
+		Nonce:         auth.nonce,
+		Email:         auth.email,
+		EmailVerified: true,
+		Name:          auth.name,
+	}
+	idToken, err := jwt.Sign(claims, keyID, p.key)
+	if err != nil {
+		tokenError(w, http.StatusInternalServerError, "server_error")
+		return
+	}
+	accessToken, err := oidc.RandomString()
+	if err != nil {
+		tokenError(w, http.StatusInternalServerError, "server_error")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"access_token": accessToken,
+		"token_type":   "Bearer",
+		"expires_in":   300,
+		"id_token":     idToken,
+	})
+}
+
+func tokenError(w http.ResponseWriter, status int, code string) {
+	writeJSON(w, status, map[string]string{"error": code})
+}
+
+func writeJSON(w http.ResponseWriter, status int, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(data)
+}
@@ -0,0 +1,214 @@
+package data
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base32"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/henrtytanoh/greenlight/internal/validator"
+	"github.com/lib/pq"
+)
+
+// Every API key starts with this prefix, which makes keys easy to recognise in
+// configuration files and secret scanners.
+const apiKeyPrefix = "glk_"
+
+// APIKey is a long-lived, named credential for machine clients. Like a Token, only the
+// SHA-256 hash of the key is stored; the plaintext is shown once, at creation.
+type APIKey struct {
+	ID          int64       `json:"id"`
+	Plaintext   string      `json:"key,omitempty"`
+	Hash        []byte      `json:"-"`
+	UserID      int64       `json:"-"`
+	Name        string      `json:"name"`
+	Permissions Permissions `json:"permissions"`
+	CreatedAt   time.Time   `json:"created_at"`
+	Expiry      *time.Time  `json:"expiry,omitempty"`
+	LastUsedAt  *time.Time  `json:"last_used_at,omitempty"`
+}
+
+func generateAPIKey(userID int64, name string, permissions Permissions, expiry *time.Time) (*APIKey, error) {
+	key := &APIKey{
+		UserID:      userID,
+		Name:        name,
+		Permissions: permissions,
+		Expiry:      expiry,
+	}
+	randomBytes := make([]byte, 20)
+	_, err := rand.Read(randomBytes)
+	if err != nil {
+		return nil, err
+	}
+	key.Plaintext = apiKeyPrefix + base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(randomBytes)
+	hash := sha256.Sum256([]byte(key.Plaintext))
+	key.Hash = hash[:]
+	return key, nil
+}
+
+// ValidateAPIKey checks the user supplied fields of a new key. The permissions of the
+// key must be a subset of the permissions that its owner currently holds.
+func ValidateAPIKey(v *validator.Validator, key *APIKey, owner Permissions) {
+	v.Check(key.Name != "", "name", "must be provided")
+	v.Check(len(key.Name) <= 100, "name", "must not be more than 100 bytes long")
+	v.Check(len(key.Permissions) >= 1, "permissions", "must contain at least 1 permission")
+	v.Check(validator.Unique(key.Permissions), "permissions", "must not contain duplicate values")
+	for _, code := range key.Permissions {
+		v.Check(owner.Include(code), "permissions", "must be a subset of your own permissions")
+	}
+	if key.Expiry != nil {
+		v.Check(key.Expiry.After(time.Now()), "expiry", "must be in the future")
+	}
+}
+
+// Check that the plaintext key has the expected prefix and is exactly 36 bytes long.
+func ValidateAPIKeyPlaintext(v *validator.Validator, keyPlaintext string) {
+	v.Check(keyPlaintext != "", "key", "must be provided")
+	v.Check(strings.HasPrefix(keyPlaintext, apiKeyPrefix), "key", "must be a greenlight API key")
+	v.Check(len(keyPlaintext) == 36, "key", "must be 36 bytes long")
+}
+
+// Define the APIKeyModel type.
+type APIKeyModel struct {
+	DB      *sql.DB
+	Timeout time.Duration
+}
+
+// The New() method generates a new key and inserts it in the api_keys table. A nil
+// expiry creates a key which never expires.
+func (m APIKeyModel) New(ctx context.Context, userID int64, name string, permissions Permissions, expiry *time.Time) (*APIKey, error) {
+	ctx, span := startSpan(ctx, "APIKeyModel.New")
+	defer span.End()
+
+	key, err := generateAPIKey(userID, name, permissions, expiry)
+	if err != nil {
+		return nil, err
+	}
+	err = m.Insert(ctx, key)
+	return key, err
+}
+
+func (m APIKeyModel) Insert(ctx context.Context, key *APIKey) error {
+	ctx, span := startSpan(ctx, "APIKeyModel.Insert")
+	defer span.End()
+
+	query := `
+		INSERT INTO api_keys (hash, user_id, name, permissions, expiry)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING id, created_at`
+	args := []interface{}{key.Hash, key.UserID, key.Name, pq.Array([]string(key.Permissions)), key.Expiry}
+	ctx, cancel := withTimeout(ctx, m.Timeout)
+	defer cancel()
+	return m.DB.QueryRowContext(ctx, query, args...).Scan(&key.ID, &key.CreatedAt)
+}
+
+// GetAllForUser() returns every key owned by a user, including expired ones, so that
+// they can still be seen and revoked.
+func (m APIKeyModel) GetAllForUser(ctx context.Context, userID int64) ([]*APIKey, error) {
+	ctx, span := startSpan(ctx, "APIKeyModel.GetAllForUser")
+	defer span.End()
+
+	query := `
+		SELECT id, user_id, name, permissions, created_at, expiry, last_used_at
+		FROM api_keys
+		WHERE user_id = $1
+		ORDER BY id`
+	ctx, cancel := withTimeout(ctx, m.Timeout)
+	defer cancel()
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []*APIKey{}
+	for rows.Next() {
+		var key APIKey
+		err := rows.Scan(
+			&key.ID,
+			&key.UserID,
+			&key.Name,
+			pq.Array((*[]string)(&key.Permissions)),
+			&key.CreatedAt,
+			&key.Expiry,
+			&key.LastUsedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, &key)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// GetForPlaintext() looks up an unexpired key from its plaintext value and records
+// that it has just been used.
+func (m APIKeyModel) GetForPlaintext(ctx context.Context, keyPlaintext string) (*APIKey, error) {
+	ctx, span := startSpan(ctx, "APIKeyModel.GetForPlaintext")
+	defer span.End()
+
+	keyHash := sha256.Sum256([]byte(keyPlaintext))
+	query := `
+		UPDATE api_keys
+		SET last_used_at = NOW()
+		WHERE hash = $1
+		AND (expiry IS NULL OR expiry > NOW())
+		RETURNING id, user_id, name, permissions, created_at, expiry, last_used_at`
+	var key APIKey
+	ctx, cancel := withTimeout(ctx, m.Timeout)
+	defer cancel()
+	err := m.DB.QueryRowContext(ctx, query, keyHash[:]).Scan(
+		&key.ID,
+		&key.UserID,
+		&key.Name,
+		pq.Array((*[]string)(&key.Permissions)),
+		&key.CreatedAt,
+		&key.Expiry,
+		&key.LastUsedAt,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	key.Hash = keyHash[:]
+	return &key, nil
+}
+
+// DeleteForUser() revokes a key. The user ID is part of the WHERE clause so that users
+// can only ever revoke their own keys.
+func (m APIKeyModel) DeleteForUser(ctx context.Context, id, userID int64) error {
+	ctx, span := startSpan(ctx, "APIKeyModel.DeleteForUser")
+	defer span.End()
+
+	if id < 1 {
+		return ErrRecordNotFound
+	}
+	query := `
+		DELETE FROM api_keys
+		WHERE id = $1 AND user_id = $2`
+	ctx, cancel := withTimeout(ctx, m.Timeout)
+	defer cancel()
+	result, err := m.DB.ExecContext(ctx, query, id, userID)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+	return nil
+}
@@ -0,0 +1,201 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/henrtytanoh/greenlight/internal/validator"
+)
+
+// Outcomes of audited actions.
+const (
+	AuditSuccess = "success"
+	AuditFailure = "failure"
+)
+
+// Audited actions.
+const (
+	AuditLogin              = "auth.login"
+	AuditLogout             = "auth.logout"
+	AuditTokenRefresh       = "auth.token_refresh"
+	AuditSessionRevoke      = "auth.session_revoke"
+	AuditMFAEnable          = "auth.mfa_enable"
+	AuditMFADisable         = "auth.mfa_disable"
+	AuditLockoutLift        = "auth.lockout_lift"
+	AuditAPIKeyCreate       = "api_key.create"
+	AuditAPIKeyRevoke       = "api_key.revoke"
+	AuditOAuthAuthorize     = "oauth.authorize"
+	AuditOAuthTokenCreate   = "oauth.token_create"
+	AuditOAuthTokenRevoke   = "oauth.token_revoke"
+	AuditOAuthAppRevoke     = "oauth.app_revoke"
+	AuditOAuthClientCreate  = "oauth.client_create"
+	AuditOAuthClientDelete  = "oauth.client_delete"
+	AuditRolesUpdate        = "user.roles_update"
+	AuditPasswordResetStart = "user.password_reset_request"
+	AuditPasswordReset      = "user.password_reset"
+	AuditMovieCreate        = "movie.create"
+	AuditMovieUpdate        = "movie.update"
+	AuditMovieDelete        = "movie.delete"
+)
+
+// AuditEvent records who did what, to what, and from where. ActorID is nil when the
+// actor isn't known, such as a failed login with an unknown email address. Details
+// holds action specific data, e.g. the changes made to a movie.
+type AuditEvent struct {
+	ID         int64                  `json:"id"`
+	CreatedAt  time.Time              `json:"created_at"`
+	ActorID    *int64                 `json:"actor_id"`
+	Action     string                 `json:"action"`
+	Outcome    string                 `json:"outcome"`
+	TargetType string                 `json:"target_type,omitempty"`
+	TargetID   string                 `json:"target_id,omitempty"`
+	IP         string                 `json:"ip,omitempty"`
+	RequestID  string                 `json:"request_id,omitempty"`
+	Details    map[string]interface{} `json:"details,omitempty"`
+}
+
+// AuditFilters narrows down a listing of audit events. Zero values don't filter.
+type AuditFilters struct {
+	ActorID    int64
+	Action     string
+	Outcome    string
+	TargetType string
+	TargetID   string
+	IP         string
+	RequestID  string
+	Since      time.Time
+	Until      time.Time
+}
+
+func ValidateAuditFilters(v *validator.Validator, f AuditFilters) {
+	v.Check(f.ActorID >= 0, "actor_id", "must be a positive integer")
+	v.Check(f.Outcome == "" || validator.In(f.Outcome, AuditSuccess, AuditFailure), "outcome", "must be success or failure")
+	v.Check(f.Since.IsZero() || f.Until.IsZero() || f.Since.Before(f.Until), "since", "must be before until")
+}
+
+// Define the AuditModel type.
+type AuditModel struct {
+	DB      *sql.DB
+	Timeout time.Duration
+}
+
+// Insert() appends an event to the audit log. Events can never be changed or deleted.
+func (m AuditModel) Insert(ctx context.Context, event *AuditEvent) error {
+	ctx, span := startSpan(ctx, "AuditModel.Insert")
+	defer span.End()
+
+	details, err := json.Marshal(event.Details)
+	if err != nil {
+		return err
+	}
+	if event.Details == nil {
+		details = []byte("{}")
+	}
+
+	query := `
+		INSERT INTO audit_events (actor_id, action, outcome, target_type, target_id, ip, request_id, details)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		RETURNING id, created_at`
+	args := []interface{}{
+		event.ActorID,
+		event.Action,
+		event.Outcome,
+		event.TargetType,
+		event.TargetID,
+		event.IP,
+		event.RequestID,
+		details,
+	}
+	ctx, cancel := withTimeout(ctx, m.Timeout)
+	defer cancel()
+	return m.DB.QueryRowContext(ctx, query, args...).Scan(&event.ID, &event.CreatedAt)
+}
+
+// GetAll() returns the audit events matching the filters, a page at a time.
+func (m AuditModel) GetAll(ctx context.Context, audit AuditFilters, filters Filters) ([]*AuditEvent, Metadata, error) {
+	ctx, span := startSpan(ctx, "AuditModel.GetAll")
+	defer span.End()
+
+	query := fmt.Sprintf(`
+		SELECT count(*) OVER(), id, created_at, actor_id, action, outcome, target_type, target_id,
+			ip, request_id, details
+		FROM audit_events
+		WHERE (actor_id = $1 OR $1 = 0)
+		AND (action = $2 OR $2 = '')
+		AND (outcome = $3 OR $3 = '')
+		AND (target_type = $4 OR $4 = '')
+		AND (target_id = $5 OR $5 = '')
+		AND (ip = $6 OR $6 = '')
+		AND (request_id = $7 OR $7 = '')
+		AND (created_at >= $8 OR $8 IS NULL)
+		AND (created_at < $9 OR $9 IS NULL)
+		ORDER BY %s %s, id DESC
+		LIMIT $10 OFFSET $11`, filters.sortColumn(), filters.sortDirection())
+
+	var since, until *time.Time
+	if !audit.Since.IsZero() {
+		since = &audit.Since
+	}
+	if !audit.Until.IsZero() {
+		until = &audit.Until
+	}
+
+	ctx, cancel := withTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	args := []interface{}{
+		audit.ActorID,
+		audit.Action,
+		audit.Outcome,
+		audit.TargetType,
+		audit.TargetID,
+		audit.IP,
+		audit.RequestID,
+		since,
+		until,
+		filters.limit(),
+		filters.offset(),
+	}
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+
+	events := []*AuditEvent{}
+	totalRecords := 0
+	for rows.Next() {
+		var event AuditEvent
+		var details []byte
+		err := rows.Scan(
+			&totalRecords,
+			&event.ID,
+			&event.CreatedAt,
+			&event.ActorID,
+			&event.Action,
+			&event.Outcome,
+			&event.TargetType,
+			&event.TargetID,
+			&event.IP,
+			&event.RequestID,
+			&details,
+		)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+		err = json.Unmarshal(details, &event.Details)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+		events = append(events, &event)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+	return events, metadata, nil
+}
@@ -0,0 +1,72 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// Identity links a user to their account at an external OpenID Connect provider. The
+// subject is the provider's stable identifier for the account; unlike the email address
+// it never changes.
+type Identity struct {
+	Provider    string
+	Subject     string
+	UserID      int64
+	Email       string
+	CreatedAt   time.Time
+	LastLoginAt time.Time
+}
+
+// Define the IdentityModel type.
+type IdentityModel struct {
+	DB      *sql.DB
+	Timeout time.Duration
+}
+
+func (m IdentityModel) Insert(ctx context.Context, identity *Identity) error {
+	ctx, span := startSpan(ctx, "IdentityModel.Insert")
+	defer span.End()
+
+	query := `
+		INSERT INTO user_identities (provider, subject, user_id, email)
+		VALUES ($1, $2, $3, $4)
+		RETURNING created_at, last_login_at`
+	args := []interface{}{identity.Provider, identity.Subject, identity.UserID, identity.Email}
+	ctx, cancel := withTimeout(ctx, m.Timeout)
+	defer cancel()
+	return m.DB.QueryRowContext(ctx, query, args...).Scan(&identity.CreatedAt, &identity.LastLoginAt)
+}
+
+// Touch() looks up an identity and records that it has just been used to log in.
+func (m IdentityModel) Touch(ctx context.Context, provider, subject, email string) (*Identity, error) {
+	ctx, span := startSpan(ctx, "IdentityModel.Touch")
+	defer span.End()
+
+	query := `
+		UPDATE user_identities
+		SET last_login_at = NOW(), email = $3
+		WHERE provider = $1 AND subject = $2
+		RETURNING provider, subject, user_id, email, created_at, last_login_at`
+	var identity Identity
+	ctx, cancel := withTimeout(ctx, m.Timeout)
+	defer cancel()
+	err := m.DB.QueryRowContext(ctx, query, provider, subject, email).Scan(
+		&identity.Provider,
+		&identity.Subject,
+		&identity.UserID,
+		&identity.Email,
+		&identity.CreatedAt,
+		&identity.LastLoginAt,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &identity, nil
+}
@@ -0,0 +1,957 @@
+package data
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// MemoryStore keeps movies, users, tokens, roles, TOTP enrollments and audit events in
+// memory, for handler tests and demos without a database. It behaves like the
+// Postgres models: records are copied in and out, versions are checked on update
+// (ErrEditConflict), emails are unique regardless of case (ErrDuplicateEmail), and
+// missing records are reported with ErrRecordNotFound. It is safe for concurrent use.
+//
+// Titles are searched word by word like Postgres' 'simple' text search configuration,
+// and sorted byte-wise rather than with the database collation.
+type MemoryStore struct {
+	mu sync.Mutex
+
+	movies      map[int64]*Movie
+	lastMovieID int64
+
+	users      map[int64]*User
+	lastUserID int64
+
+	// Tokens are keyed by their hash, which is their primary key in Postgres.
+	tokens      map[string]*memoryToken
+	lastTokenID int64
+
+	// The roles and their permissions, in the order of their ids, as seeded by the
+	// migrations.
+	roles      []memoryRole
+	usersRoles map[int64]Roles
+
+	totp map[int64]*TOTP
+	// Recovery codes are keyed by their hash, and map to whether they have been used.
+	recoveryCodes map[int64]map[[32]byte]bool
+
+	audit       []*AuditEvent
+	lastAuditID int64
+}
+
+// memoryToken holds the columns of the tokens table which Token doesn't carry.
+type memoryToken struct {
+	Token
+	id         int64
+	createdAt  time.Time
+	lastUsedAt *time.Time
+}
+
+type memoryRole struct {
+	code        string
+	permissions Permissions
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		movies: make(map[int64]*Movie),
+		users:  make(map[int64]*User),
+		tokens: make(map[string]*memoryToken),
+		roles: []memoryRole{
+			{code: "viewer", permissions: Permissions{"movies:read"}},
+			{code: "editor", permissions: Permissions{"movies:read", "movies:write"}},
+			{code: "admin", permissions: Permissions{"movies:read", "movies:write", "admin:access"}},
+		},
+		usersRoles:    make(map[int64]Roles),
+		totp:          make(map[int64]*TOTP),
+		recoveryCodes: make(map[int64]map[[32]byte]bool),
+	}
+}
+
+// Models() returns a Models struct whose movies, users, tokens, permissions, roles,
+// TOTP enrollments and audit log are backed by the store. Permissions only come from
+// roles, since the store doesn't keep subscriptions. The other models have no
+// database, so the handlers which use them still need Postgres.
+func (s *MemoryStore) Models() Models {
+	return Models{
+		Movies:      memoryMovieModel{s},
+		Users:       memoryUserModel{s},
+		Tokens:      memoryTokenModel{s},
+		Permissions: memoryPermissionModel{s},
+		Roles:       memoryRoleModel{s},
+		TOTP:        memoryTOTPModel{s},
+		Audit:       memoryAuditModel{s},
+	}
+}
+
+// lock() locks the store, unless ctx is already done: like a query, a call made on
+// behalf of a canceled request fails.
+func (s *MemoryStore) lock(ctx context.Context) error {
+	err := ctx.Err()
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	return nil
+}
+
+// Postgres stores timestamps with a precision of one second.
+func memoryNow() time.Time {
+	return time.Now().Truncate(time.Second)
+}
+
+func copyMovie(movie *Movie) *Movie {
+	c := *movie
+	c.Genres = slices.Clone(movie.Genres)
+	return &c
+}
+
+// copyUser() copies a user the way it is read back from the database: with the
+// password hash, but not the plaintext.
+func copyUser(user *User) *User {
+	c := *user
+	c.Password = password{hash: bytes.Clone(user.Password.hash)}
+	return &c
+}
+
+type memoryMovieModel struct {
+	s *MemoryStore
+}
+
+func (m memoryMovieModel) Insert(ctx context.Context, movie *Movie) error {
+	err := m.s.lock(ctx)
+	if err != nil {
+		return err
+	}
+	defer m.s.mu.Unlock()
+
+	m.s.lastMovieID++
+	movie.ID = m.s.lastMovieID
+	movie.CreatedAt = memoryNow()
+	movie.Version = 1
+	m.s.movies[movie.ID] = copyMovie(movie)
+	return nil
+}
+
+func (m memoryMovieModel) Get(ctx context.Context, id int64) (*Movie, error) {
+	err := m.s.lock(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer m.s.mu.Unlock()
+
+	movie, ok := m.s.movies[id]
+	if !ok {
+		return nil, ErrRecordNotFound
+	}
+	return copyMovie(movie), nil
+}
+
+func (m memoryMovieModel) Update(ctx context.Context, movie *Movie) error {
+	err := m.s.lock(ctx)
+	if err != nil {
+		return err
+	}
+	defer m.s.mu.Unlock()
+
+	stored, ok := m.s.movies[movie.ID]
+	if !ok || stored.Version != movie.Version {
+		return ErrEditConflict
+	}
+
+	movie.Version++
+	updated := copyMovie(movie)
+	updated.CreatedAt = stored.CreatedAt
+	m.s.movies[movie.ID] = updated
+	return nil
+}
+
+func (m memoryMovieModel) Delete(ctx context.Context, id int64) error {
+	err := m.s.lock(ctx)
+	if err != nil {
+		return err
+	}
+	defer m.s.mu.Unlock()
+
+	_, ok := m.s.movies[id]
+	if !ok {
+		return ErrRecordNotFound
+	}
+	delete(m.s.movies, id)
+	return nil
+}
+
+func (m memoryMovieModel) GetAll(ctx context.Context, title string, genres []string, filters Filters) ([]*Movie, Metadata, error) {
+	// Like the SQL query, refuse to sort on a column which isn't in the safelist.
+	column, direction := filters.sortColumn(), filters.sortDirection()
+
+	err := m.s.lock(ctx)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer m.s.mu.Unlock()
+
+	matches := []*Movie{}
+	for _, movie := range m.s.movies {
+		if matchesTitle(movie.Title, title) && containsAll(movie.Genres, genres) {
+			matches = append(matches, movie)
+		}
+	}
+
+	slices.SortFunc(matches, func(a, b *Movie) int {
+		var c int
+		switch column {
+		case "title":
+			c = strings.Compare(a.Title, b.Title)
+		case "year":
+			c = cmp.Compare(a.Year, b.Year)
+		case "runtime":
+			c = cmp.Compare(a.Runtime, b.Runtime)
+		default:
+			c = cmp.Compare(a.ID, b.ID)
+		}
+		if direction == "DESC" {
+			c = -c
+		}
+		if c == 0 {
+			c = cmp.Compare(a.ID, b.ID)
+		}
+		return c
+	})
+
+	// The total comes from count(*) OVER() in SQL, so a page past the end reports no
+	// records at all.
+	if filters.offset() >= len(matches) {
+		return []*Movie{}, Metadata{}, nil
+	}
+	page := matches[filters.offset():min(filters.offset()+filters.limit(), len(matches))]
+
+	movies := make([]*Movie, 0, len(page))
+	for _, movie := range page {
+		movies = append(movies, copyMovie(movie))
+	}
+	return movies, calculateMetadata(len(matches), filters.Page, filters.PageSize), nil
+}
+
+// matchesTitle() reports whether every word of the query is a word of the title, as
+// to_tsvector('simple', title) @@ plainto_tsquery('simple', query) does.
+func matchesTitle(title, query string) bool {
+	if query == "" {
+		return true
+	}
+	queryWords := textSearchWords(query)
+	if len(queryWords) == 0 {
+		return false
+	}
+	titleWords := textSearchWords(title)
+	for _, word := range queryWords {
+		if !slices.Contains(titleWords, word) {
+			return false
+		}
+	}
+	return true
+}
+
+func textSearchWords(s string) []string {
+	return strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+func containsAll(values, wanted []string) bool {
+	for _, w := range wanted {
+		if !slices.Contains(values, w) {
+			return false
+		}
+	}
+	return true
+}
+
+type memoryUserModel struct {
+	s *MemoryStore
+}
+
+func (m memoryUserModel) Insert(ctx context.Context, user *User) error {
+	err := m.s.lock(ctx)
+	if err != nil {
+		return err
+	}
+	defer m.s.mu.Unlock()
+
+	if m.s.userByEmail(user.Email) != nil {
+		return ErrDuplicateEmail
+	}
+
+	m.s.lastUserID++
+	user.ID = m.s.lastUserID
+	user.CreatedAt = memoryNow()
+	user.Version = 1
+	m.s.users[user.ID] = copyUser(user)
+	return nil
+}
+
+func (m memoryUserModel) Get(ctx context.Context, id int64) (*User, error) {
+	err := m.s.lock(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer m.s.mu.Unlock()
+
+	user, ok := m.s.users[id]
+	if !ok {
+		return nil, ErrRecordNotFound
+	}
+	return copyUser(user), nil
+}
+
+func (m memoryUserModel) GetByEmail(ctx context.Context, email string) (*User, error) {
+	err := m.s.lock(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer m.s.mu.Unlock()
+
+	user := m.s.userByEmail(email)
+	if user == nil {
+		return nil, ErrRecordNotFound
+	}
+	return copyUser(user), nil
+}
+
+func (m memoryUserModel) Update(ctx context.Context, user *User) error {
+	err := m.s.lock(ctx)
+	if err != nil {
+		return err
+	}
+	defer m.s.mu.Unlock()
+
+	stored, ok := m.s.users[user.ID]
+	if !ok || stored.Version != user.Version {
+		return ErrEditConflict
+	}
+	if other := m.s.userByEmail(user.Email); other != nil && other.ID != user.ID {
+		return ErrDuplicateEmail
+	}
+
+	user.Version++
+	updated := copyUser(user)
+	updated.CreatedAt = stored.CreatedAt
+	m.s.users[user.ID] = updated
+	return nil
+}
+
+func (m memoryUserModel) GetForToken(ctx context.Context, tokenScope, tokenPlaintext string) (*User, error) {
+	err := m.s.lock(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer m.s.mu.Unlock()
+
+	token := m.s.tokenFor(tokenPlaintext)
+	if token == nil || token.Scope != tokenScope || !token.Expiry.After(time.Now()) {
+		return nil, ErrRecordNotFound
+	}
+	return copyUser(m.s.users[token.UserID]), nil
+}
+
+// userByEmail() finds a user by email address, ignoring case like the citext column.
+// The caller must hold the lock.
+func (s *MemoryStore) userByEmail(email string) *User {
+	for _, user := range s.users {
+		if strings.ToLower(user.Email) == strings.ToLower(email) {
+			return user
+		}
+	}
+	return nil
+}
+
+// tokenFor() finds a token by plaintext. The caller must hold the lock.
+func (s *MemoryStore) tokenFor(tokenPlaintext string) *memoryToken {
+	hash := sha256.Sum256([]byte(tokenPlaintext))
+	return s.tokens[string(hash[:])]
+}
+
+type memoryTokenModel struct {
+	s *MemoryStore
+}
+
+func (m memoryTokenModel) New(ctx context.Context, userID int64, ttl time.Duration, scope string) (*Token, error) {
+	token, err := generateToken(userID, ttl, scope)
+	if err != nil {
+		return nil, err
+	}
+	err = m.Insert(ctx, token)
+	return token, err
+}
+
+func (m memoryTokenModel) NewSession(ctx context.Context, userID int64, ttl time.Duration, ip, userAgent string) (*Token, error) {
+	token, err := generateSessionToken(userID, ttl, ip, userAgent)
+	if err != nil {
+		return nil, err
+	}
+	err = m.Insert(ctx, token)
+	return token, err
+}
+
+func (m memoryTokenModel) NewRefresh(ctx context.Context, userID int64, ttl time.Duration, family, ip, userAgent string) (*Token, error) {
+	token, err := generateRefreshToken(userID, ttl, family, ip, userAgent)
+	if err != nil {
+		return nil, err
+	}
+	err = m.Insert(ctx, token)
+	return token, err
+}
+
+// Insert() fails like the INSERT statement would when the hash is taken or the user
+// doesn't exist.
+func (m memoryTokenModel) Insert(ctx context.Context, token *Token) error {
+	err := m.s.lock(ctx)
+	if err != nil {
+		return err
+	}
+	defer m.s.mu.Unlock()
+
+	if _, ok := m.s.tokens[string(token.Hash)]; ok {
+		return errors.New("duplicate token hash")
+	}
+	if _, ok := m.s.users[token.UserID]; !ok {
+		return errors.New("token user does not exist")
+	}
+
+	m.s.lastTokenID++
+	stored := &memoryToken{
+		Token:     *token,
+		id:        m.s.lastTokenID,
+		createdAt: memoryNow(),
+	}
+	stored.Plaintext = ""
+	stored.Hash = bytes.Clone(token.Hash)
+	stored.UsedAt = nil
+	m.s.tokens[string(token.Hash)] = stored
+	return nil
+}
+
+func (m memoryTokenModel) DeleteAllForUser(ctx context.Context, scope string, userID int64) error {
+	return m.deleteWhere(ctx, func(t *memoryToken) bool {
+		return t.Scope == scope && t.UserID == userID
+	})
+}
+
+func (m memoryTokenModel) DeleteForPlaintext(ctx context.Context, scope, tokenPlaintext string) error {
+	hash := sha256.Sum256([]byte(tokenPlaintext))
+	return m.deleteWhere(ctx, func(t *memoryToken) bool {
+		return t.Scope == scope && bytes.Equal(t.Hash, hash[:])
+	})
+}
+
+func (m memoryTokenModel) Touch(ctx context.Context, tokenPlaintext string) error {
+	err := m.s.lock(ctx)
+	if err != nil {
+		return err
+	}
+	defer m.s.mu.Unlock()
+
+	token := m.s.tokenFor(tokenPlaintext)
+	now := memoryNow()
+	if token != nil && (token.lastUsedAt == nil || token.lastUsedAt.Before(now.Add(-time.Minute))) {
+		token.lastUsedAt = &now
+	}
+	return nil
+}
+
+func (m memoryTokenModel) GetSessionsForUser(ctx context.Context, userID int64, currentPlaintext string) ([]*Session, error) {
+	err := m.s.lock(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer m.s.mu.Unlock()
+
+	currentHash := sha256.Sum256([]byte(currentPlaintext))
+	now := time.Now()
+
+	sessions := []*Session{}
+	for _, token := range m.s.tokens {
+		if token.UserID != userID || !slices.Contains(sessionScopes, token.Scope) ||
+			token.UsedAt != nil || !token.Expiry.After(now) {
+			continue
+		}
+		session := &Session{
+			ID:        token.id,
+			CreatedAt: token.createdAt,
+			Expiry:    token.Expiry,
+			IP:        token.IP,
+			UserAgent: token.UserAgent,
+			Current:   bytes.Equal(token.Hash, currentHash[:]),
+		}
+		if token.lastUsedAt != nil {
+			lastUsedAt := *token.lastUsedAt
+			session.LastUsedAt = &lastUsedAt
+		}
+		sessions = append(sessions, session)
+	}
+
+	slices.SortFunc(sessions, func(a, b *Session) int {
+		if c := b.CreatedAt.Compare(a.CreatedAt); c != 0 {
+			return c
+		}
+		return cmp.Compare(b.ID, a.ID)
+	})
+	return sessions, nil
+}
+
+func (m memoryTokenModel) DeleteSessionForUser(ctx context.Context, id, userID int64) error {
+	err := m.s.lock(ctx)
+	if err != nil {
+		return err
+	}
+	defer m.s.mu.Unlock()
+
+	for hash, token := range m.s.tokens {
+		if token.id == id && token.UserID == userID && slices.Contains(sessionScopes, token.Scope) {
+			delete(m.s.tokens, hash)
+			return nil
+		}
+	}
+	return ErrRecordNotFound
+}
+
+func (m memoryTokenModel) DeleteAllSessionsForUser(ctx context.Context, userID int64) error {
+	return m.deleteWhere(ctx, func(t *memoryToken) bool {
+		return t.UserID == userID && slices.Contains(sessionScopes, t.Scope)
+	})
+}
+
+func (m memoryTokenModel) GetRefresh(ctx context.Context, tokenPlaintext string) (*Token, error) {
+	err := m.s.lock(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer m.s.mu.Unlock()
+
+	stored := m.s.tokenFor(tokenPlaintext)
+	if stored == nil || stored.Scope != ScopeRefresh || !stored.Expiry.After(time.Now()) {
+		return nil, ErrRecordNotFound
+	}
+
+	token := &Token{
+		Plaintext: tokenPlaintext,
+		Hash:      bytes.Clone(stored.Hash),
+		UserID:    stored.UserID,
+		Expiry:    stored.Expiry,
+		Scope:     ScopeRefresh,
+		Family:    stored.Family,
+	}
+	if stored.UsedAt != nil {
+		usedAt := *stored.UsedAt
+		token.UsedAt = &usedAt
+	}
+	return token, nil
+}
+
+func (m memoryTokenModel) MarkUsed(ctx context.Context, token *Token) error {
+	err := m.s.lock(ctx)
+	if err != nil {
+		return err
+	}
+	defer m.s.mu.Unlock()
+
+	stored, ok := m.s.tokens[string(token.Hash)]
+	if !ok || stored.UsedAt != nil {
+		return ErrEditConflict
+	}
+	now := memoryNow()
+	stored.UsedAt = &now
+	return nil
+}
+
+func (m memoryTokenModel) DeleteFamily(ctx context.Context, family string) error {
+	// Tokens without a family have a NULL family in Postgres, which equals nothing.
+	return m.deleteWhere(ctx, func(t *memoryToken) bool {
+		return t.Family != "" && t.Family == family
+	})
+}
+
+func (m memoryTokenModel) deleteWhere(ctx context.Context, match func(t *memoryToken) bool) error {
+	err := m.s.lock(ctx)
+	if err != nil {
+		return err
+	}
+	defer m.s.mu.Unlock()
+
+	for hash, token := range m.s.tokens {
+		if match(token) {
+			delete(m.s.tokens, hash)
+		}
+	}
+	return nil
+}
+
+type memoryPermissionModel struct {
+	s *MemoryStore
+}
+
+func (m memoryPermissionModel) GetAllForUser(ctx context.Context, userID int64) (Permissions, error) {
+	err := m.s.lock(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer m.s.mu.Unlock()
+
+	var permissions Permissions
+	for _, role := range m.s.roles {
+		if !m.s.usersRoles[userID].Include(role.code) {
+			continue
+		}
+		for _, code := range role.permissions {
+			if !permissions.Include(code) {
+				permissions = append(permissions, code)
+			}
+		}
+	}
+	return permissions, nil
+}
+
+type memoryRoleModel struct {
+	s *MemoryStore
+}
+
+func (m memoryRoleModel) GetAll(ctx context.Context) (Roles, error) {
+	err := m.s.lock(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer m.s.mu.Unlock()
+
+	roles := Roles{}
+	for _, role := range m.s.roles {
+		roles = append(roles, role.code)
+	}
+	return roles, nil
+}
+
+func (m memoryRoleModel) GetAllForUser(ctx context.Context, userID int64) (Roles, error) {
+	err := m.s.lock(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer m.s.mu.Unlock()
+
+	roles := Roles{}
+	for _, role := range m.s.roles {
+		if m.s.usersRoles[userID].Include(role.code) {
+			roles = append(roles, role.code)
+		}
+	}
+	return roles, nil
+}
+
+// AddForUser() grants the roles which exist and ignores the others, like the INSERT
+// ... SELECT statement.
+func (m memoryRoleModel) AddForUser(ctx context.Context, userID int64, codes ...string) error {
+	err := m.s.lock(ctx)
+	if err != nil {
+		return err
+	}
+	defer m.s.mu.Unlock()
+
+	if _, ok := m.s.users[userID]; !ok {
+		return errors.New("role user does not exist")
+	}
+	for _, role := range m.s.roles {
+		if slices.Contains(codes, role.code) && !m.s.usersRoles[userID].Include(role.code) {
+			m.s.usersRoles[userID] = append(m.s.usersRoles[userID], role.code)
+		}
+	}
+	return nil
+}
+
+func (m memoryRoleModel) RemoveForUser(ctx context.Context, userID int64, codes ...string) error {
+	err := m.s.lock(ctx)
+	if err != nil {
+		return err
+	}
+	defer m.s.mu.Unlock()
+
+	m.s.usersRoles[userID] = slices.DeleteFunc(m.s.usersRoles[userID], func(code string) bool {
+		return slices.Contains(codes, code)
+	})
+	return nil
+}
+
+func (m memoryRoleModel) SetForUser(ctx context.Context, userID int64, codes ...string) error {
+	err := m.s.lock(ctx)
+	if err != nil {
+		return err
+	}
+	defer m.s.mu.Unlock()
+
+	if _, ok := m.s.users[userID]; !ok {
+		return errors.New("role user does not exist")
+	}
+	roles := Roles{}
+	for _, role := range m.s.roles {
+		if slices.Contains(codes, role.code) {
+			roles = append(roles, role.code)
+		}
+	}
+	m.s.usersRoles[userID] = roles
+	return nil
+}
+
+type memoryTOTPModel struct {
+	s *MemoryStore
+}
+
+func (m memoryTOTPModel) Get(ctx context.Context, userID int64) (*TOTP, error) {
+	err := m.s.lock(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer m.s.mu.Unlock()
+
+	totp, ok := m.s.totp[userID]
+	if !ok {
+		return nil, ErrRecordNotFound
+	}
+	return copyTOTP(totp), nil
+}
+
+func (m memoryTOTPModel) Upsert(ctx context.Context, totp *TOTP) error {
+	err := m.s.lock(ctx)
+	if err != nil {
+		return err
+	}
+	defer m.s.mu.Unlock()
+
+	if _, ok := m.s.users[totp.UserID]; !ok {
+		return errors.New("totp user does not exist")
+	}
+	if stored, ok := m.s.totp[totp.UserID]; ok && stored.Confirmed {
+		return ErrEditConflict
+	}
+
+	totp.Confirmed = false
+	totp.LastCounter = 0
+	totp.CreatedAt = memoryNow()
+	m.s.totp[totp.UserID] = copyTOTP(totp)
+	return nil
+}
+
+func (m memoryTOTPModel) Confirm(ctx context.Context, userID, counter int64) error {
+	err := m.s.lock(ctx)
+	if err != nil {
+		return err
+	}
+	defer m.s.mu.Unlock()
+
+	if totp, ok := m.s.totp[userID]; ok {
+		totp.Confirmed = true
+		totp.LastCounter = counter
+	}
+	return nil
+}
+
+func (m memoryTOTPModel) UseCounter(ctx context.Context, userID, counter int64) error {
+	err := m.s.lock(ctx)
+	if err != nil {
+		return err
+	}
+	defer m.s.mu.Unlock()
+
+	totp, ok := m.s.totp[userID]
+	if !ok || totp.LastCounter >= counter {
+		return ErrEditConflict
+	}
+	totp.LastCounter = counter
+	return nil
+}
+
+func (m memoryTOTPModel) Delete(ctx context.Context, userID int64) error {
+	err := m.s.lock(ctx)
+	if err != nil {
+		return err
+	}
+	defer m.s.mu.Unlock()
+
+	delete(m.s.recoveryCodes, userID)
+	delete(m.s.totp, userID)
+	return nil
+}
+
+func (m memoryTOTPModel) NewRecoveryCodes(ctx context.Context, userID int64) ([]string, error) {
+	codes, err := generateRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+
+	err = m.s.lock(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer m.s.mu.Unlock()
+
+	if _, ok := m.s.users[userID]; !ok {
+		return nil, errors.New("recovery code user does not exist")
+	}
+	hashes := make(map[[32]byte]bool, len(codes))
+	for _, code := range codes {
+		hashes[recoveryCodeHash(code)] = false
+	}
+	m.s.recoveryCodes[userID] = hashes
+	return codes, nil
+}
+
+func (m memoryTOTPModel) UseRecoveryCode(ctx context.Context, userID int64, code string) error {
+	err := m.s.lock(ctx)
+	if err != nil {
+		return err
+	}
+	defer m.s.mu.Unlock()
+
+	hash := recoveryCodeHash(code)
+	used, ok := m.s.recoveryCodes[userID][hash]
+	if !ok || used {
+		return ErrRecordNotFound
+	}
+	m.s.recoveryCodes[userID][hash] = true
+	return nil
+}
+
+func copyTOTP(totp *TOTP) *TOTP {
+	c := *totp
+	c.Secret = bytes.Clone(totp.Secret)
+	return &c
+}
+
+type memoryAuditModel struct {
+	s *MemoryStore
+}
+
+func (m memoryAuditModel) Insert(ctx context.Context, event *AuditEvent) error {
+	err := m.s.lock(ctx)
+	if err != nil {
+		return err
+	}
+	defer m.s.mu.Unlock()
+
+	stored, err := copyAuditEvent(event)
+	if err != nil {
+		return err
+	}
+	m.s.lastAuditID++
+	stored.ID = m.s.lastAuditID
+	stored.CreatedAt = memoryNow()
+	m.s.audit = append(m.s.audit, stored)
+
+	event.ID, event.CreatedAt = stored.ID, stored.CreatedAt
+	return nil
+}
+
+func (m memoryAuditModel) GetAll(ctx context.Context, audit AuditFilters, filters Filters) ([]*AuditEvent, Metadata, error) {
+	column, direction := filters.sortColumn(), filters.sortDirection()
+
+	err := m.s.lock(ctx)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer m.s.mu.Unlock()
+
+	matches := []*AuditEvent{}
+	for _, event := range m.s.audit {
+		if matchesAuditFilters(event, audit) {
+			matches = append(matches, event)
+		}
+	}
+
+	slices.SortFunc(matches, func(a, b *AuditEvent) int {
+		var c int
+		switch column {
+		case "created_at":
+			c = a.CreatedAt.Compare(b.CreatedAt)
+		default:
+			c = cmp.Compare(a.ID, b.ID)
+		}
+		if direction == "DESC" {
+			c = -c
+		}
+		if c == 0 {
+			c = cmp.Compare(b.ID, a.ID)
+		}
+		return c
+	})
+
+	if filters.offset() >= len(matches) {
+		return []*AuditEvent{}, Metadata{}, nil
+	}
+	page := matches[filters.offset():min(filters.offset()+filters.limit(), len(matches))]
+
+	events := make([]*AuditEvent, 0, len(page))
+	for _, event := range page {
+		c, err := copyAuditEvent(event)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+		events = append(events, c)
+	}
+	return events, calculateMetadata(len(matches), filters.Page, filters.PageSize), nil
+}
+
+// matchesAuditFilters() reports whether an event matches every filter, zero values
+// matching anything.
+func matchesAuditFilters(event *AuditEvent, f AuditFilters) bool {
+	switch {
+	case f.ActorID != 0 && (event.ActorID == nil || *event.ActorID != f.ActorID):
+		return false
+	case f.Action != "" && event.Action != f.Action:
+		return false
+	case f.Outcome != "" && event.Outcome != f.Outcome:
+		return false
+	case f.TargetType != "" && event.TargetType != f.TargetType:
+		return false
+	case f.TargetID != "" && event.TargetID != f.TargetID:
+		return false
+	case f.IP != "" && event.IP != f.IP:
+		return false
+	case f.RequestID != "" && event.RequestID != f.RequestID:
+		return false
+	case !f.Since.IsZero() && event.CreatedAt.Before(f.Since):
+		return false
+	case !f.Until.IsZero() && !event.CreatedAt.Before(f.Until):
+		return false
+	}
+	return true
+}
+
+// copyAuditEvent() copies an event the way it is read back from the database: the
+// details go through JSON like the jsonb column, so that numbers become float64, and
+// missing details become an empty object.
+func copyAuditEvent(event *AuditEvent) (*AuditEvent, error) {
+	details, err := json.Marshal(event.Details)
+	if err != nil {
+		return nil, err
+	}
+	if event.Details == nil {
+		details = []byte("{}")
+	}
+
+	c := *event
+	if event.ActorID != nil {
+		actorID := *event.ActorID
+		c.ActorID = &actorID
+	}
+	c.Details = nil
+	err = json.Unmarshal(details, &c.Details)
+	if err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
@@ -0,0 +1,315 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func insertTestUser(t *testing.T, models Models, email string) *User {
+	t.Helper()
+
+	user := &User{Name: "Test", Email: email, Activated: true}
+	user.Password.hash = []byte("hash")
+	err := models.Users.Insert(context.Background(), user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return user
+}
+
+func TestMemoryMovieVersionConflict(t *testing.T) {
+	ctx := context.Background()
+	models := NewMemoryStore().Models()
+
+	movie := &Movie{Title: "Moana", Year: 2016, Runtime: 107, Genres: []string{"animation"}}
+	err := models.Movies.Insert(ctx, movie)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first, err := models.Movies.Get(ctx, movie.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := models.Movies.Get(ctx, movie.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first.Title = "Moana 2"
+	err = models.Movies.Update(ctx, first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.Version != 2 {
+		t.Errorf("got version %d after update; want 2", first.Version)
+	}
+
+	second.Year = 2024
+	err = models.Movies.Update(ctx, second)
+	if !errors.Is(err, ErrEditConflict) {
+		t.Errorf("got %v updating a stale movie; want ErrEditConflict", err)
+	}
+
+	stored, err := models.Movies.Get(ctx, movie.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.Title != "Moana 2" || stored.Year != 2016 {
+		t.Errorf("got %q (%d); want the first update only", stored.Title, stored.Year)
+	}
+}
+
+func TestMemoryUserVersionConflict(t *testing.T) {
+	ctx := context.Background()
+	models := NewMemoryStore().Models()
+	user := insertTestUser(t, models, "alice@example.com")
+
+	stale, err := models.Users.Get(ctx, user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	user.Name = "Alice"
+	err = models.Users.Update(ctx, user)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stale.Name = "Bob"
+	err = models.Users.Update(ctx, stale)
+	if !errors.Is(err, ErrEditConflict) {
+		t.Errorf("got %v updating a stale user; want ErrEditConflict", err)
+	}
+}
+
+func TestMemoryDuplicateEmail(t *testing.T) {
+	ctx := context.Background()
+	models := NewMemoryStore().Models()
+	insertTestUser(t, models, "alice@example.com")
+	bob := insertTestUser(t, models, "bob@example.com")
+
+	tests := []struct {
+		name string
+		fn   func() error
+	}{
+		{"insert", func() error {
+			user := &User{Name: "Alice", Email: "alice@example.com"}
+			return models.Users.Insert(ctx, user)
+		}},
+		{"insert with another case", func() error {
+			user := &User{Name: "Alice", Email: "ALICE@Example.com"}
+			return models.Users.Insert(ctx, user)
+		}},
+		{"update", func() error {
+			bob.Email = "Alice@example.com"
+			return models.Users.Update(ctx, bob)
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.fn()
+			if !errors.Is(err, ErrDuplicateEmail) {
+				t.Errorf("got %v; want ErrDuplicateEmail", err)
+			}
+		})
+	}
+}
+
+func TestMemoryRecordNotFound(t *testing.T) {
+	ctx := context.Background()
+	models := NewMemoryStore().Models()
+	user := insertTestUser(t, models, "alice@example.com")
+
+	expired, err := models.Tokens.New(ctx, user.ID, -time.Minute, ScopeAuthentication)
+	if err != nil {
+		t.Fatal(err)
+	}
+	activation, err := models.Tokens.New(ctx, user.ID, time.Hour, ScopeActivation)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		fn   func() error
+	}{
+		{"get movie", func() error {
+			_, err := models.Movies.Get(ctx, 1)
+			return err
+		}},
+		{"delete movie", func() error {
+			return models.Movies.Delete(ctx, 1)
+		}},
+		{"get user", func() error {
+			_, err := models.Users.Get(ctx, user.ID+1)
+			return err
+		}},
+		{"get user by email", func() error {
+			_, err := models.Users.GetByEmail(ctx, "bob@example.com")
+			return err
+		}},
+		{"get user for an expired token", func() error {
+			_, err := models.Users.GetForToken(ctx, ScopeAuthentication, expired.Plaintext)
+			return err
+		}},
+		{"get user for a token of another scope", func() error {
+			_, err := models.Users.GetForToken(ctx, ScopeAuthentication, activation.Plaintext)
+			return err
+		}},
+		{"get refresh token", func() error {
+			_, err := models.Tokens.GetRefresh(ctx, activation.Plaintext)
+			return err
+		}},
+		{"delete session of another user", func() error {
+			return models.Tokens.DeleteSessionForUser(ctx, 1, user.ID+1)
+		}},
+		{"get totp", func() error {
+			_, err := models.TOTP.Get(ctx, user.ID)
+			return err
+		}},
+		{"use unknown recovery code", func() error {
+			return models.TOTP.UseRecoveryCode(ctx, user.ID, "abcd-efgh")
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.fn()
+			if !errors.Is(err, ErrRecordNotFound) {
+				t.Errorf("got %v; want ErrRecordNotFound", err)
+			}
+		})
+	}
+}
+
+func TestMemoryPermissionsFromRoles(t *testing.T) {
+	ctx := context.Background()
+	models := NewMemoryStore().Models()
+	user := insertTestUser(t, models, "alice@example.com")
+
+	err := models.Roles.AddForUser(ctx, user.ID, "viewer", "editor", "unknown")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	roles, err := models.Roles.GetAllForUser(ctx, user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(roles) != 2 || roles[0] != "viewer" || roles[1] != "editor" {
+		t.Errorf("got roles %v; want [viewer editor]", roles)
+	}
+
+	permissions, err := models.Permissions.GetAllForUser(ctx, user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(permissions) != 2 || !permissions.Include("movies:read") || !permissions.Include("movies:write") {
+		t.Errorf("got permissions %v; want movies:read and movies:write", permissions)
+	}
+
+	err = models.Roles.SetForUser(ctx, user.ID, "viewer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	permissions, err = models.Permissions.GetAllForUser(ctx, user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if permissions.Include("movies:write") {
+		t.Errorf("got permissions %v after SetForUser(viewer); want movies:read only", permissions)
+	}
+}
+
+func TestMemoryTOTP(t *testing.T) {
+	ctx := context.Background()
+	models := NewMemoryStore().Models()
+	user := insertTestUser(t, models, "alice@example.com")
+
+	err := models.TOTP.Upsert(ctx, &TOTP{UserID: user.ID, Secret: []byte("secret")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = models.TOTP.Confirm(ctx, user.ID, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = models.TOTP.Upsert(ctx, &TOTP{UserID: user.ID, Secret: []byte("other")})
+	if !errors.Is(err, ErrEditConflict) {
+		t.Errorf("got %v overwriting a confirmed enrollment; want ErrEditConflict", err)
+	}
+	err = models.TOTP.UseCounter(ctx, user.ID, 10)
+	if !errors.Is(err, ErrEditConflict) {
+		t.Errorf("got %v replaying a counter; want ErrEditConflict", err)
+	}
+	err = models.TOTP.UseCounter(ctx, user.ID, 11)
+	if err != nil {
+		t.Errorf("got %v using a new counter; want nil", err)
+	}
+
+	codes, err := models.TOTP.NewRecoveryCodes(ctx, user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = models.TOTP.UseRecoveryCode(ctx, user.ID, " "+codes[0]+" ")
+	if err != nil {
+		t.Errorf("got %v using a recovery code; want nil", err)
+	}
+	err = models.TOTP.UseRecoveryCode(ctx, user.ID, codes[0])
+	if !errors.Is(err, ErrRecordNotFound) {
+		t.Errorf("got %v reusing a recovery code; want ErrRecordNotFound", err)
+	}
+}
+
+func TestMemoryAudit(t *testing.T) {
+	ctx := context.Background()
+	models := NewMemoryStore().Models()
+
+	actorID := int64(1)
+	for _, action := range []string{AuditLogin, AuditMovieCreate, AuditMovieUpdate} {
+		event := &AuditEvent{ActorID: &actorID, Action: action, Outcome: AuditSuccess, Details: map[string]interface{}{"count": 1}}
+		err := models.Audit.Insert(ctx, event)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	filters := Filters{Page: 1, PageSize: 2, Sort: "-id", SortSafelist: []string{"id", "-id"}}
+	events, metadata, err := models.Audit.GetAll(ctx, AuditFilters{ActorID: actorID}, filters)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if metadata.TotalRecords != 3 || len(events) != 2 {
+		t.Fatalf("got %d of %d events; want 2 of 3", len(events), metadata.TotalRecords)
+	}
+	if events[0].Action != AuditMovieUpdate || events[1].Action != AuditMovieCreate {
+		t.Errorf("got %s, %s; want the newest events first", events[0].Action, events[1].Action)
+	}
+	// Details read back as they do from the jsonb column.
+	if events[0].Details["count"] != float64(1) {
+		t.Errorf("got details %v; want count 1 as a float64", events[0].Details)
+	}
+
+	events, _, err = models.Audit.GetAll(ctx, AuditFilters{Action: AuditLogin}, filters)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 || events[0].Action != AuditLogin {
+		t.Errorf("got %v; want the login event only", events)
+	}
+}
+
+func TestMemoryCanceledContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err := NewMemoryStore().Models().Movies.Get(ctx, 1)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("got %v; want context.Canceled", err)
+	}
+}
@@ -1,8 +1,10 @@
 package data
 
 import (
+	"context"
 	"database/sql"
 	"errors"
+	"time"
 )
 
 // Define a custom ErrRecordNotFound error. We'll return this from our Get() method when
@@ -12,22 +14,130 @@ var (
 	ErrEditConflict   = errors.New("edit conflict")
 )
 
+// MovieRepository stores movies. It is implemented by MovieModel on top of Postgres,
+// and by the in-memory store of NewMemoryStore().
+type MovieRepository interface {
+	Insert(ctx context.Context, movie *Movie) error
+	Get(ctx context.Context, id int64) (*Movie, error)
+	Update(ctx context.Context, movie *Movie) error
+	Delete(ctx context.Context, id int64) error
+	GetAll(ctx context.Context, title string, genres []string, filters Filters) ([]*Movie, Metadata, error)
+}
+
+// UserRepository stores users. It is implemented by UserModel and the in-memory store.
+type UserRepository interface {
+	Insert(ctx context.Context, user *User) error
+	Get(ctx context.Context, id int64) (*User, error)
+	GetByEmail(ctx context.Context, email string) (*User, error)
+	Update(ctx context.Context, user *User) error
+	GetForToken(ctx context.Context, tokenScope, tokenPlaintext string) (*User, error)
+}
+
+// TokenRepository stores the tokens of every scope, including the sessions made of
+// authentication and refresh tokens. It is implemented by TokenModel and the in-memory
+// store.
+type TokenRepository interface {
+	New(ctx context.Context, userID int64, ttl time.Duration, scope string) (*Token, error)
+	NewSession(ctx context.Context, userID int64, ttl time.Duration, ip, userAgent string) (*Token, error)
+	NewRefresh(ctx context.Context, userID int64, ttl time.Duration, family, ip, userAgent string) (*Token, error)
+	Insert(ctx context.Context, token *Token) error
+	DeleteAllForUser(ctx context.Context, scope string, userID int64) error
+	DeleteForPlaintext(ctx context.Context, scope, tokenPlaintext string) error
+	Touch(ctx context.Context, tokenPlaintext string) error
+	GetSessionsForUser(ctx context.Context, userID int64, currentPlaintext string) ([]*Session, error)
+	DeleteSessionForUser(ctx context.Context, id, userID int64) error
+	DeleteAllSessionsForUser(ctx context.Context, userID int64) error
+	GetRefresh(ctx context.Context, tokenPlaintext string) (*Token, error)
+	MarkUsed(ctx context.Context, token *Token) error
+	DeleteFamily(ctx context.Context, family string) error
+}
+
+// PermissionRepository resolves the permissions users hold through their roles and
+// subscriptions. It is implemented by PermissionModel and the in-memory store.
+type PermissionRepository interface {
+	GetAllForUser(ctx context.Context, userID int64) (Permissions, error)
+}
+
+// RoleRepository stores the roles granted to users. It is implemented by RoleModel and
+// the in-memory store.
+type RoleRepository interface {
+	GetAll(ctx context.Context) (Roles, error)
+	GetAllForUser(ctx context.Context, userID int64) (Roles, error)
+	AddForUser(ctx context.Context, userID int64, codes ...string) error
+	RemoveForUser(ctx context.Context, userID int64, codes ...string) error
+	SetForUser(ctx context.Context, userID int64, codes ...string) error
+}
+
+// TOTPRepository stores two-factor authentication enrollments and recovery codes. It
+// is implemented by TOTPModel and the in-memory store.
+type TOTPRepository interface {
+	Get(ctx context.Context, userID int64) (*TOTP, error)
+	Upsert(ctx context.Context, totp *TOTP) error
+	Confirm(ctx context.Context, userID, counter int64) error
+	UseCounter(ctx context.Context, userID, counter int64) error
+	Delete(ctx context.Context, userID int64) error
+	NewRecoveryCodes(ctx context.Context, userID int64) ([]string, error)
+	UseRecoveryCode(ctx context.Context, userID int64, code string) error
+}
+
+// AuditRepository stores the audit log. It is implemented by AuditModel and the
+// in-memory store.
+type AuditRepository interface {
+	Insert(ctx context.Context, event *AuditEvent) error
+	GetAll(ctx context.Context, audit AuditFilters, filters Filters) ([]*AuditEvent, Metadata, error)
+}
+
 // Create a Models struct which wraps the MovieModel. We'll add other models to this,
-// like a UserModel and PermissionModel, as our build progresses.
+// like a UserModel and PermissionModel, as our build progresses. The movies, users,
+// tokens, permissions, roles, TOTP enrollments and audit log are accessed through
+// interfaces, so that handlers can run against the in-memory store instead of Postgres.
 type Models struct {
-	Movies      MovieModel
-	Users       UserModel
-	Tokens      TokenModel
-	Permissions PermissionModel
+	Movies        MovieRepository
+	Users         UserRepository
+	Tokens        TokenRepository
+	Permissions   PermissionRepository
+	Roles         RoleRepository
+	APIKeys       APIKeyModel
+	SigningKeys   SigningKeyModel
+	TOTP          TOTPRepository
+	Identities    IdentityModel
+	OAuthClients  OAuthClientModel
+	OAuthTokens   OAuthTokenModel
+	Plans         PlanModel
+	Subscriptions SubscriptionModel
+	Audit         AuditRepository
+	Schema        SchemaModel
 }
 
 // For ease of use, we also add a New() method which returns a Models struct containing
-// the initialized MovieModel.
-func NewModels(db *sql.DB) Models {
+// the initialized MovieModel. Each query is bounded by queryTimeout, or only by the
+// deadline of the context it is given when queryTimeout is 0.
+func NewModels(db *sql.DB, queryTimeout time.Duration) Models {
 	return Models{
-		Movies:      MovieModel{DB: db},
-		Users:       UserModel{DB: db},
-		Tokens:      TokenModel{DB: db},
-		Permissions: PermissionModel{DB: db},
+		Movies:        MovieModel{DB: db, Timeout: queryTimeout},
+		Users:         UserModel{DB: db, Timeout: queryTimeout},
+		Tokens:        TokenModel{DB: db, Timeout: queryTimeout},
+		Permissions:   PermissionModel{DB: db, Timeout: queryTimeout},
+		Roles:         RoleModel{DB: db, Timeout: queryTimeout},
+		APIKeys:       APIKeyModel{DB: db, Timeout: queryTimeout},
+		SigningKeys:   SigningKeyModel{DB: db, Timeout: queryTimeout},
+		TOTP:          TOTPModel{DB: db, Timeout: queryTimeout},
+		Identities:    IdentityModel{DB: db, Timeout: queryTimeout},
+		OAuthClients:  OAuthClientModel{DB: db, Timeout: queryTimeout},
+		OAuthTokens:   OAuthTokenModel{DB: db, Timeout: queryTimeout},
+		Plans:         PlanModel{DB: db, Timeout: queryTimeout},
+		Subscriptions: SubscriptionModel{DB: db, Timeout: queryTimeout},
+		Audit:         AuditModel{DB: db, Timeout: queryTimeout},
+		Schema:        SchemaModel{DB: db},
+	}
+}
+
+// withTimeout() returns the context a query runs with: the caller's context, so that
+// the query is canceled with the request it serves, shortened to the model's timeout
+// when it has one.
+func withTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
 	}
+	return context.WithTimeout(ctx, timeout)
 }
@@ -13,7 +13,8 @@ import (
 
 // Define a MovieModel struct type which wraps a sql.DB connection pool.
 type MovieModel struct {
-	DB *sql.DB
+	DB      *sql.DB
+	Timeout time.Duration
 }
 
 type Movie struct {
@@ -41,7 +42,10 @@ func ValidateMovie(v *validator.Validator, movie *Movie) {
 }
 
 // Add a placeholder method for inserting a new record in the movies table.
-func (m MovieModel) Insert(movie *Movie) error {
+func (m MovieModel) Insert(ctx context.Context, movie *Movie) error {
+	ctx, span := startSpan(ctx, "MovieModel.Insert")
+	defer span.End()
+
 	// Define the SQL query for inserting a new record in the movies table and returning
 	// the system-generated data.
 	query := `
@@ -53,14 +57,17 @@ func (m MovieModel) Insert(movie *Movie) error {
 	// make it nice and clear *what values are being used where* in the query.
 	args := []interface{}{movie.Title, movie.Year, movie.Runtime, pq.Array(movie.Genres)}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := withTimeout(ctx, m.Timeout)
 	defer cancel()
 
 	return m.DB.QueryRowContext(ctx, query, args...).Scan(&movie.ID, &movie.CreatedAt, &movie.Version)
 }
 
 // Add a placeholder method for fetching a specific record from the movies table.
-func (m MovieModel) Get(id int64) (*Movie, error) {
+func (m MovieModel) Get(ctx context.Context, id int64) (*Movie, error) {
+	ctx, span := startSpan(ctx, "MovieModel.Get")
+	defer span.End()
+
 	// The PostgreSQL bigserial type that we're using for the movie ID starts
 	// auto-incrementing at 1 by default, so we know that no movies will have ID values
 	// less than that. To avoid making an unnecessary database call, we take a shortcut
@@ -76,10 +83,10 @@ func (m MovieModel) Get(id int64) (*Movie, error) {
 	// Declare a Movie struct to hold the data returned by the query.
 	var movie Movie
 
-	// Use the context.WithTimeout() function to create a context.Context which carries a
-	// 3-second timeout deadline. Note that we're using the empty context.Background()
-	// as the 'parent' context.
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	// Use the withTimeout() helper to derive a context.Context from the request's one,
+	// which carries the model's timeout deadline. The query is therefore canceled when
+	// the client goes away or the server shuts down, as well as when it takes too long.
+	ctx, cancel := withTimeout(ctx, m.Timeout)
 	// Importantly, use defer to make sure that we cancel the context before the Get()
 	// method returns.
 	defer cancel()
@@ -113,7 +120,10 @@ func (m MovieModel) Get(id int64) (*Movie, error) {
 }
 
 // Add a placeholder method for updating a specific record in the movies table.
-func (m MovieModel) Update(movie *Movie) error {
+func (m MovieModel) Update(ctx context.Context, movie *Movie) error {
+	ctx, span := startSpan(ctx, "MovieModel.Update")
+	defer span.End()
+
 	// Declare the SQL query for updating the record and returning the new version
 	// number.
 	query := `
@@ -131,7 +141,7 @@ func (m MovieModel) Update(movie *Movie) error {
 		movie.Version,
 	}
 	// Create a context with a 3-second timeout.
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := withTimeout(ctx, m.Timeout)
 	defer cancel()
 	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&movie.Version)
 	if err != nil {
@@ -146,7 +156,10 @@ func (m MovieModel) Update(movie *Movie) error {
 }
 
 // Add a placeholder method for deleting a specific record from the movies table.
-func (m MovieModel) Delete(id int64) error {
+func (m MovieModel) Delete(ctx context.Context, id int64) error {
+	ctx, span := startSpan(ctx, "MovieModel.Delete")
+	defer span.End()
+
 	// Return an ErrRecordNotFound error if the movie ID is less than 1.
 	if id < 1 {
 		return ErrRecordNotFound
@@ -160,7 +173,7 @@ func (m MovieModel) Delete(id int64) error {
 	// object.
 
 	// Create a context with a 3-second timeout.
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := withTimeout(ctx, m.Timeout)
 	defer cancel()
 	result, err := m.DB.ExecContext(ctx, query, id)
 	if err != nil {
@@ -184,7 +197,10 @@ func (m MovieModel) Delete(id int64) error {
 // Create a new GetAll() method which returns a slice of movies. Although we're not
 // using them right now, we've set this up to accept the various filter parameters as
 // arguments.
-func (m MovieModel) GetAll(title string, genres []string, filters Filters) ([]*Movie, Metadata, error) {
+func (m MovieModel) GetAll(ctx context.Context, title string, genres []string, filters Filters) ([]*Movie, Metadata, error) {
+	ctx, span := startSpan(ctx, "MovieModel.GetAll")
+	defer span.End()
+
 	// Construct the SQL query to retrieve all movie records.
 	query := fmt.Sprintf(`
 		SELECT count(*) OVER(), id, created_at, title, year, runtime, genres, version
@@ -195,7 +211,7 @@ func (m MovieModel) GetAll(title string, genres []string, filters Filters) ([]*M
 		LIMIT $3 OFFSET $4`, filters.sortColumn(), filters.sortDirection())
 
 	// Create a context with a 3-second timeout.
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := withTimeout(ctx, m.Timeout)
 	defer cancel()
 
 	args := []interface{}{title, pq.Array(genres), filters.limit(), filters.offset()}
@@ -0,0 +1,496 @@
+package data
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base32"
+	"errors"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/henrtytanoh/greenlight/internal/validator"
+	"github.com/lib/pq"
+)
+
+// Like API keys, every OAuth credential has a prefix telling what it is. The prefix of
+// access tokens is also how the authenticate middleware tells them apart from our own
+// tokens.
+const (
+	OAuthClientIDPrefix     = "glc_"
+	OAuthClientSecretPrefix = "gls_"
+	OAuthCodePrefix         = "glo_"
+	OAuthAccessTokenPrefix  = "gla_"
+	OAuthRefreshTokenPrefix = "glr_"
+)
+
+// Kinds of OAuth tokens.
+const (
+	OAuthKindAccess  = "access"
+	OAuthKindRefresh = "refresh"
+)
+
+// OAuthScopes are the permissions that third-party apps may be granted. A scope has the
+// same name as the permission it grants; admin permissions are deliberately left out.
+var OAuthScopes = Permissions{"movies:read", "movies:write"}
+
+// OAuthClient is a third-party app registered by a user. Confidential clients, which
+// run on a server, authenticate with a secret; public clients, such as mobile apps,
+// have none and rely on PKCE alone.
+type OAuthClient struct {
+	ID           string      `json:"client_id"`
+	Secret       string      `json:"client_secret,omitempty"`
+	SecretHash   []byte      `json:"-"`
+	UserID       int64       `json:"-"`
+	Name         string      `json:"name"`
+	RedirectURIs []string    `json:"redirect_uris"`
+	Scopes       Permissions `json:"scopes"`
+	Confidential bool        `json:"confidential"`
+	CreatedAt    time.Time   `json:"created_at"`
+}
+
+// OAuthCode is an authorization code, handed to the client through the user's browser
+// and redeemed once at the token endpoint.
+type OAuthCode struct {
+	Plaintext     string
+	Hash          []byte
+	ClientID      string
+	UserID        int64
+	RedirectURI   string
+	Scopes        Permissions
+	CodeChallenge string
+	Expiry        time.Time
+}
+
+// OAuthToken is an access or refresh token issued to a client, acting on behalf of a
+// user within the granted scopes.
+type OAuthToken struct {
+	Plaintext string
+	Hash      []byte
+	Kind      string
+	ClientID  string
+	UserID    int64
+	Scopes    Permissions
+	Expiry    time.Time
+}
+
+func randomCredential(prefix string, size int) (string, []byte, error) {
+	randomBytes := make([]byte, size)
+	_, err := rand.Read(randomBytes)
+	if err != nil {
+		return "", nil, err
+	}
+	plaintext := prefix + base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(randomBytes)
+	hash := sha256.Sum256([]byte(plaintext))
+	return plaintext, hash[:], nil
+}
+
+// ValidateOAuthClient checks a client registration. Redirect URIs must be absolute and
+// use https, except on the loopback interface where http is allowed for development
+// and native apps.
+func ValidateOAuthClient(v *validator.Validator, client *OAuthClient) {
+	v.Check(client.Name != "", "name", "must be provided")
+	v.Check(len(client.Name) <= 100, "name", "must not be more than 100 bytes long")
+
+	v.Check(len(client.RedirectURIs) >= 1, "redirect_uris", "must contain at least 1 URI")
+	v.Check(len(client.RedirectURIs) <= 10, "redirect_uris", "must not contain more than 10 URIs")
+	for _, uri := range client.RedirectURIs {
+		u, err := url.Parse(uri)
+		if err != nil || !u.IsAbs() || u.Fragment != "" {
+			v.AddError("redirect_uris", "must only contain absolute URIs without a fragment")
+			continue
+		}
+		loopback := u.Hostname() == "localhost" || u.Hostname() == "127.0.0.1" || u.Hostname() == "::1"
+		v.Check(u.Scheme == "https" || (u.Scheme == "http" && loopback), "redirect_uris", "must use https")
+	}
+
+	v.Check(len(client.Scopes) >= 1, "scopes", "must contain at least 1 scope")
+	v.Check(validator.Unique(client.Scopes), "scopes", "must not contain duplicate values")
+	for _, scope := range client.Scopes {
+		v.Check(OAuthScopes.Include(scope), "scopes", "must only contain "+strings.Join(OAuthScopes, ", "))
+	}
+}
+
+// Check that the plaintext OAuth credential has the expected prefix and length.
+func ValidateOAuthPlaintext(v *validator.Validator, key, plaintext, prefix string) {
+	v.Check(plaintext != "", key, "must be provided")
+	v.Check(strings.HasPrefix(plaintext, prefix), key, "is not valid")
+	v.Check(len(plaintext) == 56, key, "must be 56 bytes long")
+}
+
+// Authenticate reports whether the secret belongs to the client. Public clients have
+// no secret, so it always fails for them.
+func (c *OAuthClient) Authenticate(secret string) bool {
+	if !c.Confidential {
+		return false
+	}
+	hash := sha256.Sum256([]byte(secret))
+	return subtle.ConstantTimeCompare(hash[:], c.SecretHash) == 1
+}
+
+// Define the OAuthClientModel type.
+type OAuthClientModel struct {
+	DB      *sql.DB
+	Timeout time.Duration
+}
+
+// New() registers a client. Its secret, if it has one, is only available in plaintext on
+// the returned client.
+func (m OAuthClientModel) New(ctx context.Context, client *OAuthClient) error {
+	ctx, span := startSpan(ctx, "OAuthClientModel.New")
+	defer span.End()
+
+	id, _, err := randomCredential(OAuthClientIDPrefix, 20)
+	if err != nil {
+		return err
+	}
+	client.ID = id
+
+	if client.Confidential {
+		client.Secret, client.SecretHash, err = randomCredential(OAuthClientSecretPrefix, 32)
+		if err != nil {
+			return err
+		}
+	}
+
+	query := `
+		INSERT INTO oauth_clients (id, secret_hash, user_id, name, redirect_uris, scopes)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING created_at`
+	args := []interface{}{
+		client.ID,
+		client.SecretHash,
+		client.UserID,
+		client.Name,
+		pq.Array(client.RedirectURIs),
+		pq.Array([]string(client.Scopes)),
+	}
+	ctx, cancel := withTimeout(ctx, m.Timeout)
+	defer cancel()
+	return m.DB.QueryRowContext(ctx, query, args...).Scan(&client.CreatedAt)
+}
+
+func (m OAuthClientModel) Get(ctx context.Context, id string) (*OAuthClient, error) {
+	ctx, span := startSpan(ctx, "OAuthClientModel.Get")
+	defer span.End()
+
+	query := `
+		SELECT id, secret_hash, user_id, name, redirect_uris, scopes, created_at
+		FROM oauth_clients
+		WHERE id = $1`
+	ctx, cancel := withTimeout(ctx, m.Timeout)
+	defer cancel()
+	client, err := scanOAuthClient(m.DB.QueryRowContext(ctx, query, id))
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return client, nil
+}
+
+// GetAllForUser() returns the clients registered by a user.
+func (m OAuthClientModel) GetAllForUser(ctx context.Context, userID int64) ([]*OAuthClient, error) {
+	ctx, span := startSpan(ctx, "OAuthClientModel.GetAllForUser")
+	defer span.End()
+
+	query := `
+		SELECT id, secret_hash, user_id, name, redirect_uris, scopes, created_at
+		FROM oauth_clients
+		WHERE user_id = $1
+		ORDER BY created_at, id`
+	return m.query(ctx, query, userID)
+}
+
+// GetAuthorizedForUser() returns the clients which currently hold tokens for a user,
+// i.e. the apps the user has granted access to their account.
+func (m OAuthClientModel) GetAuthorizedForUser(ctx context.Context, userID int64) ([]*OAuthClient, error) {
+	ctx, span := startSpan(ctx, "OAuthClientModel.GetAuthorizedForUser")
+	defer span.End()
+
+	query := `
+		SELECT id, secret_hash, user_id, name, redirect_uris, scopes, created_at
+		FROM oauth_clients
+		WHERE id IN (
+			SELECT client_id FROM oauth_tokens WHERE user_id = $1 AND expiry > NOW()
+		)
+		ORDER BY name, id`
+	return m.query(ctx, query, userID)
+}
+
+// DeleteForUser() deletes a client registered by the user, together with every code and
+// token issued to it.
+func (m OAuthClientModel) DeleteForUser(ctx context.Context, id string, userID int64) error {
+	ctx, span := startSpan(ctx, "OAuthClientModel.DeleteForUser")
+	defer span.End()
+
+	query := `
+		DELETE FROM oauth_clients
+		WHERE id = $1 AND user_id = $2`
+	ctx, cancel := withTimeout(ctx, m.Timeout)
+	defer cancel()
+	result, err := m.DB.ExecContext(ctx, query, id, userID)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+	return nil
+}
+
+func (m OAuthClientModel) query(ctx context.Context, query string, args ...interface{}) ([]*OAuthClient, error) {
+	ctx, cancel := withTimeout(ctx, m.Timeout)
+	defer cancel()
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	clients := []*OAuthClient{}
+	for rows.Next() {
+		client, err := scanOAuthClient(rows)
+		if err != nil {
+			return nil, err
+		}
+		clients = append(clients, client)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return clients, nil
+}
+
+func scanOAuthClient(row interface{ Scan(...interface{}) error }) (*OAuthClient, error) {
+	var client OAuthClient
+	err := row.Scan(
+		&client.ID,
+		&client.SecretHash,
+		&client.UserID,
+		&client.Name,
+		pq.Array(&client.RedirectURIs),
+		pq.Array((*[]string)(&client.Scopes)),
+		&client.CreatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	client.Confidential = client.SecretHash != nil
+	return &client, nil
+}
+
+// Define the OAuthTokenModel type, which handles both authorization codes and tokens.
+type OAuthTokenModel struct {
+	DB      *sql.DB
+	Timeout time.Duration
+}
+
+// NewCode() creates an authorization code once the user has consented.
+func (m OAuthTokenModel) NewCode(ctx context.Context, code *OAuthCode, ttl time.Duration) error {
+	ctx, span := startSpan(ctx, "OAuthTokenModel.NewCode")
+	defer span.End()
+
+	var err error
+	code.Plaintext, code.Hash, err = randomCredential(OAuthCodePrefix, 32)
+	if err != nil {
+		return err
+	}
+	code.Expiry = time.Now().Add(ttl)
+
+	query := `
+		INSERT INTO oauth_codes (hash, client_id, user_id, redirect_uri, scopes, code_challenge, expiry)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)`
+	args := []interface{}{
+		code.Hash,
+		code.ClientID,
+		code.UserID,
+		code.RedirectURI,
+		pq.Array([]string(code.Scopes)),
+		code.CodeChallenge,
+		code.Expiry,
+	}
+	ctx, cancel := withTimeout(ctx, m.Timeout)
+	defer cancel()
+	_, err = m.DB.ExecContext(ctx, query, args...)
+	return err
+}
+
+// ConsumeCode() deletes an unexpired code and returns it, so that a code can only ever
+// be redeemed once.
+func (m OAuthTokenModel) ConsumeCode(ctx context.Context, plaintext string) (*OAuthCode, error) {
+	ctx, span := startSpan(ctx, "OAuthTokenModel.ConsumeCode")
+	defer span.End()
+
+	hash := sha256.Sum256([]byte(plaintext))
+	query := `
+		DELETE FROM oauth_codes
+		WHERE hash = $1
+		RETURNING client_id, user_id, redirect_uri, scopes, code_challenge, expiry`
+	code := OAuthCode{Plaintext: plaintext, Hash: hash[:]}
+	ctx, cancel := withTimeout(ctx, m.Timeout)
+	defer cancel()
+	err := m.DB.QueryRowContext(ctx, query, hash[:]).Scan(
+		&code.ClientID,
+		&code.UserID,
+		&code.RedirectURI,
+		pq.Array((*[]string)(&code.Scopes)),
+		&code.CodeChallenge,
+		&code.Expiry,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	if time.Now().After(code.Expiry) {
+		return nil, ErrRecordNotFound
+	}
+	return &code, nil
+}
+
+// New() issues an access or refresh token to a client.
+func (m OAuthTokenModel) New(ctx context.Context, kind, clientID string, userID int64, scopes Permissions, ttl time.Duration) (*OAuthToken, error) {
+	ctx, span := startSpan(ctx, "OAuthTokenModel.New")
+	defer span.End()
+
+	prefix := OAuthAccessTokenPrefix
+	if kind == OAuthKindRefresh {
+		prefix = OAuthRefreshTokenPrefix
+	}
+	plaintext, hash, err := randomCredential(prefix, 32)
+	if err != nil {
+		return nil, err
+	}
+	token := &OAuthToken{
+		Plaintext: plaintext,
+		Hash:      hash,
+		Kind:      kind,
+		ClientID:  clientID,
+		UserID:    userID,
+		Scopes:    scopes,
+		Expiry:    time.Now().Add(ttl),
+	}
+
+	query := `
+		INSERT INTO oauth_tokens (hash, kind, client_id, user_id, scopes, expiry)
+		VALUES ($1, $2, $3, $4, $5, $6)`
+	args := []interface{}{token.Hash, token.Kind, token.ClientID, token.UserID, pq.Array([]string(token.Scopes)), token.Expiry}
+	ctx, cancel := withTimeout(ctx, m.Timeout)
+	defer cancel()
+	_, err = m.DB.ExecContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	return token, nil
+}
+
+// Get() looks up an unexpired token of the given kind.
+func (m OAuthTokenModel) Get(ctx context.Context, kind, plaintext string) (*OAuthToken, error) {
+	ctx, span := startSpan(ctx, "OAuthTokenModel.Get")
+	defer span.End()
+
+	query := `
+		SELECT kind, client_id, user_id, scopes, expiry
+		FROM oauth_tokens
+		WHERE hash = $1 AND kind = $2 AND expiry > NOW()`
+	return m.scan(ctx, query, kind, plaintext)
+}
+
+// Consume() deletes an unexpired token of the given kind and returns it. Refresh tokens
+// are consumed when they are used, so that each can only be used once.
+func (m OAuthTokenModel) Consume(ctx context.Context, kind, plaintext string) (*OAuthToken, error) {
+	ctx, span := startSpan(ctx, "OAuthTokenModel.Consume")
+	defer span.End()
+
+	query := `
+		DELETE FROM oauth_tokens
+		WHERE hash = $1 AND kind = $2 AND expiry > NOW()
+		RETURNING kind, client_id, user_id, scopes, expiry`
+	return m.scan(ctx, query, kind, plaintext)
+}
+
+// DeleteForClient() revokes a token, provided that it was issued to the given client.
+// Revoking a token that doesn't exist is not an error.
+func (m OAuthTokenModel) DeleteForClient(ctx context.Context, plaintext, clientID string) error {
+	ctx, span := startSpan(ctx, "OAuthTokenModel.DeleteForClient")
+	defer span.End()
+
+	hash := sha256.Sum256([]byte(plaintext))
+	query := `
+		DELETE FROM oauth_tokens
+		WHERE hash = $1 AND client_id = $2`
+	ctx, cancel := withTimeout(ctx, m.Timeout)
+	defer cancel()
+	_, err := m.DB.ExecContext(ctx, query, hash[:], clientID)
+	return err
+}
+
+// DeleteAllForUser() revokes every token issued to a client on behalf of a user.
+func (m OAuthTokenModel) DeleteAllForUser(ctx context.Context, clientID string, userID int64) error {
+	ctx, span := startSpan(ctx, "OAuthTokenModel.DeleteAllForUser")
+	defer span.End()
+
+	ctx, cancel := withTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `DELETE FROM oauth_codes WHERE client_id = $1 AND user_id = $2`, clientID, userID)
+	if err != nil {
+		return err
+	}
+	result, err := tx.ExecContext(ctx, `DELETE FROM oauth_tokens WHERE client_id = $1 AND user_id = $2`, clientID, userID)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+	return tx.Commit()
+}
+
+// scan() runs a query selecting a single token by hash and kind.
+func (m OAuthTokenModel) scan(ctx context.Context, query, kind, plaintext string) (*OAuthToken, error) {
+	hash := sha256.Sum256([]byte(plaintext))
+	token := OAuthToken{Plaintext: plaintext, Hash: hash[:]}
+	ctx, cancel := withTimeout(ctx, m.Timeout)
+	defer cancel()
+	err := m.DB.QueryRowContext(ctx, query, hash[:], kind).Scan(
+		&token.Kind,
+		&token.ClientID,
+		&token.UserID,
+		pq.Array((*[]string)(&token.Scopes)),
+		&token.Expiry,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &token, nil
+}
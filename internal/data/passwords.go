@@ -0,0 +1,174 @@
+package data
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	_ "embed"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/henrtytanoh/greenlight/internal/validator"
+)
+
+// The SHA-1 hashes of a few hundred of the most common passwords, used when no breached
+// password file is configured.
+//
+//go:embed common_passwords.txt
+var commonPasswords []byte
+
+// BreachedPasswords is a set of breached passwords, stored as SHA-1 hashes the same way
+// as the Pwned Passwords k-anonymity range API: hashes are grouped by their first five
+// hex characters, and a lookup only compares the remaining suffixes of one group.
+type BreachedPasswords struct {
+	ranges map[string][]string
+	count  int
+}
+
+// LoadBreachedPasswords reads a file of uppercase hex SHA-1 hashes, one per line. Each
+// hash may be followed by ":<count>", which is the format of the Pwned Passwords
+// downloads, so a trimmed copy of those can be used as is. Blank lines and lines
+// starting with # are ignored.
+func LoadBreachedPasswords(r io.Reader) (*BreachedPasswords, error) {
+	b := &BreachedPasswords{ranges: make(map[string][]string)}
+
+	scanner := bufio.NewScanner(r)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		hash, _, _ := strings.Cut(text, ":")
+		hash = strings.ToUpper(hash)
+		if len(hash) != sha1.Size*2 {
+			return nil, fmt.Errorf("breached passwords: line %d: invalid SHA-1 hash", line)
+		}
+		_, err := hex.DecodeString(hash)
+		if err != nil {
+			return nil, fmt.Errorf("breached passwords: line %d: invalid SHA-1 hash", line)
+		}
+		b.ranges[hash[:5]] = append(b.ranges[hash[:5]], hash[5:])
+		b.count++
+	}
+	err := scanner.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, suffixes := range b.ranges {
+		sort.Strings(suffixes)
+	}
+	return b, nil
+}
+
+// Len returns the number of hashes in the set.
+func (b *BreachedPasswords) Len() int {
+	return b.count
+}
+
+// Contains reports whether the password is in the set.
+func (b *BreachedPasswords) Contains(plaintextPassword string) bool {
+	sum := sha1.Sum([]byte(plaintextPassword))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+	suffixes := b.ranges[hash[:5]]
+	i := sort.SearchStrings(suffixes, hash[5:])
+	return i < len(suffixes) && suffixes[i] == hash[5:]
+}
+
+// PasswordPolicy decides whether a new password is acceptable. The user is the owner of
+// the password, which lets a policy reject passwords derived from their details; it is
+// nil when the owner isn't known.
+type PasswordPolicy interface {
+	Check(v *validator.Validator, plaintextPassword string, user *User)
+}
+
+// StandardPasswordPolicy rejects short passwords, passwords that don't mix enough kinds
+// of characters, passwords containing the user's name or email address, and breached
+// passwords.
+type StandardPasswordPolicy struct {
+	MinLength int
+	// The number of character classes (lowercase letters, uppercase letters, digits and
+	// symbols) a password has to contain. Zero disables the rule.
+	MinCharacterClasses int
+	Breached            *BreachedPasswords
+}
+
+// DefaultPasswordPolicy only screens passwords against the bundled list of common
+// passwords and the user's details.
+var DefaultPasswordPolicy = StandardPasswordPolicy{
+	MinLength: 8,
+	Breached:  mustLoadBreachedPasswords(commonPasswords),
+}
+
+// New passwords are checked against the current policy, see SetPasswordPolicy.
+var currentPolicy PasswordPolicy = DefaultPasswordPolicy
+
+// SetPasswordPolicy replaces the policy applied to new passwords. It should be called
+// once at startup, before any request is served.
+func SetPasswordPolicy(p PasswordPolicy) {
+	currentPolicy = p
+}
+
+func (p StandardPasswordPolicy) Check(v *validator.Validator, plaintextPassword string, user *User) {
+	v.Check(len(plaintextPassword) >= p.MinLength, "password", fmt.Sprintf("must be at least %d bytes long", p.MinLength))
+	v.Check(characterClasses(plaintextPassword) >= p.MinCharacterClasses, "password",
+		fmt.Sprintf("must contain at least %d of: lowercase letters, uppercase letters, digits and symbols", p.MinCharacterClasses))
+	if user != nil {
+		v.Check(!containsUserDetails(plaintextPassword, user), "password", "must not contain your name or email address")
+	}
+	if p.Breached != nil {
+		v.Check(!p.Breached.Contains(plaintextPassword), "password", "must not be a common or breached password")
+	}
+}
+
+func characterClasses(password string) int {
+	var lower, upper, digit, symbol int
+	for _, r := range password {
+		switch {
+		case unicode.IsLower(r):
+			lower = 1
+		case unicode.IsUpper(r):
+			upper = 1
+		case unicode.IsDigit(r):
+			digit = 1
+		default:
+			symbol = 1
+		}
+	}
+	return lower + upper + digit + symbol
+}
+
+// containsUserDetails() reports whether the password contains the user's email address
+// or any word of at least three characters from their name or the local part of their
+// email address, ignoring case.
+func containsUserDetails(password string, user *User) bool {
+	password = strings.ToLower(password)
+	notAlphanumeric := func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	}
+
+	local, _, _ := strings.Cut(strings.ToLower(user.Email), "@")
+	words := append(strings.FieldsFunc(strings.ToLower(user.Name), notAlphanumeric), local)
+	words = append(words, strings.FieldsFunc(local, notAlphanumeric)...)
+
+	for _, word := range words {
+		if len(word) >= 3 && strings.Contains(password, word) {
+			return true
+		}
+	}
+	return false
+}
+
+func mustLoadBreachedPasswords(hashes []byte) *BreachedPasswords {
+	b, err := LoadBreachedPasswords(bytes.NewReader(hashes))
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
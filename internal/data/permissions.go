@@ -4,8 +4,6 @@ import (
 	"context"
 	"database/sql"
 	"time"
-
-	"github.com/lib/pq"
 )
 
 type Permissions []string
@@ -21,21 +19,35 @@ func (p Permissions) Include(code string) bool {
 
 // Define the PermissionModel type.
 type PermissionModel struct {
-	DB *sql.DB
+	DB      *sql.DB
+	Timeout time.Duration
 }
 
 // The GetAllForUser() method returns all permission codes for a specific user in a
-// Permissions slice. The code in this method should feel very familiar --- it uses the
-// standard pattern that we've already seen before for retrieving multiple data rows in
-// an SQL query.
-func (m PermissionModel) GetAllForUser(userID int64) (Permissions, error) {
+// Permissions slice. Users are not granted permissions directly, so the codes are
+// resolved through the roles that the user holds, plus the role of the plan they are
+// currently subscribed to. The period end is checked here too, so that a subscription
+// stops granting anything the moment it lapses, even before the background job has
+// expired it.
+func (m PermissionModel) GetAllForUser(ctx context.Context, userID int64) (Permissions, error) {
+	ctx, span := startSpan(ctx, "PermissionModel.GetAllForUser")
+	defer span.End()
+
 	query := `
-		SELECT permissions.code
+		SELECT DISTINCT permissions.code
 		FROM permissions
-		INNER JOIN users_permissions ON users_permissions.permission_id = permissions.id
-		INNER JOIN users ON users_permissions.user_id = users.id
-		WHERE users.id = $1`
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+		INNER JOIN roles_permissions ON roles_permissions.permission_id = permissions.id
+		WHERE roles_permissions.role_id IN (
+			SELECT role_id FROM users_roles WHERE user_id = $1
+			UNION
+			SELECT plans.role_id
+			FROM subscriptions
+			INNER JOIN plans ON plans.id = subscriptions.plan_id
+			WHERE subscriptions.user_id = $1
+			AND subscriptions.status IN ('trialing', 'active')
+			AND subscriptions.current_period_end > NOW()
+		)`
+	ctx, cancel := withTimeout(ctx, m.Timeout)
 	defer cancel()
 	rows, err := m.DB.QueryContext(ctx, query, userID)
 	if err != nil {
@@ -56,27 +68,3 @@ func (m PermissionModel) GetAllForUser(userID int64) (Permissions, error) {
 	}
 	return permissions, nil
 }
-
-func (m PermissionModel) AddForUser(userID int64, codes ...string) error {
-	query := `
-		INSERT INTO users_permissions
-		SELECT $1, permissions.id FROM permissions WHERE permissions.code = ANY($2)`
-
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-	defer cancel()
-	_, err := m.DB.ExecContext(ctx, query, userID, pq.Array(codes))
-	return err
-}
-
-func (m PermissionModel) RemoveForUser(userID int64, codes ...string) error {
-	query := `
-		DELETE FROM users_permissions
-		WHERE user_id = $1 AND permission_id IN (
-			SELECT permissions.id FROM permissions WHERE permissions.code = ANY($2)
-		)`
-
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-	defer cancel()
-	_, err := m.DB.ExecContext(ctx, query, userID, pq.Array(codes))
-	return err
-}
@@ -0,0 +1,158 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/henrtytanoh/greenlight/internal/validator"
+	"github.com/lib/pq"
+)
+
+// Roles bundle permission codes together so that they can be granted to users as a
+// group, rather than one permission row per user.
+type Roles []string
+
+func (r Roles) Include(code string) bool {
+	for i := range r {
+		if code == r[i] {
+			return true
+		}
+	}
+	return false
+}
+
+// ValidateRoles checks that every requested role code is one of the known roles.
+func ValidateRoles(v *validator.Validator, roles []string, known Roles) {
+	v.Check(roles != nil, "roles", "must be provided")
+	v.Check(validator.Unique(roles), "roles", "must not contain duplicate values")
+	for _, role := range roles {
+		v.Check(known.Include(role), "roles", "must only contain known roles")
+	}
+}
+
+// Define the RoleModel type.
+type RoleModel struct {
+	DB      *sql.DB
+	Timeout time.Duration
+}
+
+// GetAll() returns the codes of every role defined in the roles table.
+func (m RoleModel) GetAll(ctx context.Context) (Roles, error) {
+	ctx, span := startSpan(ctx, "RoleModel.GetAll")
+	defer span.End()
+
+	query := `
+		SELECT code
+		FROM roles
+		ORDER BY id`
+	ctx, cancel := withTimeout(ctx, m.Timeout)
+	defer cancel()
+	rows, err := m.DB.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return scanRoles(rows)
+}
+
+// GetAllForUser() returns the codes of the roles held by a specific user.
+func (m RoleModel) GetAllForUser(ctx context.Context, userID int64) (Roles, error) {
+	ctx, span := startSpan(ctx, "RoleModel.GetAllForUser")
+	defer span.End()
+
+	query := `
+		SELECT roles.code
+		FROM roles
+		INNER JOIN users_roles ON users_roles.role_id = roles.id
+		WHERE users_roles.user_id = $1
+		ORDER BY roles.id`
+	ctx, cancel := withTimeout(ctx, m.Timeout)
+	defer cancel()
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return scanRoles(rows)
+}
+
+// AddForUser() grants the given roles to a user. Roles that the user already holds are
+// left untouched.
+func (m RoleModel) AddForUser(ctx context.Context, userID int64, codes ...string) error {
+	ctx, span := startSpan(ctx, "RoleModel.AddForUser")
+	defer span.End()
+
+	query := `
+		INSERT INTO users_roles
+		SELECT $1, roles.id FROM roles WHERE roles.code = ANY($2)
+		ON CONFLICT DO NOTHING`
+
+	ctx, cancel := withTimeout(ctx, m.Timeout)
+	defer cancel()
+	_, err := m.DB.ExecContext(ctx, query, userID, pq.Array(codes))
+	return err
+}
+
+func (m RoleModel) RemoveForUser(ctx context.Context, userID int64, codes ...string) error {
+	ctx, span := startSpan(ctx, "RoleModel.RemoveForUser")
+	defer span.End()
+
+	query := `
+		DELETE FROM users_roles
+		WHERE user_id = $1 AND role_id IN (
+			SELECT roles.id FROM roles WHERE roles.code = ANY($2)
+		)`
+
+	ctx, cancel := withTimeout(ctx, m.Timeout)
+	defer cancel()
+	_, err := m.DB.ExecContext(ctx, query, userID, pq.Array(codes))
+	return err
+}
+
+// SetForUser() replaces all the roles held by a user with the given roles, inside a
+// single transaction so the user is never left without their previous roles on error.
+func (m RoleModel) SetForUser(ctx context.Context, userID int64, codes ...string) error {
+	ctx, span := startSpan(ctx, "RoleModel.SetForUser")
+	defer span.End()
+
+	ctx, cancel := withTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `DELETE FROM users_roles WHERE user_id = $1`, userID)
+	if err != nil {
+		return err
+	}
+
+	query := `
+		INSERT INTO users_roles
+		SELECT $1, roles.id FROM roles WHERE roles.code = ANY($2)`
+	_, err = tx.ExecContext(ctx, query, userID, pq.Array(codes))
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func scanRoles(rows *sql.Rows) (Roles, error) {
+	roles := Roles{}
+	for rows.Next() {
+		var role string
+		err := rows.Scan(&role)
+		if err != nil {
+			return nil, err
+		}
+		roles = append(roles, role)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return roles, nil
+}
@@ -0,0 +1,46 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+)
+
+// SchemaModel reports on the database itself rather than on its records, for health
+// checks.
+type SchemaModel struct {
+	DB *sql.DB
+}
+
+// Ping() checks that a connection to the database can be made.
+func (m SchemaModel) Ping(ctx context.Context) error {
+	ctx, span := startSpan(ctx, "SchemaModel.Ping")
+	defer span.End()
+
+	return m.DB.PingContext(ctx)
+}
+
+// Version() returns the version of the last migration applied by migrate, and whether it
+// failed halfway (dirty). The version is 0 when no migration was applied.
+func (m SchemaModel) Version(ctx context.Context) (uint64, bool, error) {
+	ctx, span := startSpan(ctx, "SchemaModel.Version")
+	defer span.End()
+
+	query := `
+		SELECT version, dirty
+		FROM schema_migrations
+		LIMIT 1`
+
+	var version uint64
+	var dirty bool
+	err := m.DB.QueryRowContext(ctx, query).Scan(&version, &dirty)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return 0, false, nil
+		default:
+			return 0, false, err
+		}
+	}
+	return version, dirty, nil
+}
@@ -0,0 +1,85 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// SigningKey is a private key used to sign access tokens. Keys are shared through the
+// database so that every replica of the API signs and verifies with the same set.
+type SigningKey struct {
+	ID         string
+	Algorithm  string
+	PrivateKey []byte
+	CreatedAt  time.Time
+	RetiresAt  time.Time
+}
+
+// Define the SigningKeyModel type.
+type SigningKeyModel struct {
+	DB      *sql.DB
+	Timeout time.Duration
+}
+
+func (m SigningKeyModel) Insert(ctx context.Context, key *SigningKey) error {
+	ctx, span := startSpan(ctx, "SigningKeyModel.Insert")
+	defer span.End()
+
+	query := `
+		INSERT INTO signing_keys (id, algorithm, private_key, retires_at)
+		VALUES ($1, $2, $3, $4)
+		RETURNING created_at`
+	args := []interface{}{key.ID, key.Algorithm, key.PrivateKey, key.RetiresAt}
+	ctx, cancel := withTimeout(ctx, m.Timeout)
+	defer cancel()
+	return m.DB.QueryRowContext(ctx, query, args...).Scan(&key.CreatedAt)
+}
+
+// GetAllActive() returns the keys which have not yet been retired, newest first. The
+// first key is the one that should be used to sign new tokens.
+func (m SigningKeyModel) GetAllActive(ctx context.Context) ([]*SigningKey, error) {
+	ctx, span := startSpan(ctx, "SigningKeyModel.GetAllActive")
+	defer span.End()
+
+	query := `
+		SELECT id, algorithm, private_key, created_at, retires_at
+		FROM signing_keys
+		WHERE retires_at > NOW()
+		ORDER BY created_at DESC, id`
+	ctx, cancel := withTimeout(ctx, m.Timeout)
+	defer cancel()
+	rows, err := m.DB.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []*SigningKey{}
+	for rows.Next() {
+		var key SigningKey
+		err := rows.Scan(&key.ID, &key.Algorithm, &key.PrivateKey, &key.CreatedAt, &key.RetiresAt)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, &key)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// DeleteRetired() removes keys that can no longer have valid tokens signed with them.
+func (m SigningKeyModel) DeleteRetired(ctx context.Context) error {
+	ctx, span := startSpan(ctx, "SigningKeyModel.DeleteRetired")
+	defer span.End()
+
+	query := `
+		DELETE FROM signing_keys
+		WHERE retires_at <= NOW()`
+	ctx, cancel := withTimeout(ctx, m.Timeout)
+	defer cancel()
+	_, err := m.DB.ExecContext(ctx, query)
+	return err
+}
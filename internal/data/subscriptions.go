@@ -0,0 +1,546 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/henrtytanoh/greenlight/internal/validator"
+)
+
+var (
+	ErrDuplicateSubscription = errors.New("duplicate subscription")
+	ErrDuplicatePaymentEvent = errors.New("duplicate payment event")
+)
+
+// Subscription statuses. A subscription is incomplete until the payment provider reports
+// that its checkout was completed, and becomes incomplete_expired if that never happens.
+// Only trialing and active subscriptions grant the role of their plan; once a
+// subscription has expired it is kept for the user's history.
+const (
+	SubscriptionIncomplete        = "incomplete"
+	SubscriptionIncompleteExpired = "incomplete_expired"
+	SubscriptionTrialing          = "trialing"
+	SubscriptionActive            = "active"
+	SubscriptionExpired           = "expired"
+)
+
+// Plan is a subscription plan. Subscribers are granted the plan's role, and through it
+// its permissions, for as long as their subscription is current.
+type Plan struct {
+	ID         int64  `json:"-"`
+	Code       string `json:"code"`
+	Name       string `json:"name"`
+	Role       string `json:"role"`
+	PriceCents int    `json:"price_cents"`
+	Currency   string `json:"currency"`
+	PeriodDays int    `json:"period_days"`
+	TrialDays  int    `json:"trial_days"`
+}
+
+// Subscription is a user's subscription to a plan. CurrentPeriodEnd is the end of the
+// trial while trialing, and the next renewal date afterwards. Provider is the payment
+// provider the subscription is paid through, which knows it as ProviderSubscriptionID
+// once the checkout has been completed.
+type Subscription struct {
+	ID                     int64      `json:"id"`
+	UserID                 int64      `json:"-"`
+	Plan                   Plan       `json:"plan"`
+	Status                 string     `json:"status"`
+	StartedAt              time.Time  `json:"started_at"`
+	TrialEndsAt            *time.Time `json:"trial_ends_at,omitempty"`
+	CurrentPeriodEnd       time.Time  `json:"current_period_end"`
+	CancelAtPeriodEnd      bool       `json:"cancel_at_period_end"`
+	CanceledAt             *time.Time `json:"canceled_at,omitempty"`
+	EndedAt                *time.Time `json:"ended_at,omitempty"`
+	Provider               string     `json:"-"`
+	CheckoutID             string     `json:"-"`
+	ProviderSubscriptionID string     `json:"-"`
+	Version                int32      `json:"-"`
+}
+
+// PaymentEvent identifies a webhook event of a payment provider. Each event is applied
+// at most once.
+type PaymentEvent struct {
+	Provider string
+	ID       string
+	Type     string
+}
+
+func ValidatePlanCode(v *validator.Validator, code string) {
+	v.Check(code != "", "plan", "must be provided")
+	v.Check(len(code) <= 100, "plan", "must not be more than 100 bytes long")
+}
+
+// Define the PlanModel type.
+type PlanModel struct {
+	DB      *sql.DB
+	Timeout time.Duration
+}
+
+// GetAll() returns the plans that are open to new subscribers.
+func (m PlanModel) GetAll(ctx context.Context) ([]*Plan, error) {
+	ctx, span := startSpan(ctx, "PlanModel.GetAll")
+	defer span.End()
+
+	query := `
+		SELECT plans.id, plans.code, plans.name, roles.code, plans.price_cents, plans.currency,
+			plans.period_days, plans.trial_days
+		FROM plans
+		INNER JOIN roles ON roles.id = plans.role_id
+		WHERE plans.active
+		ORDER BY plans.price_cents, plans.id`
+	ctx, cancel := withTimeout(ctx, m.Timeout)
+	defer cancel()
+	rows, err := m.DB.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	plans := []*Plan{}
+	for rows.Next() {
+		var plan Plan
+		err := rows.Scan(
+			&plan.ID,
+			&plan.Code,
+			&plan.Name,
+			&plan.Role,
+			&plan.PriceCents,
+			&plan.Currency,
+			&plan.PeriodDays,
+			&plan.TrialDays,
+		)
+		if err != nil {
+			return nil, err
+		}
+		plans = append(plans, &plan)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return plans, nil
+}
+
+// GetByCode() returns an active plan.
+func (m PlanModel) GetByCode(ctx context.Context, code string) (*Plan, error) {
+	ctx, span := startSpan(ctx, "PlanModel.GetByCode")
+	defer span.End()
+
+	query := `
+		SELECT plans.id, plans.code, plans.name, roles.code, plans.price_cents, plans.currency,
+			plans.period_days, plans.trial_days
+		FROM plans
+		INNER JOIN roles ON roles.id = plans.role_id
+		WHERE plans.code = $1 AND plans.active`
+	var plan Plan
+	ctx, cancel := withTimeout(ctx, m.Timeout)
+	defer cancel()
+	err := m.DB.QueryRowContext(ctx, query, code).Scan(
+		&plan.ID,
+		&plan.Code,
+		&plan.Name,
+		&plan.Role,
+		&plan.PriceCents,
+		&plan.Currency,
+		&plan.PeriodDays,
+		&plan.TrialDays,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &plan, nil
+}
+
+// Define the SubscriptionModel type.
+type SubscriptionModel struct {
+	DB      *sql.DB
+	Timeout time.Duration
+}
+
+// New() starts a subscription to the plan, paid through the given provider. It stays
+// incomplete, and grants nothing, until the checkout has been completed.
+func (m SubscriptionModel) New(ctx context.Context, userID int64, plan *Plan, provider string) (*Subscription, error) {
+	ctx, span := startSpan(ctx, "SubscriptionModel.New")
+	defer span.End()
+
+	subscription := &Subscription{
+		UserID:           userID,
+		Plan:             *plan,
+		Status:           SubscriptionIncomplete,
+		CurrentPeriodEnd: time.Now(),
+		Provider:         provider,
+	}
+
+	err := m.Insert(ctx, subscription)
+	if err != nil {
+		return nil, err
+	}
+	return subscription, nil
+}
+
+func (m SubscriptionModel) Insert(ctx context.Context, subscription *Subscription) error {
+	ctx, span := startSpan(ctx, "SubscriptionModel.Insert")
+	defer span.End()
+
+	query := `
+		INSERT INTO subscriptions (user_id, plan_id, status, trial_ends_at, current_period_end, provider)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING id, started_at, version`
+	args := []interface{}{
+		subscription.UserID,
+		subscription.Plan.ID,
+		subscription.Status,
+		subscription.TrialEndsAt,
+		subscription.CurrentPeriodEnd,
+		subscription.Provider,
+	}
+	ctx, cancel := withTimeout(ctx, m.Timeout)
+	defer cancel()
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&subscription.ID, &subscription.StartedAt, &subscription.Version)
+	if err != nil {
+		switch {
+		case err.Error() == `pq: duplicate key value violates unique constraint "subscriptions_user_current_idx"`:
+			return ErrDuplicateSubscription
+		default:
+			return err
+		}
+	}
+	return nil
+}
+
+// SetCheckout() records the checkout session opened for an incomplete subscription.
+func (m SubscriptionModel) SetCheckout(ctx context.Context, s *Subscription, checkoutID string) error {
+	ctx, span := startSpan(ctx, "SubscriptionModel.SetCheckout")
+	defer span.End()
+
+	query := `
+		UPDATE subscriptions
+		SET checkout_id = $1, version = version + 1
+		WHERE id = $2 AND version = $3
+		RETURNING version`
+	ctx, cancel := withTimeout(ctx, m.Timeout)
+	defer cancel()
+	err := m.DB.QueryRowContext(ctx, query, checkoutID, s.ID, s.Version).Scan(&s.Version)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		default:
+			return err
+		}
+	}
+	s.CheckoutID = checkoutID
+	return nil
+}
+
+// AbandonIncomplete() gives up on the user's incomplete subscription, if any, so that
+// they can start over with a new checkout.
+func (m SubscriptionModel) AbandonIncomplete(ctx context.Context, userID int64) error {
+	ctx, span := startSpan(ctx, "SubscriptionModel.AbandonIncomplete")
+	defer span.End()
+
+	query := `
+		UPDATE subscriptions
+		SET status = 'incomplete_expired', ended_at = NOW(), version = version + 1
+		WHERE user_id = $1 AND status = 'incomplete'`
+	ctx, cancel := withTimeout(ctx, m.Timeout)
+	defer cancel()
+	_, err := m.DB.ExecContext(ctx, query, userID)
+	return err
+}
+
+// GetCurrentForUser() returns the user's incomplete, trialing or active subscription.
+func (m SubscriptionModel) GetCurrentForUser(ctx context.Context, userID int64) (*Subscription, error) {
+	ctx, span := startSpan(ctx, "SubscriptionModel.GetCurrentForUser")
+	defer span.End()
+
+	query := `
+		SELECT subscriptions.id, subscriptions.user_id, subscriptions.status, subscriptions.started_at,
+			subscriptions.trial_ends_at, subscriptions.current_period_end, subscriptions.cancel_at_period_end,
+			subscriptions.canceled_at, subscriptions.ended_at, COALESCE(subscriptions.provider, ''),
+			COALESCE(subscriptions.checkout_id, ''), COALESCE(subscriptions.provider_subscription_id, ''),
+			subscriptions.version,
+			plans.id, plans.code, plans.name, roles.code, plans.price_cents, plans.currency,
+			plans.period_days, plans.trial_days
+		FROM subscriptions
+		INNER JOIN plans ON plans.id = subscriptions.plan_id
+		INNER JOIN roles ON roles.id = plans.role_id
+		WHERE subscriptions.user_id = $1 AND subscriptions.status IN ('incomplete', 'trialing', 'active')`
+	var s Subscription
+	ctx, cancel := withTimeout(ctx, m.Timeout)
+	defer cancel()
+	err := m.DB.QueryRowContext(ctx, query, userID).Scan(
+		&s.ID,
+		&s.UserID,
+		&s.Status,
+		&s.StartedAt,
+		&s.TrialEndsAt,
+		&s.CurrentPeriodEnd,
+		&s.CancelAtPeriodEnd,
+		&s.CanceledAt,
+		&s.EndedAt,
+		&s.Provider,
+		&s.CheckoutID,
+		&s.ProviderSubscriptionID,
+		&s.Version,
+		&s.Plan.ID,
+		&s.Plan.Code,
+		&s.Plan.Name,
+		&s.Plan.Role,
+		&s.Plan.PriceCents,
+		&s.Plan.Currency,
+		&s.Plan.PeriodDays,
+		&s.Plan.TrialDays,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &s, nil
+}
+
+// Update() saves the cancellation fields of a subscription, using the version number to
+// detect concurrent changes, such as a renewal reported by the payment provider.
+func (m SubscriptionModel) Update(ctx context.Context, s *Subscription) error {
+	ctx, span := startSpan(ctx, "SubscriptionModel.Update")
+	defer span.End()
+
+	query := `
+		UPDATE subscriptions
+		SET cancel_at_period_end = $1, canceled_at = $2, version = version + 1
+		WHERE id = $3 AND version = $4
+		RETURNING version`
+	args := []interface{}{s.CancelAtPeriodEnd, s.CanceledAt, s.ID, s.Version}
+	ctx, cancel := withTimeout(ctx, m.Timeout)
+	defer cancel()
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&s.Version)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		default:
+			return err
+		}
+	}
+	return nil
+}
+
+// applyPaymentEvent() records a payment event and runs fn in the same transaction, so
+// that each event changes the subscription once however often it is delivered. It
+// returns ErrDuplicatePaymentEvent for an event which was already recorded. When fn
+// returns ErrRecordNotFound, because the event doesn't apply to the subscription in its
+// current state, the event is still recorded before the error is returned.
+func (m SubscriptionModel) applyPaymentEvent(ctx context.Context, event PaymentEvent, subscriptionID int64, fn func(ctx context.Context, tx *sql.Tx) error) error {
+	ctx, cancel := withTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := `
+		INSERT INTO payment_events (provider, id, type, subscription_id)
+		VALUES ($1, $2, $3, NULLIF($4::bigint, 0))
+		ON CONFLICT DO NOTHING`
+	result, err := tx.ExecContext(ctx, query, event.Provider, event.ID, event.Type, subscriptionID)
+	if err != nil {
+		return err
+	}
+	inserted, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if inserted == 0 {
+		return ErrDuplicatePaymentEvent
+	}
+
+	fnErr := fn(ctx, tx)
+	if fnErr != nil && !errors.Is(fnErr, ErrRecordNotFound) {
+		return fnErr
+	}
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+	return fnErr
+}
+
+// RecordPaymentEvent() records an event which doesn't change the subscription, such as
+// a failed payment.
+func (m SubscriptionModel) RecordPaymentEvent(ctx context.Context, event PaymentEvent, subscriptionID int64) error {
+	ctx, span := startSpan(ctx, "SubscriptionModel.RecordPaymentEvent")
+	defer span.End()
+
+	return m.applyPaymentEvent(ctx, event, subscriptionID, func(ctx context.Context, tx *sql.Tx) error {
+		return nil
+	})
+}
+
+// Activate() starts an incomplete subscription once its checkout has been completed.
+// Users get the plan's trial the first time they subscribe; after that they go straight
+// to a paid period.
+func (m SubscriptionModel) Activate(ctx context.Context, event PaymentEvent, subscriptionID int64, providerSubscriptionID string) error {
+	ctx, span := startSpan(ctx, "SubscriptionModel.Activate")
+	defer span.End()
+
+	return m.applyPaymentEvent(ctx, event, subscriptionID, func(ctx context.Context, tx *sql.Tx) error {
+		query := `
+			SELECT plans.period_days, plans.trial_days, EXISTS (
+				SELECT 1 FROM subscriptions earlier
+				WHERE earlier.user_id = subscriptions.user_id
+				AND earlier.id <> subscriptions.id
+				AND earlier.status NOT IN ('incomplete', 'incomplete_expired')
+			)
+			FROM subscriptions
+			INNER JOIN plans ON plans.id = subscriptions.plan_id
+			WHERE subscriptions.id = $1 AND subscriptions.status = 'incomplete'
+			FOR UPDATE OF subscriptions`
+		var periodDays, trialDays int
+		var hasSubscribed bool
+		err := tx.QueryRowContext(ctx, query, subscriptionID).Scan(&periodDays, &trialDays, &hasSubscribed)
+		if err != nil {
+			switch {
+			case errors.Is(err, sql.ErrNoRows):
+				return ErrRecordNotFound
+			default:
+				return err
+			}
+		}
+
+		now := time.Now()
+		status := SubscriptionActive
+		var trialEndsAt *time.Time
+		periodEnd := now.AddDate(0, 0, periodDays)
+		if trialDays > 0 && !hasSubscribed {
+			t := now.AddDate(0, 0, trialDays)
+			status = SubscriptionTrialing
+			trialEndsAt = &t
+			periodEnd = t
+		}
+
+		query = `
+			UPDATE subscriptions
+			SET status = $1, started_at = $2, trial_ends_at = $3, current_period_end = $4,
+				provider_subscription_id = $5, version = version + 1
+			WHERE id = $6`
+		args := []interface{}{status, now, trialEndsAt, periodEnd, providerSubscriptionID, subscriptionID}
+		_, err = tx.ExecContext(ctx, query, args...)
+		return err
+	})
+}
+
+// Renew() moves a trialing or active subscription on to the period which has been paid
+// for, ending at periodEnd. A zero periodEnd means one period of the plan after the
+// current one. A trial turns into an active subscription.
+func (m SubscriptionModel) Renew(ctx context.Context, event PaymentEvent, subscriptionID int64, periodEnd time.Time) error {
+	ctx, span := startSpan(ctx, "SubscriptionModel.Renew")
+	defer span.End()
+
+	return m.applyPaymentEvent(ctx, event, subscriptionID, func(ctx context.Context, tx *sql.Tx) error {
+		var end *time.Time
+		if !periodEnd.IsZero() {
+			end = &periodEnd
+		}
+
+		// The period end never moves backwards, in case events arrive out of order.
+		query := `
+			UPDATE subscriptions
+			SET status = 'active',
+				current_period_end = GREATEST(subscriptions.current_period_end,
+					COALESCE($1, subscriptions.current_period_end + plans.period_days * INTERVAL '1 day')),
+				version = subscriptions.version + 1
+			FROM plans
+			WHERE plans.id = subscriptions.plan_id
+			AND subscriptions.id = $2
+			AND subscriptions.status IN ('trialing', 'active')`
+		result, err := tx.ExecContext(ctx, query, end, subscriptionID)
+		if err != nil {
+			return err
+		}
+		return requireRowAffected(result)
+	})
+}
+
+// End() ends a subscription straight away, when it was canceled at the provider.
+func (m SubscriptionModel) End(ctx context.Context, event PaymentEvent, subscriptionID int64) error {
+	ctx, span := startSpan(ctx, "SubscriptionModel.End")
+	defer span.End()
+
+	return m.applyPaymentEvent(ctx, event, subscriptionID, func(ctx context.Context, tx *sql.Tx) error {
+		query := `
+			UPDATE subscriptions
+			SET status = CASE WHEN status = 'incomplete' THEN 'incomplete_expired' ELSE 'expired' END,
+				ended_at = NOW(), version = version + 1
+			WHERE id = $1 AND status IN ('incomplete', 'trialing', 'active')`
+		result, err := tx.ExecContext(ctx, query, subscriptionID)
+		if err != nil {
+			return err
+		}
+		return requireRowAffected(result)
+	})
+}
+
+func requireRowAffected(result sql.Result) error {
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return ErrRecordNotFound
+	}
+	return nil
+}
+
+// ExpireDue() ends the subscriptions which are over: the canceled ones which have
+// reached the end of their period, the others once their period ended more than grace
+// ago without the provider reporting a renewal, and the incomplete ones whose checkout
+// was started more than checkoutTTL ago. It returns the IDs of their users.
+func (m SubscriptionModel) ExpireDue(ctx context.Context, grace, checkoutTTL time.Duration) ([]int64, error) {
+	ctx, span := startSpan(ctx, "SubscriptionModel.ExpireDue")
+	defer span.End()
+
+	query := `
+		UPDATE subscriptions
+		SET status = CASE WHEN status = 'incomplete' THEN 'incomplete_expired' ELSE 'expired' END,
+			ended_at = CASE WHEN status = 'incomplete' THEN NOW() ELSE current_period_end END,
+			version = version + 1
+		WHERE (status IN ('trialing', 'active') AND cancel_at_period_end AND current_period_end <= NOW())
+		OR (status IN ('trialing', 'active') AND current_period_end <= $1)
+		OR (status = 'incomplete' AND started_at <= $2)
+		RETURNING user_id`
+	now := time.Now()
+	ctx, cancel := withTimeout(ctx, m.Timeout)
+	defer cancel()
+	rows, err := m.DB.QueryContext(ctx, query, now.Add(-grace), now.Add(-checkoutTTL))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	userIDs := []int64{}
+	for rows.Next() {
+		var userID int64
+		err := rows.Scan(&userID)
+		if err != nil {
+			return nil, err
+		}
+		userIDs = append(userIDs, userID)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return userIDs, nil
+}
@@ -6,23 +6,49 @@ import (
 	"crypto/sha256"
 	"database/sql"
 	"encoding/base32"
+	"errors"
 	"time"
 
 	"github.com/henrtytanoh/greenlight/internal/validator"
+	"github.com/lib/pq"
 )
 
 const (
 	ScopeActivation     = "activation"
 	ScopeAuthentication = "authentication"
 	ScopePasswordReset  = "password-reset"
+	ScopeRefresh        = "refresh"
+	ScopeMFA            = "mfa"
 )
 
+// sessionScopes are the token scopes that represent a logged in client.
+var sessionScopes = []string{ScopeAuthentication, ScopeRefresh}
+
 type Token struct {
 	Plaintext string    `json:"token"`
 	Hash      []byte    `json:"-"`
 	UserID    int64     `json:"-"`
 	Expiry    time.Time `json:"expiry"`
 	Scope     string    `json:"-"`
+	IP        string    `json:"-"`
+	UserAgent string    `json:"-"`
+	// Refresh tokens are rotated on every use. All the tokens descending from the same
+	// login share a family, so that the whole chain can be revoked when an already used
+	// refresh token is presented again.
+	Family string     `json:"-"`
+	UsedAt *time.Time `json:"-"`
+}
+
+// Session describes an authentication token as shown to its owner. It never carries
+// the token itself, only enough information to recognise and revoke it.
+type Session struct {
+	ID         int64      `json:"id"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+	Expiry     time.Time  `json:"expiry"`
+	IP         string     `json:"ip"`
+	UserAgent  string     `json:"user_agent"`
+	Current    bool       `json:"current"`
 }
 
 func generateToken(userID int64, ttl time.Duration, scope string) (*Token, error) {
@@ -54,39 +80,315 @@ func ValidateTokenPlaintext(v *validator.Validator, tokenPlaintext string) {
 
 // Define the TokenModel type.
 type TokenModel struct {
-	DB *sql.DB
+	DB      *sql.DB
+	Timeout time.Duration
 }
 
 // The New() method is a shortcut which creates a new Token struct and then inserts the
 // data in the tokens table.
-func (m TokenModel) New(userID int64, ttl time.Duration, scope string) (*Token, error) {
+func (m TokenModel) New(ctx context.Context, userID int64, ttl time.Duration, scope string) (*Token, error) {
+	ctx, span := startSpan(ctx, "TokenModel.New")
+	defer span.End()
+
 	token, err := generateToken(userID, ttl, scope)
 	if err != nil {
 		return nil, err
 	}
-	err = m.Insert(token)
+	err = m.Insert(ctx, token)
+	return token, err
+}
+
+// NewSession() creates an authentication token and records the client that it was
+// issued to, so that it can be listed in the user's sessions.
+func (m TokenModel) NewSession(ctx context.Context, userID int64, ttl time.Duration, ip, userAgent string) (*Token, error) {
+	ctx, span := startSpan(ctx, "TokenModel.NewSession")
+	defer span.End()
+
+	token, err := generateSessionToken(userID, ttl, ip, userAgent)
+	if err != nil {
+		return nil, err
+	}
+	err = m.Insert(ctx, token)
+	return token, err
+}
+
+// NewRefresh() creates a refresh token. An empty family starts a new family, which is
+// what happens at login; refreshing passes the family of the token being rotated.
+func (m TokenModel) NewRefresh(ctx context.Context, userID int64, ttl time.Duration, family, ip, userAgent string) (*Token, error) {
+	ctx, span := startSpan(ctx, "TokenModel.NewRefresh")
+	defer span.End()
+
+	token, err := generateRefreshToken(userID, ttl, family, ip, userAgent)
+	if err != nil {
+		return nil, err
+	}
+	err = m.Insert(ctx, token)
 	return token, err
 }
 
+func generateSessionToken(userID int64, ttl time.Duration, ip, userAgent string) (*Token, error) {
+	token, err := generateToken(userID, ttl, ScopeAuthentication)
+	if err != nil {
+		return nil, err
+	}
+	// The user agent is client controlled, so cap the amount we are willing to store.
+	if len(userAgent) > 512 {
+		userAgent = userAgent[:512]
+	}
+	token.IP = ip
+	token.UserAgent = userAgent
+	return token, nil
+}
+
+func generateRefreshToken(userID int64, ttl time.Duration, family, ip, userAgent string) (*Token, error) {
+	token, err := generateToken(userID, ttl, ScopeRefresh)
+	if err != nil {
+		return nil, err
+	}
+	if family == "" {
+		family, err = generateFamily()
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(userAgent) > 512 {
+		userAgent = userAgent[:512]
+	}
+	token.Family = family
+	token.IP = ip
+	token.UserAgent = userAgent
+	return token, nil
+}
+
+func generateFamily() (string, error) {
+	randomBytes := make([]byte, 16)
+	_, err := rand.Read(randomBytes)
+	if err != nil {
+		return "", err
+	}
+	return base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(randomBytes), nil
+}
+
 // Insert() adds the data for a specific token to the tokens table.
-func (m TokenModel) Insert(token *Token) error {
+func (m TokenModel) Insert(ctx context.Context, token *Token) error {
+	ctx, span := startSpan(ctx, "TokenModel.Insert")
+	defer span.End()
+
 	query := `
-	INSERT INTO tokens (hash, user_id, expiry, scope)
-	VALUES ($1, $2, $3, $4)`
-	args := []interface{}{token.Hash, token.UserID, token.Expiry, token.Scope}
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	INSERT INTO tokens (hash, user_id, expiry, scope, ip, user_agent, family)
+	VALUES ($1, $2, $3, $4, $5, $6, $7)`
+	family := sql.NullString{String: token.Family, Valid: token.Family != ""}
+	args := []interface{}{token.Hash, token.UserID, token.Expiry, token.Scope, token.IP, token.UserAgent, family}
+	ctx, cancel := withTimeout(ctx, m.Timeout)
 	defer cancel()
 	_, err := m.DB.ExecContext(ctx, query, args...)
 	return err
 }
 
 // DeleteAllForUser() deletes all tokens for a specific user and scope.
-func (m TokenModel) DeleteAllForUser(scope string, userID int64) error {
+func (m TokenModel) DeleteAllForUser(ctx context.Context, scope string, userID int64) error {
+	ctx, span := startSpan(ctx, "TokenModel.DeleteAllForUser")
+	defer span.End()
+
 	query := `
 	DELETE FROM tokens
 	WHERE scope = $1 AND user_id = $2`
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := withTimeout(ctx, m.Timeout)
 	defer cancel()
 	_, err := m.DB.ExecContext(ctx, query, scope, userID)
 	return err
 }
+
+// DeleteForPlaintext() revokes a single token.
+func (m TokenModel) DeleteForPlaintext(ctx context.Context, scope, tokenPlaintext string) error {
+	ctx, span := startSpan(ctx, "TokenModel.DeleteForPlaintext")
+	defer span.End()
+
+	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
+	query := `
+	DELETE FROM tokens
+	WHERE scope = $1 AND hash = $2`
+	ctx, cancel := withTimeout(ctx, m.Timeout)
+	defer cancel()
+	_, err := m.DB.ExecContext(ctx, query, scope, tokenHash[:])
+	return err
+}
+
+// Touch() records that an authentication token has just been used. To avoid a write on
+// every request the timestamp is only refreshed once a minute.
+func (m TokenModel) Touch(ctx context.Context, tokenPlaintext string) error {
+	ctx, span := startSpan(ctx, "TokenModel.Touch")
+	defer span.End()
+
+	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
+	query := `
+	UPDATE tokens
+	SET last_used_at = NOW()
+	WHERE hash = $1
+	AND (last_used_at IS NULL OR last_used_at < NOW() - INTERVAL '1 minute')`
+	ctx, cancel := withTimeout(ctx, m.Timeout)
+	defer cancel()
+	_, err := m.DB.ExecContext(ctx, query, tokenHash[:])
+	return err
+}
+
+// GetSessionsForUser() returns the unexpired authentication tokens of a user, and the
+// latest refresh token of each family. The session matching currentPlaintext, if any,
+// is flagged as the current one.
+func (m TokenModel) GetSessionsForUser(ctx context.Context, userID int64, currentPlaintext string) ([]*Session, error) {
+	ctx, span := startSpan(ctx, "TokenModel.GetSessionsForUser")
+	defer span.End()
+
+	currentHash := sha256.Sum256([]byte(currentPlaintext))
+	query := `
+	SELECT id, created_at, last_used_at, expiry, ip, user_agent, hash = $3
+	FROM tokens
+	WHERE user_id = $1 AND scope = ANY($2) AND used_at IS NULL AND expiry > NOW()
+	ORDER BY created_at DESC, id DESC`
+	ctx, cancel := withTimeout(ctx, m.Timeout)
+	defer cancel()
+	rows, err := m.DB.QueryContext(ctx, query, userID, pq.Array(sessionScopes), currentHash[:])
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := []*Session{}
+	for rows.Next() {
+		var session Session
+		err := rows.Scan(
+			&session.ID,
+			&session.CreatedAt,
+			&session.LastUsedAt,
+			&session.Expiry,
+			&session.IP,
+			&session.UserAgent,
+			&session.Current,
+		)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, &session)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return sessions, nil
+}
+
+// DeleteSessionForUser() revokes one of a user's sessions by its ID.
+func (m TokenModel) DeleteSessionForUser(ctx context.Context, id, userID int64) error {
+	ctx, span := startSpan(ctx, "TokenModel.DeleteSessionForUser")
+	defer span.End()
+
+	if id < 1 {
+		return ErrRecordNotFound
+	}
+	query := `
+	DELETE FROM tokens
+	WHERE id = $1 AND user_id = $2 AND scope = ANY($3)`
+	ctx, cancel := withTimeout(ctx, m.Timeout)
+	defer cancel()
+	result, err := m.DB.ExecContext(ctx, query, id, userID, pq.Array(sessionScopes))
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+	return nil
+}
+
+// DeleteAllSessionsForUser() logs a user out everywhere by deleting all of their
+// authentication and refresh tokens.
+func (m TokenModel) DeleteAllSessionsForUser(ctx context.Context, userID int64) error {
+	ctx, span := startSpan(ctx, "TokenModel.DeleteAllSessionsForUser")
+	defer span.End()
+
+	query := `
+	DELETE FROM tokens
+	WHERE user_id = $1 AND scope = ANY($2)`
+	ctx, cancel := withTimeout(ctx, m.Timeout)
+	defer cancel()
+	_, err := m.DB.ExecContext(ctx, query, userID, pq.Array(sessionScopes))
+	return err
+}
+
+// GetRefresh() looks up an unexpired refresh token. Tokens that have already been
+// used are returned too, with UsedAt set, so that reuse can be detected.
+func (m TokenModel) GetRefresh(ctx context.Context, tokenPlaintext string) (*Token, error) {
+	ctx, span := startSpan(ctx, "TokenModel.GetRefresh")
+	defer span.End()
+
+	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
+	query := `
+	SELECT user_id, expiry, family, used_at
+	FROM tokens
+	WHERE hash = $1 AND scope = $2 AND expiry > NOW()`
+	token := Token{
+		Plaintext: tokenPlaintext,
+		Hash:      tokenHash[:],
+		Scope:     ScopeRefresh,
+	}
+	ctx, cancel := withTimeout(ctx, m.Timeout)
+	defer cancel()
+	err := m.DB.QueryRowContext(ctx, query, tokenHash[:], ScopeRefresh).Scan(
+		&token.UserID,
+		&token.Expiry,
+		&token.Family,
+		&token.UsedAt,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &token, nil
+}
+
+// MarkUsed() flags a refresh token as used. It returns ErrEditConflict if the token
+// had already been used, which happens when two requests race to rotate it.
+func (m TokenModel) MarkUsed(ctx context.Context, token *Token) error {
+	ctx, span := startSpan(ctx, "TokenModel.MarkUsed")
+	defer span.End()
+
+	query := `
+	UPDATE tokens
+	SET used_at = NOW()
+	WHERE hash = $1 AND used_at IS NULL`
+	ctx, cancel := withTimeout(ctx, m.Timeout)
+	defer cancel()
+	result, err := m.DB.ExecContext(ctx, query, token.Hash)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrEditConflict
+	}
+	return nil
+}
+
+// DeleteFamily() revokes every refresh token descending from the same login.
+func (m TokenModel) DeleteFamily(ctx context.Context, family string) error {
+	ctx, span := startSpan(ctx, "TokenModel.DeleteFamily")
+	defer span.End()
+
+	query := `
+	DELETE FROM tokens
+	WHERE family = $1`
+	ctx, cancel := withTimeout(ctx, m.Timeout)
+	defer cancel()
+	_, err := m.DB.ExecContext(ctx, query, family)
+	return err
+}
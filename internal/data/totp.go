@@ -0,0 +1,252 @@
+package data
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base32"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/henrtytanoh/greenlight/internal/validator"
+)
+
+// The number of recovery codes generated when a user enrolls in two-factor
+// authentication.
+const recoveryCodeCount = 10
+
+// TOTP holds a user's two-factor authentication enrollment. The shared secret has to
+// be stored in a recoverable form, since the server computes the same codes as the
+// user's authenticator app.
+type TOTP struct {
+	UserID      int64
+	Secret      []byte
+	Confirmed   bool
+	LastCounter int64
+	CreatedAt   time.Time
+}
+
+// Check that a one-time code has been provided and is made of 6 digits.
+func ValidateTOTPCode(v *validator.Validator, code string) {
+	v.Check(code != "", "code", "must be provided")
+	v.Check(len(code) == 6, "code", "must be 6 digits long")
+}
+
+// Define the TOTPModel type.
+type TOTPModel struct {
+	DB      *sql.DB
+	Timeout time.Duration
+}
+
+func (m TOTPModel) Get(ctx context.Context, userID int64) (*TOTP, error) {
+	ctx, span := startSpan(ctx, "TOTPModel.Get")
+	defer span.End()
+
+	query := `
+		SELECT user_id, secret, confirmed, last_counter, created_at
+		FROM users_totp
+		WHERE user_id = $1`
+	var totp TOTP
+	ctx, cancel := withTimeout(ctx, m.Timeout)
+	defer cancel()
+	err := m.DB.QueryRowContext(ctx, query, userID).Scan(
+		&totp.UserID,
+		&totp.Secret,
+		&totp.Confirmed,
+		&totp.LastCounter,
+		&totp.CreatedAt,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &totp, nil
+}
+
+// Upsert() stores a new, unconfirmed secret for the user. An enrollment which has
+// already been confirmed is never overwritten; ErrEditConflict is returned instead.
+func (m TOTPModel) Upsert(ctx context.Context, totp *TOTP) error {
+	ctx, span := startSpan(ctx, "TOTPModel.Upsert")
+	defer span.End()
+
+	query := `
+		INSERT INTO users_totp (user_id, secret)
+		VALUES ($1, $2)
+		ON CONFLICT (user_id) DO UPDATE
+		SET secret = EXCLUDED.secret, last_counter = 0, created_at = NOW()
+		WHERE users_totp.confirmed = false
+		RETURNING confirmed, last_counter, created_at`
+	ctx, cancel := withTimeout(ctx, m.Timeout)
+	defer cancel()
+	err := m.DB.QueryRowContext(ctx, query, totp.UserID, totp.Secret).Scan(
+		&totp.Confirmed,
+		&totp.LastCounter,
+		&totp.CreatedAt,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		default:
+			return err
+		}
+	}
+	return nil
+}
+
+// Confirm() enables two-factor authentication once the user has proven that their
+// app generates valid codes. The counter of that code is recorded at the same time.
+func (m TOTPModel) Confirm(ctx context.Context, userID, counter int64) error {
+	ctx, span := startSpan(ctx, "TOTPModel.Confirm")
+	defer span.End()
+
+	query := `
+		UPDATE users_totp
+		SET confirmed = true, last_counter = $2
+		WHERE user_id = $1`
+	ctx, cancel := withTimeout(ctx, m.Timeout)
+	defer cancel()
+	_, err := m.DB.ExecContext(ctx, query, userID, counter)
+	return err
+}
+
+// UseCounter() records the time step of a code that has just been accepted. Codes can
+// only move forward, so a code which is replayed returns ErrEditConflict.
+func (m TOTPModel) UseCounter(ctx context.Context, userID, counter int64) error {
+	ctx, span := startSpan(ctx, "TOTPModel.UseCounter")
+	defer span.End()
+
+	query := `
+		UPDATE users_totp
+		SET last_counter = $2
+		WHERE user_id = $1 AND last_counter < $2`
+	ctx, cancel := withTimeout(ctx, m.Timeout)
+	defer cancel()
+	result, err := m.DB.ExecContext(ctx, query, userID, counter)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrEditConflict
+	}
+	return nil
+}
+
+// Delete() disables two-factor authentication and removes the recovery codes.
+func (m TOTPModel) Delete(ctx context.Context, userID int64) error {
+	ctx, span := startSpan(ctx, "TOTPModel.Delete")
+	defer span.End()
+
+	ctx, cancel := withTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `DELETE FROM users_recovery_codes WHERE user_id = $1`, userID)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, `DELETE FROM users_totp WHERE user_id = $1`, userID)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// NewRecoveryCodes() replaces the user's recovery codes with a fresh set and returns
+// their plaintext. Like tokens, only the SHA-256 hash of each code is stored.
+func (m TOTPModel) NewRecoveryCodes(ctx context.Context, userID int64) ([]string, error) {
+	ctx, span := startSpan(ctx, "TOTPModel.NewRecoveryCodes")
+	defer span.End()
+
+	codes, err := generateRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := withTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `DELETE FROM users_recovery_codes WHERE user_id = $1`, userID)
+	if err != nil {
+		return nil, err
+	}
+	for _, code := range codes {
+		hash := recoveryCodeHash(code)
+		_, err = tx.ExecContext(ctx, `INSERT INTO users_recovery_codes (hash, user_id) VALUES ($1, $2)`, hash[:], userID)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return codes, tx.Commit()
+}
+
+// UseRecoveryCode() consumes one of the user's recovery codes. It returns
+// ErrRecordNotFound if the code does not exist or has already been used.
+func (m TOTPModel) UseRecoveryCode(ctx context.Context, userID int64, code string) error {
+	ctx, span := startSpan(ctx, "TOTPModel.UseRecoveryCode")
+	defer span.End()
+
+	hash := recoveryCodeHash(code)
+	query := `
+		UPDATE users_recovery_codes
+		SET used_at = NOW()
+		WHERE hash = $1 AND user_id = $2 AND used_at IS NULL`
+	ctx, cancel := withTimeout(ctx, m.Timeout)
+	defer cancel()
+	result, err := m.DB.ExecContext(ctx, query, hash[:], userID)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+	return nil
+}
+
+// generateRecoveryCodes() returns a fresh set of random recovery codes, such as
+// "abcd-efgh".
+func generateRecoveryCodes() ([]string, error) {
+	codes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		randomBytes := make([]byte, 5)
+		_, err := rand.Read(randomBytes)
+		if err != nil {
+			return nil, err
+		}
+		code := strings.ToLower(base32.StdEncoding.EncodeToString(randomBytes))
+		codes[i] = code[:4] + "-" + code[4:]
+	}
+	return codes, nil
+}
+
+// recoveryCodeHash() returns the hash under which a recovery code is stored. Codes are
+// accepted regardless of case and surrounding spaces.
+func recoveryCodeHash(code string) [32]byte {
+	return sha256.Sum256([]byte(strings.ToLower(strings.TrimSpace(code))))
+}
@@ -8,7 +8,6 @@ import (
 	"time"
 
 	"github.com/henrtytanoh/greenlight/internal/validator"
-	"golang.org/x/crypto/bcrypt"
 )
 
 // Define a custom ErrDuplicateEmail error.
@@ -18,7 +17,8 @@ var (
 
 // Create a UserModel struct which wraps the connection pool.
 type UserModel struct {
-	DB *sql.DB
+	DB      *sql.DB
+	Timeout time.Duration
 }
 
 type User struct {
@@ -36,10 +36,11 @@ var AnonymousUser = &User{}
 type password struct {
 	plaintext *string
 	hash      []byte
+	rehashed  bool
 }
 
 func (p *password) Set(plaintextPassword string) error {
-	hash, err := bcrypt.GenerateFromPassword([]byte(plaintextPassword), 12)
+	hash, err := currentHasher.Hash(plaintextPassword)
 	if err != nil {
 		return err
 	}
@@ -48,27 +49,49 @@ func (p *password) Set(plaintextPassword string) error {
 	return nil
 }
 
+// Matches() checks the password against the stored hash, whichever algorithm produced
+// it. When the password matches but the hash is outdated, the password is rehashed with
+// the current hasher and Rehashed() returns true; the caller should then save the user.
 func (p *password) Matches(plaintextPassword string) (bool, error) {
-	err := bcrypt.CompareHashAndPassword(p.hash, []byte(plaintextPassword))
+	hasher, err := hasherFor(p.hash)
 	if err != nil {
-		switch {
-		case errors.Is(err, bcrypt.ErrMismatchedHashAndPassword):
-			return false, nil
-		default:
+		return false, err
+	}
+	match, err := hasher.Matches(p.hash, plaintextPassword)
+	if err != nil || !match {
+		return false, err
+	}
+	if hasher != currentHasher || currentHasher.NeedsRehash(p.hash) {
+		err = p.Set(plaintextPassword)
+		if err != nil {
 			return false, err
 		}
+		p.rehashed = true
 	}
 	return true, nil
 }
 
+// Rehashed reports whether Matches() has replaced an outdated hash.
+func (p *password) Rehashed() bool {
+	return p.rehashed
+}
+
 func ValidateEmail(v *validator.Validator, email string) {
 	v.Check(email != "", "email", "must be provided")
 	v.Check(validator.Matches(email, validator.EmailRX), "email", "must be a valid email address")
 }
-func ValidatePasswordPlaintext(v *validator.Validator, password string) {
+
+// ValidatePasswordPlaintext() checks a new password against the password policy. The
+// user is used to reject passwords containing their name or email address, and may be
+// nil if they aren't known.
+func ValidatePasswordPlaintext(v *validator.Validator, password string, user *User) {
 	v.Check(password != "", "password", "must be provided")
-	v.Check(len(password) >= 8, "password", "must be at least 8 bytes long")
-	v.Check(len(password) <= 72, "password", "must not be more than 72 bytes long")
+	// Argon2id hashes passwords of any length; the cap only stops clients from making
+	// the server hash megabytes.
+	v.Check(len(password) <= 256, "password", "must not be more than 256 bytes long")
+	if password != "" {
+		currentPolicy.Check(v, password, user)
+	}
 }
 func ValidateUser(v *validator.Validator, user *User) {
 	v.Check(user.Name != "", "name", "must be provided")
@@ -78,20 +101,23 @@ func ValidateUser(v *validator.Validator, user *User) {
 	// If the plaintext password is not nil, call the standalone
 	// ValidatePasswordPlaintext() helper.
 	if user.Password.plaintext != nil {
-		ValidatePasswordPlaintext(v, *user.Password.plaintext)
+		ValidatePasswordPlaintext(v, *user.Password.plaintext, user)
 	}
 	if user.Password.hash == nil {
 		panic("missing password hash for user")
 	}
 }
 
-func (m UserModel) Insert(user *User) error {
+func (m UserModel) Insert(ctx context.Context, user *User) error {
+	ctx, span := startSpan(ctx, "UserModel.Insert")
+	defer span.End()
+
 	query := `
 		INSERT INTO users (name, email, password_hash, activated)
 		VALUES ($1, $2, $3, $4)
 		RETURNING id, created_at, version`
 	args := []interface{}{user.Name, user.Email, user.Password.hash, user.Activated}
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := withTimeout(ctx, m.Timeout)
 	defer cancel()
 	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&user.ID, &user.CreatedAt, &user.Version)
 	if err != nil {
@@ -105,13 +131,50 @@ func (m UserModel) Insert(user *User) error {
 	return nil
 }
 
-func (m UserModel) GetByEmail(email string) (*User, error) {
+func (m UserModel) Get(ctx context.Context, id int64) (*User, error) {
+	ctx, span := startSpan(ctx, "UserModel.Get")
+	defer span.End()
+
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+	query := `
+		SELECT id, created_at, name, email, password_hash, activated, version
+		FROM users
+		WHERE id = $1`
+	var user User
+	ctx, cancel := withTimeout(ctx, m.Timeout)
+	defer cancel()
+	err := m.DB.QueryRowContext(ctx, query, id).Scan(
+		&user.ID,
+		&user.CreatedAt,
+		&user.Name,
+		&user.Email,
+		&user.Password.hash,
+		&user.Activated,
+		&user.Version,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &user, nil
+}
+
+func (m UserModel) GetByEmail(ctx context.Context, email string) (*User, error) {
+	ctx, span := startSpan(ctx, "UserModel.GetByEmail")
+	defer span.End()
+
 	query := `
 		SELECT id, created_at, name, email, password_hash, activated, version
 		FROM users
 		WHERE email = $1`
 	var user User
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := withTimeout(ctx, m.Timeout)
 	defer cancel()
 	err := m.DB.QueryRowContext(ctx, query, email).Scan(
 		&user.ID,
@@ -133,7 +196,10 @@ func (m UserModel) GetByEmail(email string) (*User, error) {
 	return &user, nil
 }
 
-func (m UserModel) Update(user *User) error {
+func (m UserModel) Update(ctx context.Context, user *User) error {
+	ctx, span := startSpan(ctx, "UserModel.Update")
+	defer span.End()
+
 	query := `
 		UPDATE users
 		SET name = $1, email = $2, password_hash = $3, activated = $4, version = version + 1
@@ -147,7 +213,7 @@ func (m UserModel) Update(user *User) error {
 		user.ID,
 		user.Version,
 	}
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := withTimeout(ctx, m.Timeout)
 	defer cancel()
 	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&user.Version)
 	if err != nil {
@@ -164,7 +230,10 @@ func (m UserModel) Update(user *User) error {
 	return nil
 }
 
-func (m UserModel) GetForToken(tokenScope, tokenPlaintext string) (*User, error) {
+func (m UserModel) GetForToken(ctx context.Context, tokenScope, tokenPlaintext string) (*User, error) {
+	ctx, span := startSpan(ctx, "UserModel.GetForToken")
+	defer span.End()
+
 	// Calculate the SHA-256 hash of the plaintext token provided by the client.
 	// Remember that this returns a byte *array* with length 32, not a slice.
 	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
@@ -179,7 +248,7 @@ func (m UserModel) GetForToken(tokenScope, tokenPlaintext string) (*User, error)
 	AND tokens.expiry > $3`
 	args := []interface{}{tokenHash[:], tokenScope, time.Now()}
 	var user User
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := withTimeout(ctx, m.Timeout)
 	defer cancel()
 	// Execute the query, scanning the return values into a User struct. If no matching
 	// record is found we return an ErrRecordNotFound error.
@@ -0,0 +1,42 @@
+package data
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/henrtytanoh/greenlight/internal/validator"
+)
+
+func TestValidatePasswordPlaintext(t *testing.T) {
+	defer SetPasswordPolicy(currentPolicy)
+
+	tests := []struct {
+		name      string
+		minLength int
+		password  string
+		wantValid bool
+	}{
+		{"empty", 6, "", false},
+		{"shorter than the policy", 6, "tulip", false},
+		{"as long as a shorter policy", 6, "tulips", true},
+		{"as long as the default policy", 8, "tulips-1", true},
+		{"shorter than a longer policy", 12, "tulips-1", false},
+		{"breached", 6, "password", false},
+		{"longest", 6, strings.Repeat("tulips-1", 32), true},
+		{"too long", 6, strings.Repeat("tulips-1", 32) + "!", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			policy := DefaultPasswordPolicy
+			policy.MinLength = tt.minLength
+			SetPasswordPolicy(policy)
+
+			v := validator.New()
+			ValidatePasswordPlaintext(v, tt.password, nil)
+			if v.Valid() != tt.wantValid {
+				t.Errorf("got valid %t (%v); want %t", v.Valid(), v.Errors, tt.wantValid)
+			}
+		})
+	}
+}
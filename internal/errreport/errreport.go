@@ -0,0 +1,102 @@
+// Package errreport classifies the errors which fail requests and forwards the ones
+// worth a developer's attention to an error tracker.
+package errreport
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"net"
+	"syscall"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Class tells who is to blame for an error, which decides how loudly it is reported.
+type Class string
+
+const (
+	// The client went away or gave up, nothing is wrong on our side.
+	ClassClient Class = "client"
+	// A dependency (Postgres, redis, SMTP...) is down, overloaded or slow. Retrying
+	// later may succeed.
+	ClassTransient Class = "transient"
+	// Anything else, which needs fixing.
+	ClassBug Class = "bug"
+)
+
+// Postgres error classes and codes which come from the state of the server rather than
+// from the query.
+var transientPostgresClasses = []pq.ErrorClass{
+	"08", // connection exception
+	"53", // insufficient resources
+	"57", // operator intervention, such as a shutdown
+	"58", // system error
+}
+
+var transientPostgresCodes = []pq.ErrorCode{
+	"40001", // serialization_failure
+	"40P01", // deadlock_detected
+}
+
+// Classify() returns the class of an error.
+func Classify(err error) Class {
+	if errors.Is(err, context.Canceled) {
+		return ClassClient
+	}
+
+	if errors.Is(err, context.DeadlineExceeded) ||
+		errors.Is(err, driver.ErrBadConn) ||
+		errors.Is(err, sql.ErrConnDone) ||
+		errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.EPIPE) {
+		return ClassTransient
+	}
+
+	// Dial errors, timeouts, and redis pool timeouts.
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return ClassTransient
+	}
+
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		for _, class := range transientPostgresClasses {
+			if pqErr.Code.Class() == class {
+				return ClassTransient
+			}
+		}
+		for _, code := range transientPostgresCodes {
+			if pqErr.Code == code {
+				return ClassTransient
+			}
+		}
+	}
+
+	return ClassBug
+}
+
+// Event is an error reported to a tracker, with the request it failed.
+type Event struct {
+	Time  time.Time
+	Class Class
+	Err   error
+	Stack string
+
+	RequestID string
+	Method    string
+	// URL is the path of the request, without its query string.
+	URL    string
+	Route  string
+	UserID int64
+}
+
+// Tracker is implemented by error trackers. Capture() must not block the request it is
+// called from; Close() sends the events which are still queued.
+type Tracker interface {
+	Capture(event Event)
+	Close(ctx context.Context) error
+}
@@ -0,0 +1,203 @@
+package errreport
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Events waiting to be sent beyond this are dropped, rather than slowing requests down
+// or using up memory while the tracker is unreachable.
+const sentryQueueSize = 100
+
+// SentryTracker sends events to a Sentry compatible tracker (Sentry, GlitchTip, or the
+// stand-in in cmd/examples/error-sink) through its store endpoint.
+type SentryTracker struct {
+	// OnError, if set, is called when an event can't be sent or is dropped.
+	OnError func(error)
+
+	endpoint    string
+	auth        string
+	environment string
+	release     string
+	client      *http.Client
+
+	mu     sync.Mutex
+	closed bool
+	events chan Event
+	done   chan struct{}
+}
+
+// NewSentryTracker() returns a tracker sending events to the project of the DSN, such as
+// https://public_key@sentry.example.com/42.
+func NewSentryTracker(dsn, environment, release string) (*SentryTracker, error) {
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return nil, fmt.Errorf("errreport: invalid DSN: %w", err)
+	}
+	key := u.User.Username()
+	project := path.Base(u.Path)
+	if u.Scheme == "" || u.Host == "" || key == "" || project == "" || project == "/" || project == "." {
+		return nil, errors.New("errreport: DSN must look like https://key@host/project")
+	}
+
+	endpoint := url.URL{
+		Scheme: u.Scheme,
+		Host:   u.Host,
+		Path:   path.Join(path.Dir(u.Path), "api", project, "store") + "/",
+	}
+
+	t := &SentryTracker{
+		endpoint:    endpoint.String(),
+		auth:        fmt.Sprintf("Sentry sentry_version=7, sentry_client=greenlight/%s, sentry_key=%s", release, key),
+		environment: environment,
+		release:     release,
+		client:      &http.Client{Timeout: 5 * time.Second},
+		events:      make(chan Event, sentryQueueSize),
+		done:        make(chan struct{}),
+	}
+	go t.run()
+	return t, nil
+}
+
+func (t *SentryTracker) Capture(event Event) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return
+	}
+
+	select {
+	case t.events <- event:
+	default:
+		t.fail(errors.New("errreport: queue full, dropping event"))
+	}
+}
+
+func (t *SentryTracker) Close(ctx context.Context) error {
+	t.mu.Lock()
+	if !t.closed {
+		t.closed = true
+		close(t.events)
+	}
+	t.mu.Unlock()
+
+	select {
+	case <-t.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (t *SentryTracker) run() {
+	defer close(t.done)
+	for event := range t.events {
+		err := t.send(event)
+		if err != nil {
+			t.fail(err)
+		}
+	}
+}
+
+func (t *SentryTracker) fail(err error) {
+	if t.OnError != nil {
+		t.OnError(err)
+	}
+}
+
+// sentryEvent is the subset of Sentry's event payload which we fill in.
+type sentryEvent struct {
+	EventID     string            `json:"event_id"`
+	Timestamp   string            `json:"timestamp"`
+	Level       string            `json:"level"`
+	Platform    string            `json:"platform"`
+	Logger      string            `json:"logger"`
+	Environment string            `json:"environment,omitempty"`
+	Release     string            `json:"release,omitempty"`
+	Transaction string            `json:"transaction,omitempty"`
+	Tags        map[string]string `json:"tags"`
+	Exception   struct {
+		Values []sentryException `json:"values"`
+	} `json:"exception"`
+	Request struct {
+		Method string `json:"method,omitempty"`
+		URL    string `json:"url,omitempty"`
+	} `json:"request"`
+	User  map[string]string      `json:"user,omitempty"`
+	Extra map[string]interface{} `json:"extra,omitempty"`
+}
+
+type sentryException struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+func (t *SentryTracker) send(event Event) error {
+	id := make([]byte, 16)
+	_, err := rand.Read(id)
+	if err != nil {
+		return err
+	}
+
+	payload := sentryEvent{
+		EventID:     hex.EncodeToString(id),
+		Timestamp:   event.Time.UTC().Format(time.RFC3339),
+		Level:       "error",
+		Platform:    "go",
+		Logger:      "greenlight",
+		Environment: t.environment,
+		Release:     t.release,
+		Transaction: event.Route,
+		Tags:        map[string]string{"class": string(event.Class)},
+	}
+	if event.RequestID != "" {
+		payload.Tags["request_id"] = event.RequestID
+	}
+	payload.Exception.Values = []sentryException{{
+		Type:  fmt.Sprintf("%T", event.Err),
+		Value: event.Err.Error(),
+	}}
+	payload.Request.Method = event.Method
+	payload.Request.URL = event.URL
+	if event.UserID != 0 {
+		payload.User = map[string]string{"id": strconv.FormatInt(event.UserID, 10)}
+	}
+	if event.Stack != "" {
+		payload.Extra = map[string]interface{}{"stack": event.Stack}
+	}
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, t.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Sentry-Auth", t.auth)
+
+	res, err := t.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("errreport: tracker responded %s", strings.ToLower(res.Status))
+	}
+	return nil
+}
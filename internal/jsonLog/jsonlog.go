@@ -2,9 +2,12 @@ package jsonlog
 
 import (
 	"encoding/json"
+	"fmt"
 	"io"
+	"math/rand"
 	"os"
 	"runtime/debug"
+	"strings"
 	"sync"
 	"time"
 )
@@ -15,80 +18,146 @@ type Level int8
 // Initialize constants which represent a specific severity level. We use the iota
 // keyword as a shortcut to assign successive integer values to the constants.
 const (
-	LevelInfo  Level = iota // Has the value 0.
-	LevelError              // Has the value 1.
-	LevelFatal              // Has the value 2.
-	LevelOff                // Has the value 3.
+	LevelDebug Level = iota // Has the value 0.
+	LevelInfo               // Has the value 1.
+	LevelWarn               // Has the value 2.
+	LevelError              // Has the value 3.
+	LevelFatal              // Has the value 4.
+	LevelOff                // Has the value 5.
 )
 
 // Return a human-friendly string for the severity level.
 func (l Level) String() string {
 	switch l {
+	case LevelDebug:
+		return "DEBUG"
 	case LevelInfo:
 		return "INFO"
+	case LevelWarn:
+		return "WARN"
 	case LevelError:
 		return "ERROR"
 	case LevelFatal:
 		return "FATAL"
+	case LevelOff:
+		return "OFF"
 	default:
 		return ""
 	}
 }
 
+// ParseLevel() returns the level with the given name, such as "debug" or "WARN".
+func ParseLevel(name string) (Level, error) {
+	for level := LevelDebug; level <= LevelOff; level++ {
+		if strings.EqualFold(name, level.String()) {
+			return level, nil
+		}
+	}
+	return LevelOff, fmt.Errorf("jsonlog: unknown level %q", name)
+}
+
+// Properties are the structured data of a log entry. Values keep their type in the
+// JSON output, except errors and durations which are written as strings.
+type Properties map[string]interface{}
+
 // Define a custom Logger type. This holds the output destination that the log entries
 // will be written to, the minimum severity level that log entries will be written for,
-// plus a mutex for coordinating the writes.
+// plus a mutex for coordinating the writes. Loggers derived with With() or Sampled()
+// share the output and the mutex of their parent.
 type Logger struct {
-	out      io.Writer
-	minLevel Level
-	mu       sync.Mutex
+	out        io.Writer
+	minLevel   Level
+	stackLevel Level
+	sampleRate float64
+	properties Properties
+	mu         *sync.Mutex
 }
 
 // Return a new Logger instance which writes log entries at or above a minimum severity
-// level to a specific output destination.
+// level to a specific output destination. Entries at the ERROR level and above carry a
+// stack trace.
 func New(out io.Writer, minLevel Level) *Logger {
 	return &Logger{
-		out:      out,
-		minLevel: minLevel,
+		out:        out,
+		minLevel:   minLevel,
+		stackLevel: LevelError,
+		sampleRate: 1,
+		mu:         &sync.Mutex{},
 	}
 }
 
+// SetStackTraceLevel() sets the level from which entries carry a stack trace. LevelOff
+// leaves them out altogether.
+func (l *Logger) SetStackTraceLevel(level Level) {
+	l.stackLevel = level
+}
+
+// Enabled() reports whether entries at the given level are written.
+func (l *Logger) Enabled(level Level) bool {
+	return level >= l.minLevel && l.minLevel < LevelOff
+}
+
+// With() returns a logger which adds the given properties to every entry.
+func (l *Logger) With(properties Properties) *Logger {
+	child := *l
+	child.properties = merge(l.properties, properties)
+	return &child
+}
+
+// Sampled() returns a logger which only writes the given fraction (0 to 1) of its
+// DEBUG and INFO entries, for logs such as request logs which would otherwise drown
+// everything else. Warnings and errors are always written.
+func (l *Logger) Sampled(rate float64) *Logger {
+	child := *l
+	child.sampleRate = rate
+	return &child
+}
+
 // Declare some helper methods for writing log entries at the different levels. Notice
 // that these all accept a map as the second parameter which can contain any arbitrary
 // 'properties' that you want to appear in the log entry.
-func (l *Logger) PrintInfo(message string, properties map[string]string) {
+func (l *Logger) PrintDebug(message string, properties Properties) {
+	l.print(LevelDebug, message, properties)
+}
+func (l *Logger) PrintInfo(message string, properties Properties) {
 	l.print(LevelInfo, message, properties)
 }
-func (l *Logger) PrintError(err error, properties map[string]string) {
+func (l *Logger) PrintWarn(message string, properties Properties) {
+	l.print(LevelWarn, message, properties)
+}
+func (l *Logger) PrintError(err error, properties Properties) {
 	l.print(LevelError, err.Error(), properties)
 }
-func (l *Logger) PrintFatal(err error, properties map[string]string) {
+func (l *Logger) PrintFatal(err error, properties Properties) {
 	l.print(LevelFatal, err.Error(), properties)
 	os.Exit(1) // For entries at the FATAL level, we also terminate the application.
 }
 
 // Print is an internal method for writing the log entry.
-func (l *Logger) print(level Level, message string, properties map[string]string) (int, error) {
+func (l *Logger) print(level Level, message string, properties Properties) (int, error) {
 	// If the severity level of the log entry is below the minimum severity for the
 	// logger, then return with no further action.
-	if level < l.minLevel {
+	if !l.Enabled(level) {
+		return 0, nil
+	}
+	if level < LevelWarn && l.sampleRate < 1 && rand.Float64() >= l.sampleRate {
 		return 0, nil
 	}
 	// Declare an anonymous struct holding the data for the log entry.
 	aux := struct {
-		Level      string            `json:"level"`
-		Time       string            `json:"time"`
-		Message    string            `json:"message"`
-		Properties map[string]string `json:"properties,omitempty"`
-		Trace      string            `json:"trace,omitempty"`
+		Level      string     `json:"level"`
+		Time       string     `json:"time"`
+		Message    string     `json:"message"`
+		Properties Properties `json:"properties,omitempty"`
+		Trace      string     `json:"trace,omitempty"`
 	}{
 		Level:      level.String(),
 		Time:       time.Now().UTC().Format(time.RFC3339),
 		Message:    message,
-		Properties: properties,
+		Properties: normalize(merge(l.properties, properties)),
 	}
-	// Include a stack trace for entries at the ERROR and FATAL levels.
-	if level >= LevelError {
+	// Include a stack trace for entries at or above the stack trace level.
+	if level >= l.stackLevel {
 		aux.Trace = string(debug.Stack())
 	}
 	// Declare a line variable for holding the actual log entry text.
@@ -115,3 +184,52 @@ func (l *Logger) print(level Level, message string, properties map[string]string
 func (l *Logger) Write(message []byte) (n int, err error) {
 	return l.print(LevelError, string(message), nil)
 }
+
+// merge() returns the properties of both maps, the second one winning, without
+// modifying either of them.
+func merge(base, properties Properties) Properties {
+	if len(base) == 0 {
+		return properties
+	}
+	if len(properties) == 0 {
+		return base
+	}
+	merged := make(Properties, len(base)+len(properties))
+	for key, value := range base {
+		merged[key] = value
+	}
+	for key, value := range properties {
+		merged[key] = value
+	}
+	return merged
+}
+
+// normalize() replaces the values which don't marshal to anything useful: errors marshal
+// to {} and durations to nanoseconds.
+func normalize(properties Properties) Properties {
+	var normalized Properties
+	for key, value := range properties {
+		var replacement interface{}
+		switch value := value.(type) {
+		case error:
+			replacement = value.Error()
+		case time.Duration:
+			replacement = value.String()
+		case Properties:
+			replacement = normalize(value)
+		default:
+			continue
+		}
+		if normalized == nil {
+			normalized = make(Properties, len(properties))
+			for key, value := range properties {
+				normalized[key] = value
+			}
+		}
+		normalized[key] = replacement
+	}
+	if normalized == nil {
+		return properties
+	}
+	return normalized
+}
@@ -0,0 +1,118 @@
+package jsonlog
+
+import (
+	"context"
+	"log/slog"
+	"time"
+)
+
+// Handler is a slog.Handler which writes records through a Logger, so that code logging
+// with log/slog, ours or a library's, ends up in the same log with the same format.
+type Handler struct {
+	logger     *Logger
+	group      []string
+	properties Properties
+}
+
+func NewHandler(logger *Logger) *Handler {
+	return &Handler{logger: logger}
+}
+
+func (h *Handler) Enabled(_ context.Context, level slog.Level) bool {
+	return h.logger.Enabled(fromSlogLevel(level))
+}
+
+func (h *Handler) Handle(_ context.Context, record slog.Record) error {
+	properties := copyProperties(h.properties)
+	record.Attrs(func(attr slog.Attr) bool {
+		h.add(properties, attr)
+		return true
+	})
+	_, err := h.logger.print(fromSlogLevel(record.Level), record.Message, properties)
+	return err
+}
+
+func (h *Handler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	properties := copyProperties(h.properties)
+	for _, attr := range attrs {
+		h.add(properties, attr)
+	}
+	return &Handler{logger: h.logger, group: h.group, properties: properties}
+}
+
+func (h *Handler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+	group := append(append([]string(nil), h.group...), name)
+	return &Handler{logger: h.logger, group: group, properties: h.properties}
+}
+
+// add() stores the attribute in the properties, nested under the handler's groups.
+func (h *Handler) add(properties Properties, attr slog.Attr) {
+	for _, name := range h.group {
+		nested, ok := properties[name].(Properties)
+		if !ok {
+			nested = Properties{}
+			properties[name] = nested
+		}
+		properties = nested
+	}
+	addAttr(properties, attr)
+}
+
+func addAttr(properties Properties, attr slog.Attr) {
+	attr.Value = attr.Value.Resolve()
+	if attr.Equal(slog.Attr{}) {
+		return
+	}
+
+	switch attr.Value.Kind() {
+	case slog.KindGroup:
+		attrs := attr.Value.Group()
+		if len(attrs) == 0 {
+			return
+		}
+		// Attributes of an unnamed group are inlined.
+		group := properties
+		if attr.Key != "" {
+			group = Properties{}
+			properties[attr.Key] = group
+		}
+		for _, attr := range attrs {
+			addAttr(group, attr)
+		}
+	case slog.KindTime:
+		properties[attr.Key] = attr.Value.Time().UTC().Format(time.RFC3339)
+	default:
+		properties[attr.Key] = attr.Value.Any()
+	}
+}
+
+// copyProperties() deep copies the properties, so that groups can be added to without
+// affecting the handler they come from.
+func copyProperties(properties Properties) Properties {
+	copied := make(Properties, len(properties))
+	for key, value := range properties {
+		if group, ok := value.(Properties); ok {
+			value = copyProperties(group)
+		}
+		copied[key] = value
+	}
+	return copied
+}
+
+// fromSlogLevel() maps slog's levels onto ours. Levels between two slog levels, such as
+// slog.LevelInfo+2, are rounded down; there is no FATAL level in slog.
+func fromSlogLevel(level slog.Level) Level {
+	switch {
+	case level >= slog.LevelError:
+		return LevelError
+	case level >= slog.LevelWarn:
+		return LevelWarn
+	case level >= slog.LevelInfo:
+		return LevelInfo
+	default:
+		return LevelDebug
+	}
+}
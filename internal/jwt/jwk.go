@@ -0,0 +1,94 @@
+package jwt
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"errors"
+	"math/big"
+)
+
+var ErrUnknownKey = errors.New("jwt: unknown signing key")
+
+// JWK is the public part of a signing key, as published in a JWKS document.
+type JWK struct {
+	KeyType   string `json:"kty"`
+	KeyID     string `json:"kid,omitempty"`
+	Use       string `json:"use,omitempty"`
+	Algorithm string `json:"alg,omitempty"`
+	Curve     string `json:"crv,omitempty"`
+	X         string `json:"x,omitempty"`
+	N         string `json:"n,omitempty"`
+	E         string `json:"e,omitempty"`
+}
+
+// JWKS is a JSON Web Key Set.
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+// NewJWK describes an Ed25519 or RSA public key as a JWK.
+func NewJWK(keyID string, key crypto.PublicKey) (JWK, error) {
+	switch k := key.(type) {
+	case ed25519.PublicKey:
+		return JWK{
+			KeyType:   "OKP",
+			KeyID:     keyID,
+			Use:       "sig",
+			Algorithm: AlgEdDSA,
+			Curve:     "Ed25519",
+			X:         encoding.EncodeToString(k),
+		}, nil
+	case *rsa.PublicKey:
+		return JWK{
+			KeyType:   "RSA",
+			KeyID:     keyID,
+			Use:       "sig",
+			Algorithm: AlgRS256,
+			N:         encoding.EncodeToString(k.N.Bytes()),
+			E:         encoding.EncodeToString(big.NewInt(int64(k.E)).Bytes()),
+		}, nil
+	default:
+		return JWK{}, ErrUnsupportedAlgorithm
+	}
+}
+
+// PublicKey decodes the key material of a JWK.
+func (k JWK) PublicKey() (crypto.PublicKey, error) {
+	switch k.KeyType {
+	case "OKP":
+		if k.Curve != "Ed25519" {
+			return nil, ErrUnsupportedAlgorithm
+		}
+		x, err := encoding.DecodeString(k.X)
+		if err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, ErrMalformed
+		}
+		return ed25519.PublicKey(x), nil
+	case "RSA":
+		n, err := encoding.DecodeString(k.N)
+		if err != nil {
+			return nil, ErrMalformed
+		}
+		e, err := encoding.DecodeString(k.E)
+		if err != nil {
+			return nil, ErrMalformed
+		}
+		return &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}, nil
+	default:
+		return nil, ErrUnsupportedAlgorithm
+	}
+}
+
+// Lookup returns the public key with the given key ID.
+func (s JWKS) Lookup(keyID string) (crypto.PublicKey, error) {
+	for _, k := range s.Keys {
+		if k.KeyID == keyID {
+			return k.PublicKey()
+		}
+	}
+	return nil, ErrUnknownKey
+}
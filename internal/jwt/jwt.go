@@ -0,0 +1,209 @@
+// Package jwt implements the small subset of JSON Web Tokens (RFC 7519) and JSON Web
+// Keys (RFC 7517) needed by greenlight: compact JWS tokens signed with EdDSA (Ed25519)
+// or RS256.
+package jwt
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Supported signing algorithms.
+const (
+	AlgEdDSA = "EdDSA"
+	AlgRS256 = "RS256"
+)
+
+var (
+	ErrMalformed            = errors.New("jwt: malformed token")
+	ErrUnsupportedAlgorithm = errors.New("jwt: unsupported algorithm")
+	ErrInvalidSignature     = errors.New("jwt: invalid signature")
+	ErrExpired              = errors.New("jwt: token is expired")
+	ErrNotYetValid          = errors.New("jwt: token is not valid yet")
+)
+
+var encoding = base64.RawURLEncoding
+
+// Header is the JOSE header of a token.
+type Header struct {
+	Algorithm string `json:"alg"`
+	Type      string `json:"typ,omitempty"`
+	KeyID     string `json:"kid,omitempty"`
+}
+
+// Claims holds the registered claims. Embed it in a struct to add private claims.
+type Claims struct {
+	Issuer    string   `json:"iss,omitempty"`
+	Subject   string   `json:"sub,omitempty"`
+	Audience  Audience `json:"aud,omitempty"`
+	ExpiresAt int64    `json:"exp,omitempty"`
+	NotBefore int64    `json:"nbf,omitempty"`
+	IssuedAt  int64    `json:"iat,omitempty"`
+	ID        string   `json:"jti,omitempty"`
+}
+
+// Validate checks the time based claims, allowing for the given clock skew.
+func (c Claims) Validate(now time.Time, leeway time.Duration) error {
+	if c.ExpiresAt != 0 && now.Add(-leeway).Unix() >= c.ExpiresAt {
+		return ErrExpired
+	}
+	if c.NotBefore != 0 && now.Add(leeway).Unix() < c.NotBefore {
+		return ErrNotYetValid
+	}
+	return nil
+}
+
+// Audience may be encoded as either a single string or an array of strings.
+type Audience []string
+
+func (a Audience) Contains(value string) bool {
+	for i := range a {
+		if a[i] == value {
+			return true
+		}
+	}
+	return false
+}
+
+func (a Audience) MarshalJSON() ([]byte, error) {
+	if len(a) == 1 {
+		return json.Marshal(a[0])
+	}
+	return json.Marshal([]string(a))
+}
+
+func (a *Audience) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*a = Audience{single}
+		return nil
+	}
+	var multiple []string
+	if err := json.Unmarshal(data, &multiple); err != nil {
+		return err
+	}
+	*a = multiple
+	return nil
+}
+
+// Sign encodes the claims and signs them with the given key. The algorithm is picked
+// from the type of the key: ed25519.PrivateKey signs with EdDSA and *rsa.PrivateKey
+// with RS256.
+func Sign(claims interface{}, keyID string, key crypto.Signer) (string, error) {
+	header := Header{Type: "JWT", KeyID: keyID}
+	switch key.(type) {
+	case ed25519.PrivateKey:
+		header.Algorithm = AlgEdDSA
+	case *rsa.PrivateKey:
+		header.Algorithm = AlgRS256
+	default:
+		return "", ErrUnsupportedAlgorithm
+	}
+
+	h, err := json.Marshal(header)
+	if err != nil {
+		return "", err
+	}
+	p, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	signingInput := encoding.EncodeToString(h) + "." + encoding.EncodeToString(p)
+
+	var signature []byte
+	switch k := key.(type) {
+	case ed25519.PrivateKey:
+		signature = ed25519.Sign(k, []byte(signingInput))
+	case *rsa.PrivateKey:
+		digest := sha256.Sum256([]byte(signingInput))
+		signature, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, digest[:])
+		if err != nil {
+			return "", err
+		}
+	}
+
+	return signingInput + "." + encoding.EncodeToString(signature), nil
+}
+
+// KeyFunc returns the public key that should be used to verify a token, usually by
+// looking up the header's key ID.
+type KeyFunc func(header Header) (crypto.PublicKey, error)
+
+// Parse verifies the signature of a compact token and decodes its payload into claims.
+// It does not validate the claims themselves; callers should do so once decoded.
+func Parse(token string, keyFunc KeyFunc, claims interface{}) (Header, error) {
+	var header Header
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return header, ErrMalformed
+	}
+
+	h, err := encoding.DecodeString(parts[0])
+	if err != nil {
+		return header, ErrMalformed
+	}
+	if err := json.Unmarshal(h, &header); err != nil {
+		return header, ErrMalformed
+	}
+
+	signature, err := encoding.DecodeString(parts[2])
+	if err != nil {
+		return header, ErrMalformed
+	}
+
+	key, err := keyFunc(header)
+	if err != nil {
+		return header, err
+	}
+
+	// The algorithm in the header must agree with the type of the key, otherwise an
+	// attacker could pick the algorithm used to verify their own token.
+	signingInput := parts[0] + "." + parts[1]
+	switch header.Algorithm {
+	case AlgEdDSA:
+		k, ok := key.(ed25519.PublicKey)
+		if !ok {
+			return header, ErrUnsupportedAlgorithm
+		}
+		if !ed25519.Verify(k, []byte(signingInput), signature) {
+			return header, ErrInvalidSignature
+		}
+	case AlgRS256:
+		k, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return header, ErrUnsupportedAlgorithm
+		}
+		digest := sha256.Sum256([]byte(signingInput))
+		if err := rsa.VerifyPKCS1v15(k, crypto.SHA256, digest[:], signature); err != nil {
+			return header, ErrInvalidSignature
+		}
+	default:
+		return header, fmt.Errorf("%w: %q", ErrUnsupportedAlgorithm, header.Algorithm)
+	}
+
+	payload, err := encoding.DecodeString(parts[1])
+	if err != nil {
+		return header, ErrMalformed
+	}
+	if err := json.Unmarshal(payload, claims); err != nil {
+		return header, ErrMalformed
+	}
+
+	return header, nil
+}
+
+// LooksLikeJWT reports whether a string has the three dot separated segments of a
+// compact token. It is a cheap check used to tell JWTs apart from opaque tokens.
+func LooksLikeJWT(token string) bool {
+	return strings.Count(token, ".") == 2
+}
@@ -0,0 +1,182 @@
+package jwt
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// forge() builds a token with any header and signature, as an attacker would.
+func forge(t *testing.T, header Header, claims interface{}, sign func(signingInput string) []byte) string {
+	t.Helper()
+
+	h, err := json.Marshal(header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signingInput := encoding.EncodeToString(h) + "." + encoding.EncodeToString(p)
+	return signingInput + "." + encoding.EncodeToString(sign(signingInput))
+}
+
+func TestParse(t *testing.T) {
+	edPublic, edPrivate, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaPrivate, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var jwks JWKS
+	for kid, key := range map[string]crypto.PublicKey{"ed": edPublic, "rsa": &rsaPrivate.PublicKey} {
+		jwk, err := NewJWK(kid, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		jwks.Keys = append(jwks.Keys, jwk)
+	}
+	keyFunc := func(header Header) (crypto.PublicKey, error) {
+		return jwks.Lookup(header.KeyID)
+	}
+
+	claims := Claims{Subject: "1", ExpiresAt: time.Now().Add(time.Hour).Unix()}
+
+	sign := func(kid string, key crypto.Signer) string {
+		token, err := Sign(claims, kid, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+
+	edToken := sign("ed", edPrivate)
+	rsaToken := sign("rsa", rsaPrivate)
+
+	// Swap the payload of a valid token for one granting another subject.
+	tamperedPayload, err := json.Marshal(Claims{Subject: "2", ExpiresAt: claims.ExpiresAt})
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts := strings.Split(edToken, ".")
+	tampered := parts[0] + "." + encoding.EncodeToString(tamperedPayload) + "." + parts[2]
+
+	tests := []struct {
+		name    string
+		token   string
+		wantErr error
+	}{
+		{"EdDSA", edToken, nil},
+		{"RS256", rsaToken, nil},
+		{"tampered payload", tampered, ErrInvalidSignature},
+		{"unknown kid", sign("other", edPrivate), ErrUnknownKey},
+		{"signed with another key under a known kid", func() string {
+			_, otherPrivate, err := ed25519.GenerateKey(rand.Reader)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return sign("ed", otherPrivate)
+		}(), ErrInvalidSignature},
+		{"alg none", forge(t, Header{Algorithm: "none", KeyID: "ed"}, claims, func(string) []byte {
+			return nil
+		}), ErrUnsupportedAlgorithm},
+		// The classic confusion: an HMAC signature keyed with the public key, which
+		// anyone can compute.
+		{"HS256 keyed with the RSA public key", forge(t, Header{Algorithm: "HS256", KeyID: "rsa"}, claims, func(signingInput string) []byte {
+			mac := hmac.New(sha256.New, rsaPrivate.PublicKey.N.Bytes())
+			mac.Write([]byte(signingInput))
+			return mac.Sum(nil)
+		}), ErrUnsupportedAlgorithm},
+		{"RS256 header on an Ed25519 key", forge(t, Header{Algorithm: AlgRS256, KeyID: "ed"}, claims, func(signingInput string) []byte {
+			return ed25519.Sign(edPrivate, []byte(signingInput))
+		}), ErrUnsupportedAlgorithm},
+		{"EdDSA header on an RSA key", forge(t, Header{Algorithm: AlgEdDSA, KeyID: "rsa"}, claims, func(signingInput string) []byte {
+			return ed25519.Sign(edPrivate, []byte(signingInput))
+		}), ErrUnsupportedAlgorithm},
+		{"two segments", parts[0] + "." + parts[1], ErrMalformed},
+		{"invalid base64 header", "!." + parts[1] + "." + parts[2], ErrMalformed},
+		{"invalid base64 signature", parts[0] + "." + parts[1] + ".!", ErrMalformed},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got Claims
+			_, err := Parse(tt.token, keyFunc, &got)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got error %v; want %v", err, tt.wantErr)
+			}
+			if tt.wantErr == nil && got.Subject != claims.Subject {
+				t.Errorf("got subject %q; want %q", got.Subject, claims.Subject)
+			}
+		})
+	}
+}
+
+func TestClaimsValidate(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+	leeway := 30 * time.Second
+
+	tests := []struct {
+		name    string
+		claims  Claims
+		wantErr error
+	}{
+		{"no time claims", Claims{}, nil},
+		{"valid", Claims{ExpiresAt: now.Unix() + 60, NotBefore: now.Unix() - 60}, nil},
+		{"expired", Claims{ExpiresAt: now.Unix() - 60}, ErrExpired},
+		{"expired within the leeway", Claims{ExpiresAt: now.Unix() - 10}, nil},
+		{"expiring at the leeway", Claims{ExpiresAt: now.Unix() - 30}, ErrExpired},
+		{"not yet valid", Claims{NotBefore: now.Unix() + 60}, ErrNotYetValid},
+		{"not yet valid within the leeway", Claims{NotBefore: now.Unix() + 10}, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.claims.Validate(now, leeway)
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("got error %v; want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestAudience(t *testing.T) {
+	tests := []struct {
+		json string
+		want Audience
+	}{
+		{`"greenlight"`, Audience{"greenlight"}},
+		{`["greenlight","other"]`, Audience{"greenlight", "other"}},
+	}
+
+	for _, tt := range tests {
+		var got Audience
+		err := json.Unmarshal([]byte(tt.json), &got)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !got.Contains("greenlight") || len(got) != len(tt.want) {
+			t.Errorf("got %v decoding %s; want %v", got, tt.json, tt.want)
+		}
+
+		encoded, err := json.Marshal(got)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(encoded) != tt.json {
+			t.Errorf("got %s encoding %v; want %s", encoded, got, tt.json)
+		}
+	}
+}
@@ -2,15 +2,23 @@ package mailer
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
 	"embed"
 	"fmt"
+	"net"
+	"strconv"
 	"text/template"
 	"time"
 
 	"github.com/go-mail/mail/v2"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
 )
 
+var tracer = otel.Tracer("github.com/henrtytanoh/greenlight/internal/mailer")
+
 //go:embed "templates"
 var templateFS embed.FS
 
@@ -32,10 +40,31 @@ func New(host string, port int, username, password, sender string) Mailer {
 	}
 }
 
+// Ping() checks that the SMTP server accepts connections, without sending anything.
+func (m Mailer) Ping(ctx context.Context) error {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(m.dialer.Host, strconv.Itoa(m.dialer.Port)))
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
 // Define a Send() method on the Mailer type. This takes the recipient email address
 // as the first parameter, the name of the file containing the templates, and any
-// dynamic data for the templates as an interface{} parameter.
-func (m Mailer) Send(recipient, templateFile string, data interface{}) error {
+// dynamic data for the templates as an interface{} parameter. The context only carries
+// the trace the send belongs to.
+func (m Mailer) Send(ctx context.Context, recipient, templateFile string, data interface{}) (err error) {
+	_, span := tracer.Start(ctx, "Mailer.Send")
+	span.SetAttributes(attribute.String("mail.template", templateFile))
+	defer func() {
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
+	}()
+
 	// Use the ParseFS() method to parse the required template file from the embedded
 	// file system.
 	tmpl, err := template.New("email").ParseFS(templateFS, "templates/"+templateFile)
@@ -0,0 +1,317 @@
+// Package oidc implements the relying party side of OpenID Connect: the authorization
+// code flow with PKCE (RFC 7636) and verification of the ID tokens returned by the
+// provider. Providers are configured with their issuer URL; everything else is read
+// from their discovery document.
+package oidc
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/henrtytanoh/greenlight/internal/jwt"
+)
+
+var (
+	ErrInvalidIDToken = errors.New("oidc: invalid id token")
+	ErrNonceMismatch  = errors.New("oidc: nonce mismatch")
+)
+
+// How long a fetched JWKS is trusted before it is fetched again, and how often at most
+// it is refetched because a token was signed with an unknown key.
+const (
+	jwksMaxAge      = time.Hour
+	jwksMinInterval = 10 * time.Second
+)
+
+// Config describes a provider, as listed in the -oidc-providers file.
+type Config struct {
+	Name         string   `json:"name"`
+	Issuer       string   `json:"issuer"`
+	ClientID     string   `json:"client_id"`
+	ClientSecret string   `json:"client_secret"`
+	RedirectURL  string   `json:"redirect_url"`
+	Scopes       []string `json:"scopes,omitempty"`
+}
+
+// Metadata is the part of the provider's discovery document that we use.
+type Metadata struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// Claims are the ID token claims used to find or create the user.
+type Claims struct {
+	jwt.Claims
+	Nonce         string    `json:"nonce"`
+	Email         string    `json:"email"`
+	EmailVerified emailFlag `json:"email_verified"`
+	Name          string    `json:"name"`
+	AuthorizedBy  string    `json:"azp,omitempty"`
+}
+
+// Some providers encode email_verified as the string "true" rather than a boolean.
+type emailFlag bool
+
+func (f *emailFlag) UnmarshalJSON(data []byte) error {
+	var b bool
+	if err := json.Unmarshal(data, &b); err == nil {
+		*f = emailFlag(b)
+		return nil
+	}
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	*f = emailFlag(s == "true")
+	return nil
+}
+
+// Provider is an OpenID Connect provider. Its discovery document and keys are fetched
+// lazily and cached, so that the API can start while a provider is unreachable.
+type Provider struct {
+	Config
+	client *http.Client
+
+	mu          sync.Mutex
+	metadata    *Metadata
+	jwks        jwt.JWKS
+	jwksFetched time.Time
+}
+
+// NewProvider returns a provider using the given HTTP client for every request it makes.
+func NewProvider(cfg Config, client *http.Client) *Provider {
+	if len(cfg.Scopes) == 0 {
+		cfg.Scopes = []string{"openid", "email", "profile"}
+	}
+	cfg.Issuer = strings.TrimSuffix(cfg.Issuer, "/")
+	return &Provider{Config: cfg, client: client}
+}
+
+// LoadProviders reads a JSON array of provider configs.
+func LoadProviders(r io.Reader, client *http.Client) (map[string]*Provider, error) {
+	var configs []Config
+	err := json.NewDecoder(r).Decode(&configs)
+	if err != nil {
+		return nil, fmt.Errorf("oidc: decoding providers: %w", err)
+	}
+
+	providers := make(map[string]*Provider, len(configs))
+	for _, cfg := range configs {
+		if cfg.Name == "" || cfg.Issuer == "" || cfg.ClientID == "" || cfg.RedirectURL == "" {
+			return nil, fmt.Errorf("oidc: provider %q: name, issuer, client_id and redirect_url are required", cfg.Name)
+		}
+		if _, exists := providers[cfg.Name]; exists {
+			return nil, fmt.Errorf("oidc: duplicate provider %q", cfg.Name)
+		}
+		providers[cfg.Name] = NewProvider(cfg, client)
+	}
+	return providers, nil
+}
+
+// RandomString returns a URL safe random string, suitable for a state, nonce or PKCE
+// code verifier.
+func RandomString() (string, error) {
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// CodeChallenge derives the S256 PKCE code challenge of a code verifier.
+func CodeChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// Metadata returns the provider's discovery document, fetching it on first use.
+func (p *Provider) Metadata(ctx context.Context) (*Metadata, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.metadata != nil {
+		return p.metadata, nil
+	}
+
+	var metadata Metadata
+	err := p.getJSON(ctx, p.Issuer+"/.well-known/openid-configuration", &metadata)
+	if err != nil {
+		return nil, err
+	}
+	// The issuer in the document must be the one we were configured with, otherwise
+	// a compromised discovery endpoint could substitute another provider's tokens.
+	if strings.TrimSuffix(metadata.Issuer, "/") != p.Issuer {
+		return nil, fmt.Errorf("oidc: provider %q: discovery document issuer %q does not match", p.Name, metadata.Issuer)
+	}
+	p.metadata = &metadata
+	return p.metadata, nil
+}
+
+// AuthCodeURL returns the URL the user is sent to in order to log in at the provider.
+func (p *Provider) AuthCodeURL(ctx context.Context, state, nonce, verifier string) (string, error) {
+	metadata, err := p.Metadata(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	params := url.Values{}
+	params.Set("response_type", "code")
+	params.Set("client_id", p.ClientID)
+	params.Set("redirect_uri", p.RedirectURL)
+	params.Set("scope", strings.Join(p.Scopes, " "))
+	params.Set("state", state)
+	params.Set("nonce", nonce)
+	params.Set("code_challenge", CodeChallenge(verifier))
+	params.Set("code_challenge_method", "S256")
+
+	separator := "?"
+	if strings.Contains(metadata.AuthorizationEndpoint, "?") {
+		separator = "&"
+	}
+	return metadata.AuthorizationEndpoint + separator + params.Encode(), nil
+}
+
+// Exchange redeems an authorization code at the token endpoint and returns the verified
+// claims of the ID token. The nonce must be the one sent with the authorization request.
+func (p *Provider) Exchange(ctx context.Context, code, verifier, nonce string) (*Claims, error) {
+	metadata, err := p.Metadata(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", p.RedirectURL)
+	form.Set("code_verifier", verifier)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, metadata.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(url.QueryEscape(p.ClientID), url.QueryEscape(p.ClientSecret))
+
+	res, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	var body struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	err = json.NewDecoder(io.LimitReader(res.Body, 1<<20)).Decode(&body)
+	if err != nil {
+		return nil, fmt.Errorf("oidc: decoding token response: %w", err)
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("oidc: token endpoint returned %d: %s %s", res.StatusCode, body.Error, body.ErrorDescription)
+	}
+	if body.IDToken == "" {
+		return nil, fmt.Errorf("%w: missing from token response", ErrInvalidIDToken)
+	}
+
+	return p.Verify(ctx, body.IDToken, nonce)
+}
+
+// Verify checks the signature and claims of an ID token issued to us.
+func (p *Provider) Verify(ctx context.Context, idToken, nonce string) (*Claims, error) {
+	var claims Claims
+	header, err := jwt.Parse(idToken, func(header jwt.Header) (crypto.PublicKey, error) {
+		return p.publicKey(ctx, header.KeyID)
+	}, &claims)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidIDToken, err)
+	}
+
+	err = claims.Validate(time.Now(), time.Minute)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidIDToken, err)
+	}
+	switch {
+	case strings.TrimSuffix(claims.Issuer, "/") != p.Issuer:
+		return nil, fmt.Errorf("%w: unexpected issuer %q", ErrInvalidIDToken, claims.Issuer)
+	case !claims.Audience.Contains(p.ClientID):
+		return nil, fmt.Errorf("%w: not issued to this client", ErrInvalidIDToken)
+	case len(claims.Audience) > 1 && claims.AuthorizedBy != p.ClientID:
+		return nil, fmt.Errorf("%w: not authorized for this client", ErrInvalidIDToken)
+	case claims.ExpiresAt == 0 || claims.Subject == "":
+		return nil, fmt.Errorf("%w: missing exp or sub claim", ErrInvalidIDToken)
+	case header.Algorithm != jwt.AlgRS256 && header.Algorithm != jwt.AlgEdDSA:
+		return nil, fmt.Errorf("%w: unsupported algorithm %q", ErrInvalidIDToken, header.Algorithm)
+	case claims.Nonce != nonce:
+		return nil, ErrNonceMismatch
+	}
+	return &claims, nil
+}
+
+// publicKey() returns the provider's key with the given ID. The JWKS is refetched when
+// it is old or when the key is unknown, as providers rotate their keys regularly.
+func (p *Provider) publicKey(ctx context.Context, keyID string) (crypto.PublicKey, error) {
+	metadata, err := p.Metadata(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	key, err := p.jwks.Lookup(keyID)
+	stale := time.Since(p.jwksFetched) > jwksMaxAge
+	if err == nil && !stale {
+		return key, nil
+	}
+	if !stale && time.Since(p.jwksFetched) < jwksMinInterval {
+		return nil, jwt.ErrUnknownKey
+	}
+
+	var jwks jwt.JWKS
+	err = p.getJSON(ctx, metadata.JWKSURI, &jwks)
+	if err != nil {
+		return nil, err
+	}
+	p.jwks = jwks
+	p.jwksFetched = time.Now()
+	return p.jwks.Lookup(keyID)
+}
+
+func (p *Provider) getJSON(ctx context.Context, url string, dst interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	res, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("oidc: GET %s returned %d", url, res.StatusCode)
+	}
+	err = json.NewDecoder(io.LimitReader(res.Body, 1<<20)).Decode(dst)
+	if err != nil {
+		return fmt.Errorf("oidc: decoding %s: %w", url, err)
+	}
+	return nil
+}
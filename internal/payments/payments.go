@@ -0,0 +1,71 @@
+// Package payments defines how greenlight talks to a payment provider: it opens a
+// checkout session when a user subscribes, and the provider reports what happened
+// afterwards (payment, renewal, cancellation) through signed webhook events.
+package payments
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+)
+
+var ErrInvalidSignature = errors.New("payments: invalid webhook signature")
+
+// Event types understood by the API. Providers translate their own events into these.
+const (
+	// The user completed the checkout, the subscription can start.
+	EventCheckoutCompleted = "checkout.completed"
+	// A renewal was paid for, the subscription runs until the event's PeriodEnd.
+	EventInvoicePaid = "invoice.paid"
+	// A renewal payment failed. The provider will usually retry it.
+	EventPaymentFailed = "invoice.payment_failed"
+	// The subscription was canceled at the provider and has ended.
+	EventSubscriptionCanceled = "subscription.canceled"
+)
+
+// CheckoutRequest describes the subscription being paid for.
+type CheckoutRequest struct {
+	// Reference is our own identifier of the subscription. The provider includes it in
+	// every event about the subscription.
+	Reference   string
+	Email       string
+	PlanCode    string
+	PlanName    string
+	AmountCents int
+	Currency    string
+	PeriodDays  int
+	TrialDays   int
+}
+
+// Checkout is a checkout session opened at the provider. The user completes the
+// payment by following its URL.
+type Checkout struct {
+	ID  string
+	URL string
+}
+
+// Event is a verified webhook event.
+type Event struct {
+	ID   string
+	Type string
+	// Reference is the CheckoutRequest.Reference of the subscription concerned.
+	Reference string
+	// SubscriptionID is the provider's identifier of the subscription.
+	SubscriptionID string
+	// PeriodEnd is set on invoice.paid events.
+	PeriodEnd time.Time
+	CreatedAt time.Time
+}
+
+// PaymentProvider is implemented by each payment provider integration.
+type PaymentProvider interface {
+	Name() string
+	CreateCheckout(ctx context.Context, req CheckoutRequest) (*Checkout, error)
+	// SetCancelAtPeriodEnd cancels a subscription at the end of its current period, or
+	// resumes a subscription which was going to be canceled.
+	SetCancelAtPeriodEnd(ctx context.Context, subscriptionID string, cancel bool) error
+	// ParseWebhook verifies the signature of a webhook request and decodes its event.
+	// It returns ErrInvalidSignature when the request didn't come from the provider.
+	ParseWebhook(payload []byte, header http.Header) (*Event, error)
+}
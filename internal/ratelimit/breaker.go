@@ -0,0 +1,75 @@
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+// Breaker states.
+const (
+	BreakerClosed   = "closed"
+	BreakerOpen     = "open"
+	BreakerHalfOpen = "half-open"
+)
+
+// Breaker is a circuit breaker around redis. After Threshold consecutive failures it
+// opens, and calls aren't attempted for Cooldown. It then lets a single call through:
+// if that call succeeds the breaker closes again, otherwise it stays open for another
+// Cooldown.
+type Breaker struct {
+	Threshold int
+	Cooldown  time.Duration
+
+	mu       sync.Mutex
+	state    string
+	failures int
+	// When the breaker opened, or when the current trial call was let through.
+	since time.Time
+}
+
+func NewBreaker(threshold int, cooldown time.Duration) *Breaker {
+	return &Breaker{Threshold: threshold, Cooldown: cooldown, state: BreakerClosed}
+}
+
+// Allow() reports whether a call may be attempted.
+func (b *Breaker) Allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == BreakerClosed {
+		return true
+	}
+	// Once the cooldown has passed a trial call is let through, and then another one
+	// only if the previous trial didn't report back within a cooldown.
+	if time.Since(b.since) < b.Cooldown {
+		return false
+	}
+	b.state = BreakerHalfOpen
+	b.since = time.Now()
+	return true
+}
+
+// Success() records a call which succeeded.
+func (b *Breaker) Success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.state = BreakerClosed
+	b.failures = 0
+}
+
+// Failure() records a call which failed.
+func (b *Breaker) Failure() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures++
+	if b.state == BreakerHalfOpen || b.failures >= b.Threshold {
+		b.state = BreakerOpen
+		b.since = time.Now()
+	}
+}
+
+func (b *Breaker) State() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
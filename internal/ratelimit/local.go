@@ -0,0 +1,81 @@
+package ratelimit
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// LocalLimiter is an in-process token bucket per key, used while redis is unavailable.
+// Each replica counts on its own, so the limit is only enforced per replica. To bound
+// memory it tracks at most Size keys, evicting the least recently seen; an evicted
+// client simply starts again with a full bucket.
+type LocalLimiter struct {
+	Limit  int
+	Window time.Duration
+	Size   int
+
+	mu      sync.Mutex
+	buckets map[string]*list.Element
+	lru     *list.List
+}
+
+type bucket struct {
+	key     string
+	tokens  float64
+	updated time.Time
+}
+
+func NewLocalLimiter(limit int, window time.Duration, size int) *LocalLimiter {
+	return &LocalLimiter{
+		Limit:   limit,
+		Window:  window,
+		Size:    size,
+		buckets: make(map[string]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+// Allow() counts a request by key and reports whether it is within the limit.
+func (l *LocalLimiter) Allow(key string) Result {
+	now := time.Now()
+	// Tokens refill continuously, a whole bucket per window.
+	rate := float64(l.Limit) / l.Window.Seconds()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var b *bucket
+	if element, ok := l.buckets[key]; ok {
+		l.lru.MoveToFront(element)
+		b = element.Value.(*bucket)
+		b.tokens += now.Sub(b.updated).Seconds() * rate
+		if b.tokens > float64(l.Limit) {
+			b.tokens = float64(l.Limit)
+		}
+		b.updated = now
+	} else {
+		b = &bucket{key: key, tokens: float64(l.Limit), updated: now}
+		l.buckets[key] = l.lru.PushFront(b)
+		if l.lru.Len() > l.Size {
+			oldest := l.lru.Back()
+			l.lru.Remove(oldest)
+			delete(l.buckets, oldest.Value.(*bucket).key)
+		}
+	}
+
+	result := Result{Limit: l.Limit}
+	if b.tokens >= 1 {
+		b.tokens--
+		result.Allowed = true
+	} else {
+		result.RetryAfter = seconds((1 - b.tokens) / rate)
+	}
+	result.Remaining = int(b.tokens)
+	result.Reset = seconds((float64(l.Limit) - b.tokens) / rate)
+	return result
+}
+
+func seconds(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
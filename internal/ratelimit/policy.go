@@ -0,0 +1,369 @@
+package ratelimit
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Kinds of clients policies can be restricted to.
+const (
+	ClientAnonymous = "anonymous"
+	ClientUser      = "user"
+	ClientAPIKey    = "api_key"
+	ClientOAuthApp  = "oauth_app"
+)
+
+// Fallback modes, which decide what happens to requests while redis is unavailable:
+// counting them in process, letting them all through, or rejecting them all.
+const (
+	FallbackLocal  = "local"
+	FallbackOpen   = "open"
+	FallbackClosed = "closed"
+)
+
+// ErrUnavailable is returned for every request while redis is unavailable in the
+// closed fallback mode.
+var ErrUnavailable = errors.New("ratelimit: redis is unavailable")
+
+// Fallback configures how the limits behave when redis fails.
+type Fallback struct {
+	Mode string
+	// FailureThreshold consecutive redis errors open the circuit breaker, which then
+	// stays open for Cooldown before redis is tried again.
+	FailureThreshold int
+	Cooldown         time.Duration
+	// Timeout bounds each call to redis, so that a hung server fails fast.
+	Timeout time.Duration
+	// LocalSize is how many clients the in-process limiter of each policy tracks.
+	LocalSize int
+}
+
+// What policies count requests by. KeyUser counts authenticated requests per user and
+// anonymous ones per IP address.
+const (
+	KeyIP   = "ip"
+	KeyUser = "user"
+)
+
+// Request describes a request for the purpose of picking its policy.
+type Request struct {
+	Method string
+	Path   string
+	IP     string
+	// UserID is zero for anonymous requests.
+	UserID int64
+	// Client is one of the Client constants.
+	Client string
+	// Plan returns the code of the plan the user is subscribed to, or "" if none. It is
+	// only called when a policy is restricted to plans.
+	Plan func() (string, error)
+}
+
+// Duration is a time.Duration which is written as a string, such as "1m", in JSON.
+type Duration time.Duration
+
+func (d Duration) Duration() time.Duration {
+	return time.Duration(d)
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	err := json.Unmarshal(b, &s)
+	if err != nil {
+		return err
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+// Policy is a limit which applies to the requests it matches. A request matches when
+// it matches one of each non-empty list: Routes ("/v1/tokens/*" or "POST /v1/users",
+// a trailing * matching any suffix), Clients, and Plans ("*" for any plan).
+type Policy struct {
+	Name     string   `json:"name"`
+	Routes   []string `json:"routes"`
+	Clients  []string `json:"clients"`
+	Plans    []string `json:"plans"`
+	Key      string   `json:"key"`
+	Limit    int      `json:"limit"`
+	Window   Duration `json:"window"`
+	Strategy string   `json:"strategy"`
+
+	limiter *Limiter
+	local   *LocalLimiter
+}
+
+// Policies holds the policies in the order they are tried, and the default policy for
+// requests none of them match. Requests from allowlisted IP addresses or networks are
+// never limited.
+//
+// The authentication policy is checked first, before the request's credentials are
+// looked up, and counts the requests which carry credentials per IP address. The other
+// policies only apply once the client is known, so without it an invalid API key or
+// token would be rejected before any limit, and guessing credentials would be free.
+type Policies struct {
+	Allowlist      []string  `json:"allowlist"`
+	Authentication *Policy   `json:"authentication"`
+	Policies       []*Policy `json:"policies"`
+	Default        *Policy   `json:"default"`
+
+	// OnRedisError, if set, is called with every redis error which sent a request to
+	// the fallback.
+	OnRedisError func(error) `json:"-"`
+
+	allowlist []*net.IPNet
+	fallback  Fallback
+	breaker   *Breaker
+}
+
+// LoadPolicies() reads policies from JSON. The default and authentication policies fall
+// back to the given ones when the file doesn't define them.
+func LoadPolicies(r io.Reader, fallback, authentication *Policy) (*Policies, error) {
+	var p Policies
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+	err := dec.Decode(&p)
+	if err != nil {
+		return nil, fmt.Errorf("ratelimit: decoding policies: %w", err)
+	}
+	if p.Default == nil {
+		p.Default = fallback
+	}
+	if p.Authentication == nil {
+		p.Authentication = authentication
+	}
+	return &p, nil
+}
+
+// Init() validates the policies and sets up their limiters. Policies which don't name a
+// strategy use the given one.
+func (p *Policies) Init(client redis.Scripter, strategy string, fallback Fallback) error {
+	switch fallback.Mode {
+	case FallbackLocal, FallbackOpen, FallbackClosed:
+	default:
+		return fmt.Errorf("ratelimit: unknown fallback mode %q", fallback.Mode)
+	}
+	// A zero local size would let every request through the local fallback, and a zero
+	// timeout would fail every redis call and keep the breaker open.
+	switch {
+	case fallback.FailureThreshold <= 0:
+		return errors.New("ratelimit: the breaker failure threshold must be positive")
+	case fallback.Cooldown <= 0:
+		return errors.New("ratelimit: the breaker cooldown must be positive")
+	case fallback.Timeout <= 0:
+		return errors.New("ratelimit: the redis timeout must be positive")
+	case fallback.LocalSize <= 0:
+		return errors.New("ratelimit: the local limiter size must be positive")
+	}
+	p.fallback = fallback
+	p.breaker = NewBreaker(fallback.FailureThreshold, fallback.Cooldown)
+
+	for _, entry := range p.Allowlist {
+		if !strings.Contains(entry, "/") {
+			if strings.Contains(entry, ":") {
+				entry += "/128"
+			} else {
+				entry += "/32"
+			}
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return fmt.Errorf("ratelimit: allowlist: %w", err)
+		}
+		p.allowlist = append(p.allowlist, network)
+	}
+
+	if p.Default == nil {
+		return errors.New("ratelimit: no default policy")
+	}
+	if p.Default.Name == "" {
+		p.Default.Name = "default"
+	}
+
+	if p.Authentication == nil {
+		return errors.New("ratelimit: no authentication policy")
+	}
+	if p.Authentication.Name == "" {
+		p.Authentication.Name = "authentication"
+	}
+	auth := p.Authentication
+	if len(auth.Routes) > 0 || len(auth.Clients) > 0 || len(auth.Plans) > 0 {
+		return errors.New("ratelimit: the authentication policy applies to every request with credentials, it can't be restricted")
+	}
+	if auth.Key != "" && auth.Key != KeyIP {
+		return errors.New("ratelimit: the authentication policy can only count requests per ip")
+	}
+	auth.Key = KeyIP
+
+	names := map[string]bool{}
+	for _, policy := range append(p.Policies, p.Default, p.Authentication) {
+		if policy.Name == "" {
+			return errors.New("ratelimit: every policy must have a name")
+		}
+		if names[policy.Name] {
+			return fmt.Errorf("ratelimit: duplicate policy %q", policy.Name)
+		}
+		names[policy.Name] = true
+
+		if policy.Key == "" {
+			policy.Key = KeyUser
+		}
+		if policy.Key != KeyIP && policy.Key != KeyUser {
+			return fmt.Errorf("ratelimit: policy %q: unknown key %q", policy.Name, policy.Key)
+		}
+		for _, c := range policy.Clients {
+			if c != ClientAnonymous && c != ClientUser && c != ClientAPIKey && c != ClientOAuthApp {
+				return fmt.Errorf("ratelimit: policy %q: unknown client %q", policy.Name, c)
+			}
+		}
+		if policy.Strategy == "" {
+			policy.Strategy = strategy
+		}
+
+		limiter, err := New(client, policy.Strategy, policy.Limit, time.Duration(policy.Window))
+		if err != nil {
+			return fmt.Errorf("ratelimit: policy %q: %w", policy.Name, err)
+		}
+		policy.limiter = limiter
+		if fallback.Mode == FallbackLocal {
+			policy.local = NewLocalLimiter(policy.Limit, time.Duration(policy.Window), fallback.LocalSize)
+		}
+	}
+	return nil
+}
+
+// Degraded() reports whether redis is considered unavailable, so that requests are
+// being decided by the fallback.
+func (p *Policies) Degraded() bool {
+	return p.breaker.State() != BreakerClosed
+}
+
+// Allowlisted() reports whether requests from the IP address are exempt from limits.
+func (p *Policies) Allowlisted(ip string) bool {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return false
+	}
+	for _, network := range p.allowlist {
+		if network.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// Match() returns the first policy which matches the request, or the default one.
+func (p *Policies) Match(req Request) (*Policy, error) {
+	var plan *string
+	for _, policy := range p.Policies {
+		if len(policy.Routes) > 0 && !matchRoute(policy.Routes, req.Method, req.Path) {
+			continue
+		}
+		if len(policy.Clients) > 0 && !contains(policy.Clients, req.Client) {
+			continue
+		}
+		if len(policy.Plans) > 0 {
+			// Looking the plan up is the costly part, so it's done at most once and
+			// only when needed.
+			if plan == nil {
+				code := ""
+				if req.UserID != 0 && req.Plan != nil {
+					var err error
+					code, err = req.Plan()
+					if err != nil {
+						return nil, err
+					}
+				}
+				plan = &code
+			}
+			if *plan == "" || !(contains(policy.Plans, "*") || contains(policy.Plans, *plan)) {
+				continue
+			}
+		}
+		return policy, nil
+	}
+	return p.Default, nil
+}
+
+// Allow() counts the request against the limit of its policy. Redis errors don't fail
+// the request: they are handled by the fallback, and once they keep happening the
+// circuit breaker skips redis altogether for a while.
+func (p *Policies) Allow(ctx context.Context, policy *Policy, req Request) (Result, error) {
+	key := "ip:" + req.IP
+	if policy.Key == KeyUser && req.UserID != 0 {
+		key = "user:" + strconv.FormatInt(req.UserID, 10)
+	}
+	key = policy.Name + ":" + key
+
+	if p.breaker.Allow() {
+		ctx, cancel := context.WithTimeout(ctx, p.fallback.Timeout)
+		defer cancel()
+
+		result, err := policy.limiter.Allow(ctx, key)
+		if err == nil {
+			p.breaker.Success()
+			return result, nil
+		}
+		// A request canceled by its client says nothing about redis.
+		if errors.Is(err, context.Canceled) {
+			return Result{}, err
+		}
+		p.breaker.Failure()
+		if p.OnRedisError != nil {
+			p.OnRedisError(err)
+		}
+	}
+
+	switch p.fallback.Mode {
+	case FallbackOpen:
+		return Result{Allowed: true, Degraded: true}, nil
+	case FallbackClosed:
+		return Result{}, ErrUnavailable
+	default:
+		result := policy.local.Allow(key)
+		result.Degraded = true
+		return result, nil
+	}
+}
+
+func matchRoute(routes []string, method, path string) bool {
+	for _, route := range routes {
+		pattern := route
+		if m, p, ok := strings.Cut(route, " "); ok {
+			if m != method {
+				continue
+			}
+			pattern = p
+		}
+		if prefix, ok := strings.CutSuffix(pattern, "*"); ok {
+			if strings.HasPrefix(path, prefix) {
+				return true
+			}
+		} else if path == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
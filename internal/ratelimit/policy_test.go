@@ -0,0 +1,43 @@
+package ratelimit
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPoliciesInitFallback(t *testing.T) {
+	valid := Fallback{Mode: FallbackLocal, FailureThreshold: 5, Cooldown: time.Second, Timeout: time.Second, LocalSize: 100}
+
+	tests := []struct {
+		name    string
+		modify  func(f *Fallback)
+		wantErr bool
+	}{
+		{"valid", func(f *Fallback) {}, false},
+		{"unknown mode", func(f *Fallback) { f.Mode = "retry" }, true},
+		{"zero failure threshold", func(f *Fallback) { f.FailureThreshold = 0 }, true},
+		{"zero cooldown", func(f *Fallback) { f.Cooldown = 0 }, true},
+		{"zero timeout", func(f *Fallback) { f.Timeout = 0 }, true},
+		{"negative timeout", func(f *Fallback) { f.Timeout = -time.Second }, true},
+		{"zero local size", func(f *Fallback) { f.LocalSize = 0 }, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defaultPolicy := &Policy{Key: KeyIP, Limit: 10, Window: Duration(time.Second)}
+			authentication := &Policy{Key: KeyIP, Limit: 10, Window: Duration(time.Second)}
+			policies, err := LoadPolicies(strings.NewReader("{}"), defaultPolicy, authentication)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			fallback := valid
+			tt.modify(&fallback)
+			err = policies.Init(nil, GCRA, fallback)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("got error %v; want error %t", err, tt.wantErr)
+			}
+		})
+	}
+}
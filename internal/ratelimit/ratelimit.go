@@ -0,0 +1,210 @@
+// Package ratelimit limits how many requests a client can make over a window of time.
+// Each strategy is a Lua script, so that checking and updating a client's state is a
+// single atomic step in redis however many API replicas share it. Scripts read the
+// clock of the redis server, which keeps replicas with skewed clocks consistent.
+package ratelimit
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Strategies.
+const (
+	// Counts requests in consecutive fixed windows. Cheap, but a client can make twice
+	// the limit in a burst straddling the boundary between two windows.
+	FixedWindow = "fixed-window"
+	// Keeps the time of every request made over the last window. Exact, at the cost
+	// of memory proportional to the limit.
+	SlidingLog = "sliding-log"
+	// Weighs the count of the previous fixed window by how much of it still overlaps
+	// the sliding window. A close approximation of the sliding log in constant memory.
+	SlidingWindow = "sliding-window"
+	// The generic cell rate algorithm, a token bucket which refills continuously:
+	// requests are spread evenly over the window, with bursts of up to the limit.
+	GCRA = "gcra"
+)
+
+// Strategies lists the supported strategies.
+var Strategies = []string{FixedWindow, SlidingLog, SlidingWindow, GCRA}
+
+// Every script takes the window in microseconds, the limit and a random nonce, and
+// returns {allowed, remaining, retry after, reset}, durations in microseconds.
+// Remaining is how many more requests would be allowed right now, retry after how long
+// a rejected client has to wait, and reset how long until the client's quota is whole
+// again.
+var scripts = map[string]*redis.Script{
+	FixedWindow: redis.NewScript(`
+local window = tonumber(ARGV[1])
+local limit = tonumber(ARGV[2])
+local count = redis.call("INCR", KEYS[1])
+if count == 1 then
+	redis.call("PEXPIRE", KEYS[1], math.ceil(window / 1000))
+end
+local reset = redis.call("PTTL", KEYS[1]) * 1000
+if count > limit then
+	return {0, 0, reset, reset}
+end
+return {1, limit - count, 0, reset}
+`),
+
+	SlidingLog: redis.NewScript(`
+local time = redis.call("TIME")
+local now = tonumber(time[1]) * 1000000 + tonumber(time[2])
+local window = tonumber(ARGV[1])
+local limit = tonumber(ARGV[2])
+redis.call("ZREMRANGEBYSCORE", KEYS[1], "-inf", string.format("%.0f", now - window))
+local count = redis.call("ZCARD", KEYS[1])
+if count >= limit then
+	local oldest = redis.call("ZRANGE", KEYS[1], 0, 0, "WITHSCORES")
+	local wait = tonumber(oldest[2]) + window - now
+	return {0, 0, wait, wait}
+end
+redis.call("ZADD", KEYS[1], string.format("%.0f", now), ARGV[3])
+redis.call("PEXPIRE", KEYS[1], math.ceil(window / 1000))
+local oldest = redis.call("ZRANGE", KEYS[1], 0, 0, "WITHSCORES")
+return {1, limit - count - 1, 0, tonumber(oldest[2]) + window - now}
+`),
+
+	SlidingWindow: redis.NewScript(`
+local time = redis.call("TIME")
+local now = tonumber(time[1]) * 1000000 + tonumber(time[2])
+local window = tonumber(ARGV[1])
+local limit = tonumber(ARGV[2])
+local current = math.floor(now / window)
+local elapsed = now - current * window
+
+local state = redis.call("HMGET", KEYS[1], "window", "current", "previous")
+local last = tonumber(state[1]) or current
+local count = tonumber(state[2]) or 0
+local previous = tonumber(state[3]) or 0
+if last == current - 1 then
+	previous = count
+	count = 0
+elseif last ~= current then
+	previous = 0
+	count = 0
+end
+
+local weighted = previous * (window - elapsed) / window + count
+local allowed = weighted + 1 <= limit
+if allowed then
+	count = count + 1
+end
+redis.call("HSET", KEYS[1], "window", string.format("%.0f", current), "current", count, "previous", previous)
+redis.call("PEXPIRE", KEYS[1], math.ceil(2 * window / 1000))
+
+-- Requests of the current window keep counting, decreasingly, through the next one.
+local reset = window - elapsed
+if count > 0 then
+	reset = reset + window
+end
+if allowed then
+	return {1, math.floor(limit - weighted - 1), 0, reset}
+end
+
+-- How long until the weighted count leaves room for one more request, as the previous
+-- window slides out (and, if the current window alone is full, the current one too).
+local wait
+if count + 1 <= limit then
+	wait = window - elapsed - (limit - 1 - count) * window / previous
+else
+	wait = window - elapsed + window * (1 - (limit - 1) / count)
+end
+return {0, 0, math.ceil(wait), reset}
+`),
+
+	GCRA: redis.NewScript(`
+local time = redis.call("TIME")
+local now = tonumber(time[1]) * 1000000 + tonumber(time[2])
+local window = tonumber(ARGV[1])
+local limit = tonumber(ARGV[2])
+local interval = window / limit
+
+-- The theoretical arrival time: when the bucket will be full again.
+local tat = tonumber(redis.call("GET", KEYS[1])) or now
+if tat < now then
+	tat = now
+end
+
+local next = tat + interval
+local allowAt = next - window
+if allowAt > now then
+	return {0, 0, math.ceil(allowAt - now), math.ceil(tat - now)}
+end
+
+redis.call("SET", KEYS[1], string.format("%.0f", next), "PX", math.ceil((next - now) / 1000))
+return {1, math.floor((now - allowAt) / interval), 0, math.ceil(next - now)}
+`),
+}
+
+// Result is the outcome of a request against the limit.
+type Result struct {
+	Allowed    bool
+	Limit      int
+	Remaining  int
+	RetryAfter time.Duration
+	Reset      time.Duration
+	// Degraded is set when redis was unavailable and the fallback decided instead.
+	// Limit is zero when the fallback let the request through without counting it.
+	Degraded bool
+}
+
+// Limiter allows each key at most Limit requests per Window, as enforced by its strategy.
+type Limiter struct {
+	Strategy string
+	Limit    int
+	Window   time.Duration
+
+	client redis.Scripter
+	script *redis.Script
+}
+
+func New(client redis.Scripter, strategy string, limit int, window time.Duration) (*Limiter, error) {
+	script, ok := scripts[strategy]
+	if !ok {
+		return nil, fmt.Errorf("ratelimit: unknown strategy %q", strategy)
+	}
+	if limit <= 0 || window <= 0 {
+		return nil, fmt.Errorf("ratelimit: limit and window must be positive")
+	}
+	return &Limiter{Strategy: strategy, Limit: limit, Window: window, client: client, script: script}, nil
+}
+
+// Allow() counts a request by key, such as a client's IP address, and reports whether
+// it is within the limit.
+func (l *Limiter) Allow(ctx context.Context, key string) (Result, error) {
+	nonce := make([]byte, 8)
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return Result{}, err
+	}
+
+	// Each strategy keeps its state under its own keys, as they use different redis
+	// types; switching strategies simply starts everyone afresh.
+	keys := []string{"ratelimit:" + l.Strategy + ":" + key}
+	values, err := l.script.Run(ctx, l.client, keys, l.Window.Microseconds(), l.Limit, hex.EncodeToString(nonce)).Int64Slice()
+	if err != nil {
+		return Result{}, err
+	}
+	if len(values) != 4 {
+		return Result{}, fmt.Errorf("ratelimit: unexpected script result %v", values)
+	}
+
+	remaining := int(values[1])
+	if remaining < 0 {
+		remaining = 0
+	}
+	return Result{
+		Allowed:    values[0] == 1,
+		Limit:      l.Limit,
+		Remaining:  remaining,
+		RetryAfter: time.Duration(values[2]) * time.Microsecond,
+		Reset:      time.Duration(values[3]) * time.Microsecond,
+	}, nil
+}
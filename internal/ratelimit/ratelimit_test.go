@@ -0,0 +1,137 @@
+package ratelimit
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+// newTestRedis() starts an in-process redis whose clock, read by the scripts with
+// TIME, only moves when advance() is called.
+func newTestRedis(t *testing.T) (*redis.Client, func(d time.Duration)) {
+	t.Helper()
+
+	mr := miniredis.RunT(t)
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	mr.SetTime(now)
+
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { client.Close() })
+
+	advance := func(d time.Duration) {
+		now = now.Add(d)
+		mr.SetTime(now)
+		mr.FastForward(d)
+	}
+	return client, advance
+}
+
+func TestLimiterScripts(t *testing.T) {
+	const limit = 3
+	const window = time.Minute
+
+	for _, strategy := range Strategies {
+		t.Run(strategy, func(t *testing.T) {
+			client, advance := newTestRedis(t)
+			ctx := context.Background()
+
+			limiter, err := New(client, strategy, limit, window)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// The limit is spent one request at a time.
+			for i := 1; i <= limit; i++ {
+				result, err := limiter.Allow(ctx, "client")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !result.Allowed || result.Remaining != limit-i {
+					t.Fatalf("request %d: got allowed %t, remaining %d; want true, %d", i, result.Allowed, result.Remaining, limit-i)
+				}
+				if result.Reset <= 0 || result.Reset > 2*window {
+					t.Errorf("request %d: got reset %s; want within two windows", i, result.Reset)
+				}
+			}
+
+			rejected, err := limiter.Allow(ctx, "client")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if rejected.Allowed || rejected.Remaining != 0 {
+				t.Fatalf("got allowed %t, remaining %d over the limit; want false, 0", rejected.Allowed, rejected.Remaining)
+			}
+			// The sliding window has to slide partly past a full window before it
+			// has room again, so it can ask to wait for more than a window.
+			if rejected.RetryAfter <= 0 || rejected.RetryAfter > 2*window {
+				t.Fatalf("got retry after %s; want within two windows", rejected.RetryAfter)
+			}
+
+			// Other keys have their own limit.
+			other, err := limiter.Allow(ctx, "other")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !other.Allowed {
+				t.Error("got another key rejected; want it allowed")
+			}
+
+			// Just before the retry after elapses the client is still rejected, and
+			// once it has, it is allowed again.
+			advance(rejected.RetryAfter - time.Millisecond)
+			result, err := limiter.Allow(ctx, "client")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result.Allowed {
+				t.Errorf("got allowed %s before the retry after; want rejected", time.Millisecond)
+			}
+			advance(time.Millisecond)
+			result, err = limiter.Allow(ctx, "client")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !result.Allowed {
+				t.Fatal("got rejected after the retry after; want allowed")
+			}
+
+			// Once the reset of the last allowed request elapses, the whole limit is
+			// available again.
+			advance(result.Reset)
+			result, err = limiter.Allow(ctx, "client")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !result.Allowed || result.Remaining != limit-1 {
+				t.Errorf("got allowed %t, remaining %d after the reset; want true, %d", result.Allowed, result.Remaining, limit-1)
+			}
+		})
+	}
+}
+
+func TestNewLimiter(t *testing.T) {
+	tests := []struct {
+		name     string
+		strategy string
+		limit    int
+		window   time.Duration
+		wantErr  bool
+	}{
+		{"valid", GCRA, 10, time.Second, false},
+		{"unknown strategy", "leaky-bucket", 10, time.Second, true},
+		{"zero limit", GCRA, 0, time.Second, true},
+		{"negative window", GCRA, 10, -time.Second, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := New(nil, tt.strategy, tt.limit, tt.window)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("got error %v; want error %t", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,76 @@
+package totp
+
+import (
+	"net/url"
+	"testing"
+	"time"
+)
+
+// The SHA-1 secret of the test vectors of RFC 6238 appendix B.
+var rfcSecret = []byte("12345678901234567890")
+
+func TestCode(t *testing.T) {
+	// The RFC lists 8 digit codes; the 6 digit codes are their last 6 digits.
+	tests := []struct {
+		unix int64
+		want string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+
+	for _, tt := range tests {
+		got := Code(rfcSecret, Counter(time.Unix(tt.unix, 0)))
+		if got != tt.want {
+			t.Errorf("got %s at %d; want %s", got, tt.unix, tt.want)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	now := time.Unix(1111111111, 0)
+	current := Counter(now)
+
+	tests := []struct {
+		name        string
+		code        string
+		skew        int64
+		wantOK      bool
+		wantCounter int64
+	}{
+		{"current step", Code(rfcSecret, current), 0, true, current},
+		{"previous step within the skew", Code(rfcSecret, current-1), 1, true, current - 1},
+		{"next step within the skew", Code(rfcSecret, current+1), 1, true, current + 1},
+		{"previous step without skew", Code(rfcSecret, current-1), 0, false, 0},
+		{"step outside the skew", Code(rfcSecret, current-2), 1, false, 0},
+		{"wrong code", "000000", 1, false, 0},
+		{"8 digit code", "14050471", 1, false, 0},
+		{"empty code", "", 1, false, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			counter, ok := Validate(rfcSecret, tt.code, now, tt.skew)
+			if ok != tt.wantOK || counter != tt.wantCounter {
+				t.Errorf("got %d, %t; want %d, %t", counter, ok, tt.wantCounter, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestURI(t *testing.T) {
+	uri, err := url.Parse(URI("Greenlight", "alice@example.com", rfcSecret))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uri.Scheme != "otpauth" || uri.Host != "totp" || uri.Path != "/Greenlight:alice@example.com" {
+		t.Errorf("got %s; want otpauth://totp/Greenlight:alice@example.com", uri)
+	}
+	if got := uri.Query().Get("secret"); got != "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ" {
+		t.Errorf("got secret %s; want the unpadded base32 secret", got)
+	}
+}
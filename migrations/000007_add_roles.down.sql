@@ -0,0 +1,18 @@
+CREATE TABLE IF NOT EXISTS users_permissions(
+    user_id bigint NOT NULL REFERENCES users on DELETE CASCADE,
+    permission_id bigint  NOT NULL REFERENCES permissions on DELETE CASCADE,
+    PRIMARY KEY (user_id, permission_id)
+);
+
+INSERT INTO users_permissions
+SELECT DISTINCT users_roles.user_id, roles_permissions.permission_id
+FROM users_roles
+INNER JOIN roles_permissions ON roles_permissions.role_id = users_roles.role_id
+INNER JOIN permissions ON permissions.id = roles_permissions.permission_id
+WHERE permissions.code IN ('movies:read', 'movies:write');
+
+DROP TABLE IF EXISTS legacy_subscribe_grants;
+DROP TABLE IF EXISTS users_roles;
+DROP TABLE IF EXISTS roles_permissions;
+DROP TABLE IF EXISTS roles;
+DELETE FROM permissions WHERE code = 'admin:access';
@@ -0,0 +1,47 @@
+CREATE TABLE IF NOT EXISTS roles (
+    id bigserial PRIMARY KEY,
+    code text UNIQUE NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS roles_permissions (
+    role_id bigint NOT NULL REFERENCES roles ON DELETE CASCADE,
+    permission_id bigint NOT NULL REFERENCES permissions ON DELETE CASCADE,
+    PRIMARY KEY (role_id, permission_id)
+);
+
+CREATE TABLE IF NOT EXISTS users_roles (
+    user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+    role_id bigint NOT NULL REFERENCES roles ON DELETE CASCADE,
+    PRIMARY KEY (user_id, role_id)
+);
+
+INSERT INTO permissions (code) VALUES ('admin:access');
+
+INSERT INTO roles (code) VALUES ('viewer'), ('editor'), ('admin');
+
+INSERT INTO roles_permissions
+SELECT roles.id, permissions.id FROM roles, permissions
+WHERE (roles.code = 'viewer' AND permissions.code = 'movies:read')
+OR (roles.code = 'editor' AND permissions.code IN ('movies:read', 'movies:write'))
+OR roles.code = 'admin';
+
+-- Until now movies:write was only granted by the subscribe toggle. Remember who got it
+-- that way, so that those grants can later be told apart from the ones admins make.
+CREATE TABLE IF NOT EXISTS legacy_subscribe_grants (
+    user_id bigint PRIMARY KEY REFERENCES users ON DELETE CASCADE
+);
+
+INSERT INTO legacy_subscribe_grants
+SELECT DISTINCT users_permissions.user_id
+FROM users_permissions
+INNER JOIN permissions ON permissions.id = users_permissions.permission_id
+WHERE permissions.code = 'movies:write';
+
+-- Move the existing per-user grants onto the matching role.
+INSERT INTO users_roles
+SELECT DISTINCT users_permissions.user_id, roles.id
+FROM users_permissions
+INNER JOIN permissions ON permissions.id = users_permissions.permission_id
+INNER JOIN roles ON roles.code = CASE permissions.code WHEN 'movies:write' THEN 'editor' ELSE 'viewer' END;
+
+DROP TABLE IF EXISTS users_permissions;
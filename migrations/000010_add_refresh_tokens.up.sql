@@ -0,0 +1,12 @@
+ALTER TABLE tokens ADD COLUMN IF NOT EXISTS family text;
+ALTER TABLE tokens ADD COLUMN IF NOT EXISTS used_at timestamp(0) with time zone;
+
+CREATE INDEX IF NOT EXISTS tokens_family_idx ON tokens (family);
+
+CREATE TABLE IF NOT EXISTS signing_keys (
+    id text PRIMARY KEY,
+    algorithm text NOT NULL,
+    private_key bytea NOT NULL,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    retires_at timestamp(0) with time zone NOT NULL
+);
@@ -0,0 +1,39 @@
+CREATE TABLE IF NOT EXISTS plans (
+    id bigserial PRIMARY KEY,
+    code text UNIQUE NOT NULL,
+    name text NOT NULL,
+    role_id bigint NOT NULL REFERENCES roles,
+    price_cents integer NOT NULL CHECK (price_cents >= 0),
+    currency text NOT NULL DEFAULT 'usd',
+    period_days integer NOT NULL CHECK (period_days > 0),
+    trial_days integer NOT NULL DEFAULT 0 CHECK (trial_days >= 0),
+    active bool NOT NULL DEFAULT true,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW()
+);
+
+CREATE TABLE IF NOT EXISTS subscriptions (
+    id bigserial PRIMARY KEY,
+    user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+    plan_id bigint NOT NULL REFERENCES plans,
+    status text NOT NULL,
+    started_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    trial_ends_at timestamp(0) with time zone,
+    current_period_end timestamp(0) with time zone NOT NULL,
+    cancel_at_period_end bool NOT NULL DEFAULT false,
+    canceled_at timestamp(0) with time zone,
+    ended_at timestamp(0) with time zone,
+    version integer NOT NULL DEFAULT 1
+);
+
+-- A user has at most one subscription which hasn't ended.
+CREATE UNIQUE INDEX IF NOT EXISTS subscriptions_user_current_idx ON subscriptions (user_id)
+WHERE status IN ('trialing', 'active');
+
+CREATE INDEX IF NOT EXISTS subscriptions_period_end_idx ON subscriptions (current_period_end)
+WHERE status IN ('trialing', 'active');
+
+INSERT INTO plans (code, name, role_id, price_cents, period_days, trial_days)
+SELECT 'editor-monthly', 'Editor, monthly', roles.id, 500, 30, 14 FROM roles WHERE roles.code = 'editor';
+
+INSERT INTO plans (code, name, role_id, price_cents, period_days, trial_days)
+SELECT 'editor-yearly', 'Editor, yearly', roles.id, 5000, 365, 14 FROM roles WHERE roles.code = 'editor';
@@ -0,0 +1,10 @@
+DROP TABLE IF EXISTS payment_events;
+
+DELETE FROM subscriptions WHERE status = 'incomplete';
+DROP INDEX IF EXISTS subscriptions_user_current_idx;
+CREATE UNIQUE INDEX IF NOT EXISTS subscriptions_user_current_idx ON subscriptions (user_id)
+WHERE status IN ('trialing', 'active');
+
+ALTER TABLE subscriptions DROP COLUMN IF EXISTS provider_subscription_id;
+ALTER TABLE subscriptions DROP COLUMN IF EXISTS checkout_id;
+ALTER TABLE subscriptions DROP COLUMN IF EXISTS provider;
@@ -0,0 +1,20 @@
+ALTER TABLE subscriptions ADD COLUMN IF NOT EXISTS provider text;
+ALTER TABLE subscriptions ADD COLUMN IF NOT EXISTS checkout_id text;
+ALTER TABLE subscriptions ADD COLUMN IF NOT EXISTS provider_subscription_id text;
+
+-- Subscriptions now start incomplete, until the payment provider reports that the
+-- checkout was completed. They count towards the one current subscription per user.
+DROP INDEX IF EXISTS subscriptions_user_current_idx;
+CREATE UNIQUE INDEX IF NOT EXISTS subscriptions_user_current_idx ON subscriptions (user_id)
+WHERE status IN ('incomplete', 'trialing', 'active');
+
+-- Webhook events which have been processed, so that redeliveries are ignored. The
+-- subscription is the one the event referred to, which may not exist.
+CREATE TABLE IF NOT EXISTS payment_events (
+    provider text NOT NULL,
+    id text NOT NULL,
+    type text NOT NULL,
+    subscription_id bigint,
+    received_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (provider, id)
+);
@@ -0,0 +1,21 @@
+CREATE TABLE IF NOT EXISTS legacy_subscribe_grants (
+    user_id bigint PRIMARY KEY REFERENCES users ON DELETE CASCADE
+);
+
+-- Give the editor role back to the users of the complimentary subscriptions, which have
+-- no payment provider and were canceled the moment they started.
+INSERT INTO legacy_subscribe_grants
+SELECT DISTINCT user_id
+FROM subscriptions
+WHERE provider IS NULL AND canceled_at = started_at
+ON CONFLICT DO NOTHING;
+
+INSERT INTO users_roles
+SELECT subscriptions.user_id, roles.id
+FROM subscriptions, roles
+WHERE subscriptions.provider IS NULL AND subscriptions.canceled_at = subscriptions.started_at
+AND roles.code = 'editor'
+ON CONFLICT DO NOTHING;
+
+DELETE FROM subscriptions
+WHERE provider IS NULL AND canceled_at = started_at;
@@ -0,0 +1,41 @@
+-- Before subscription plans, subscribing simply granted the editor role, for free and
+-- for good. The editors who got the role that way, as recorded by migration 7, are
+-- given a complimentary subscription to the monthly editor plan instead, canceled so
+-- that it ends after one period, and the role is revoked. Editors who already
+-- subscribed through the payment provider only lose the role. Every other editor role,
+-- such as those granted by admins, is left alone.
+-- Databases migrated past migration 7 before it recorded the grants have no record of
+-- them, so no role is converted.
+CREATE TABLE IF NOT EXISTS legacy_subscribe_grants (
+    user_id bigint PRIMARY KEY REFERENCES users ON DELETE CASCADE
+);
+
+INSERT INTO subscriptions (user_id, plan_id, status, current_period_end, cancel_at_period_end, canceled_at)
+SELECT users_roles.user_id, plans.id, 'active', NOW() + make_interval(days => plans.period_days), true, NOW()
+FROM users_roles
+INNER JOIN legacy_subscribe_grants ON legacy_subscribe_grants.user_id = users_roles.user_id
+INNER JOIN roles ON roles.id = users_roles.role_id
+INNER JOIN plans ON plans.code = 'editor-monthly'
+WHERE roles.code = 'editor'
+AND NOT EXISTS (
+    SELECT 1 FROM users_roles admins
+    INNER JOIN roles admin_roles ON admin_roles.id = admins.role_id
+    WHERE admins.user_id = users_roles.user_id AND admin_roles.code = 'admin'
+)
+AND NOT EXISTS (
+    SELECT 1 FROM subscriptions
+    WHERE subscriptions.user_id = users_roles.user_id
+    AND subscriptions.status IN ('incomplete', 'trialing', 'active')
+);
+
+DELETE FROM users_roles
+USING roles, legacy_subscribe_grants
+WHERE roles.id = users_roles.role_id AND roles.code = 'editor'
+AND legacy_subscribe_grants.user_id = users_roles.user_id
+AND NOT EXISTS (
+    SELECT 1 FROM users_roles admins
+    INNER JOIN roles admin_roles ON admin_roles.id = admins.role_id
+    WHERE admins.user_id = users_roles.user_id AND admin_roles.code = 'admin'
+);
+
+DROP TABLE IF EXISTS legacy_subscribe_grants;